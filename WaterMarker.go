@@ -1,203 +1,1348 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"image"
 	"image/color"
-	"image/draw"
-	"image/jpeg"
-	"image/png"
 	"io/fs"
-	"log"
 	"os"
 	"path"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/nfnt/resize"
+	"golang.org/x/time/rate"
 )
 
 func main() {
-	fmt.Println("**************************************************************************")
-	fmt.Println("*                                                                        *")
-	fmt.Println("*      WaterMarker v1.0 - Written by Tjeerd Bakker (ICheered) in Go      *")
-	fmt.Println("*                                                                        *")
-	fmt.Println("**************************************************************************")
-	fmt.Println("")
-	fmt.Println("For help: run the program from command line with the -h flag")
-	fmt.Println("Having issues? Please let me know at Tjeerd992@gmail.com")
-	fmt.Println("")
-	watermarkOpacity, watermarkLocation, watermarkScale, watermarkFile, sourceDir, targetDir, force := getParameters()
-
-	fmt.Println("Using following parameters:")
-	fmt.Printf("- Opacity:          %d\n", watermarkOpacity)
-	fmt.Printf("- Location:         %s\n", watermarkLocation)
-	fmt.Printf("- Scale:            %1.1f\n", watermarkScale)
-	fmt.Printf("- Watermark:        %s\n", watermarkFile)
-	fmt.Printf("- Source directory: %s\n", sourceDir)
-	fmt.Printf("- Target directory: %s\n", targetDir)
-	fmt.Println("")
-
-	if _, err := os.Stat(watermarkFile); errors.Is(err, os.ErrNotExist) {
-		// Watermark file does not exist
-		fmt.Printf("ERROR: Watermark file '%s' does not exist in this directory\n", watermarkFile)
-		os.Exit(1)
-	}
-
-	if !strings.HasSuffix(watermarkFile, ".png") {
-		fmt.Printf("ERROR: Watermark file '%s' is not a PNG file\n", watermarkFile)
-		os.Exit(1)
-	}
-
-	if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
+	params := getParameters()
+	if params.sourceDir == "-" {
+		console.stderr = true
+	}
+	console.json = params.logJSON
+	if !params.noBanner {
+		printBanner()
+	}
+	if params.extract != "" {
+		os.Exit(extractMode(params.extract))
+	}
+	if params.verify != "" {
+		if params.invisible == "" {
+			console.Println("ERROR: Use -verify together with the expected -invisible text")
+			os.Exit(exitUsage)
+		}
+		os.Exit(verifyMode(params.verify, params.invisible))
+	}
+	if params.logFile != "" {
+		if err := console.openFile(params.logFile, params.logAppend); err != nil {
+			console.Printf("ERROR: Could not open log file '%s': %s\n", params.logFile, err)
+			os.Exit(exitIO)
+		}
+	}
+
+	console.Println("Using following parameters:")
+	if params.opacityRamp {
+		console.Printf("- Opacity:          ramp from %d to %d\n", params.rampStart, params.rampEnd)
+	} else if params.location == "tile" {
+		console.Printf("- Opacity:          %d\n", params.tileOpacity)
+	} else if params.adaptiveOpacity != "off" {
+		console.Printf("- Opacity:          %d-%d, adapted to %s areas\n", params.adaptiveMin, params.adaptiveMax, params.adaptiveOpacity)
+	} else if params.autoOpacity {
+		console.Println("- Opacity:          mean alpha of the watermark")
+	} else {
+		console.Printf("- Opacity:          %d\n", params.opacity)
+	}
+	if params.opacityPixels != "all" {
+		console.Printf("- Opacity pixels:   %s only\n", params.opacityPixels)
+	}
+	if params.alternate {
+		console.Printf("- Location:         alternating %s and %s\n", alternateLocation(params.location, false), alternateLocation(params.location, true))
+	} else if params.anchor.isSet() {
+		console.Printf("- Location:         anchored %s\n", params.anchor.String())
+	} else if params.offsetX != 0 || params.offsetY != 0 {
+		console.Printf("- Location:         %s, %g%% x %g%% in from the corner\n", params.location, params.offsetX*100, params.offsetY*100)
+	} else {
+		console.Printf("- Location:         %s\n", params.location)
+	}
+	if params.safeZone > 0 {
+		console.Printf("- Safe zone:        %g%% along every edge\n", params.safeZone)
+	}
+	if params.parseNames {
+		console.Println("- Parse names:      location and opacity from file names")
+	}
+	if params.paramsFromExif {
+		console.Println("- EXIF settings:    location and opacity from Watermark: keywords")
+	}
+	if params.sortOrder != "name" {
+		console.Printf("- Order:            %s\n", params.sortOrder)
+	}
+	if params.watermarkBox.isSet() {
+		console.Printf("- Scale:            fit in %s box\n", params.watermarkBox.String())
+	} else if params.referenceResolution.isSet() {
+		console.Printf("- Scale:            %s of %s at %s\n", params.scale.String(), params.scaleMode, params.referenceResolution.String())
+	} else {
+		console.Printf("- Scale:            %s of %s\n", params.scale.String(), params.scaleMode)
+	}
+	if params.linearBlend {
+		console.Printf("- Blend mode:       %s, in linear light\n", params.blend)
+	} else {
+		console.Printf("- Blend mode:       %s\n", params.blend)
+	}
+	if params.channels != "rgb" {
+		console.Printf("- Channels:         %s\n", params.channels)
+	}
+	console.Printf("- Background:       %s\n", params.background.String())
+	if params.smartQuality > 0 && params.outputFormat != "png" {
+		console.Printf("- JPEG quality:     smart, SSIM at least %g\n", params.smartQuality)
+	}
+	if params.outputFormat == "png" {
+		console.Printf("- Output format:    png, %s compression\n", params.pngCompression)
+	} else if params.outputFormat == "jpeg" && params.encoder == "turbo" {
+		console.Printf("- Output format:    jpeg, turbo encoder with %s DCT and %s subsampling\n", params.dct, params.subsampling)
+	} else {
+		console.Printf("- Output format:    %s\n", params.outputFormat)
+	}
+	if params.invisible != "" {
+		console.Printf("- Invisible text:   %s\n", params.invisible)
+	}
+	if params.aspect.isSet() {
+		console.Printf("- Aspect ratio:     %s\n", params.aspect.String())
+	}
+	if len(params.sizes) > 0 {
+		console.Printf("- Sizes:            %s\n", params.sizes.String())
+	}
+	if params.webSize > 0 {
+		console.Printf("- Web size:         %dpx in %s, full size in %s\n", params.webSize, webDir, fullDir)
+	}
+	if params.minSourceRatio > 0 {
+		action := "warn"
+		if params.minSourceRatioSkip {
+			action = "skip"
+		}
+		console.Printf("- Min source ratio: %g times the watermark area, else %s\n", params.minSourceRatio, action)
+	}
+	if params.logEvery > 0 {
+		console.Printf("- Progress:         every %d files\n", params.logEvery)
+	}
+	if params.rotateSource != 0 {
+		console.Printf("- Rotate photos:    %d degrees\n", params.rotateSource)
+	}
+	if params.proof {
+		console.Printf("- Proof copies:     opacity %d\n", params.proofOpacity)
+	}
+	if params.final {
+		console.Printf("- Final copies:     opacity %d\n", params.finalOpacity)
+	}
+	if params.sharpen > 0 {
+		console.Printf("- Sharpen:          %g (radius %gpx)\n", params.sharpen, params.sharpenRadius)
+	}
+	if params.backdropBlur > 0 {
+		console.Printf("- Backdrop:         blurred %gpx, padding %g\n", params.backdropBlur, params.backdropPadding)
+	}
+	if params.backdropColor.isSet() {
+		console.Printf("- Backdrop panel:   %s at opacity %d, padding %g\n", params.backdropColor.String(), params.backdropOpacity, params.backdropPadding)
+	}
+	if params.vignette > 0 {
+		console.Printf("- Vignette:         %g (radius %g)\n", params.vignette, params.vignetteRadius)
+	}
+	if params.shape == "rounded" {
+		console.Printf("- Shape:            rounded (radius %d%%)\n", params.radius)
+	} else if params.shape != "" {
+		console.Printf("- Shape:            %s\n", params.shape)
+	}
+	if params.maxMemory > 0 {
+		console.Printf("- Max memory:       %s\n", params.maxMemory.String())
+	}
+	if len(params.recolor) > 0 {
+		console.Printf("- Recolor:          %s (tolerance %d)\n", params.recolor.String(), params.recolorTolerance)
+	}
+	if params.border > 0 {
+		console.Printf("- Border:           %dpx %s\n", params.border, params.borderColor.String())
+	}
+	if params.overlayOnly {
+		console.Println("- Overlay only:     watermark on a transparent canvas, without the photo")
+	}
+	if params.subjectMasks {
+		console.Printf("- Subject masks:    watermark behind the subject in *%s\n", subjectMaskSuffix)
+	}
+	if params.noWatermark {
+		console.Println("- Watermark:        none, only converting photos")
+	} else if params.bar {
+		console.Printf("- Watermark:        %s bar with text '%s'\n", params.barColor.String(), params.text)
+	} else if params.textTemplate != "" {
+		console.Printf("- Watermark:        %s text '%s'\n", params.textColor.String(), params.textTemplate)
+	} else if params.watermarkDir != "" {
+		console.Printf("- Watermark:        every watermark in %s\n", params.watermarkDir)
+	} else if params.watermarkRandomDir != "" {
+		console.Printf("- Watermark:        a random watermark in %s, seed %d\n", params.watermarkRandomDir, params.seed)
+	} else {
+		console.Printf("- Watermark:        %s\n", params.watermark)
+	}
+	if params.sourceArchive != "" {
+		console.Printf("- Source archive:   %s\n", params.sourceArchive)
+	} else {
+		console.Printf("- Source directory: %s\n", params.sourceDir)
+	}
+	if params.filesFrom == "-" {
+		console.Println("- Files:            listed on stdin")
+	} else if params.filesFrom != "" {
+		console.Printf("- Files:            listed in %s\n", params.filesFrom)
+	}
+	if params.depth != 0 {
+		console.Printf("- Depth:            %d\n", params.depth)
+	}
+	console.Printf("- Target directory: %s\n", params.targetDir)
+	if params.tmpDir != "" {
+		console.Printf("- Temp directory:   %s\n", params.tmpDir)
+	}
+	if params.fsync {
+		console.Println("- Sync to disk:     after every photo")
+	}
+	if params.verifyOutput {
+		console.Println("- Verify output:    read every photo back after writing it")
+	}
+	if params.stateFile != "" {
+		console.Printf("- State file:       %s\n", params.stateFile)
+	}
+	if params.deadline > 0 {
+		console.Printf("- Deadline:         %s\n", params.deadline)
+	}
+	if params.rate > 0 {
+		console.Printf("- Rate:             %g files per second\n", params.rate)
+	}
+	if params.srgb {
+		console.Println("- Color space:      convert to sRGB")
+	}
+	if params.printSize.isSet() {
+		console.Printf("- Print size:       %s inches at %d DPI\n", params.printSize.String(), params.dpi)
+	} else if params.dpi > 0 {
+		console.Printf("- Print density:    %d DPI\n", params.dpi)
+	}
+	if params.copyright != "" {
+		console.Printf("- Copyright:        %s\n", params.copyright)
+	}
+	if params.comment != "" {
+		console.Printf("- Comment:          %s\n", params.comment)
+	}
+	if params.noRecompress {
+		console.Println("- Recompress:       no, JPEG photos are copied as they are")
+	}
+	if params.csvReport != "" {
+		console.Printf("- CSV report:       %s\n", params.csvReport)
+	}
+	if params.emitPlacement != "" {
+		console.Printf("- Placements:       %s\n", params.emitPlacement)
+	}
+	if params.placementCombined {
+		console.Printf("- Placement SVG:    %s\n", path.Join(params.targetDir, placementSVGName))
+	} else if params.placementSVG {
+		console.Println("- Placement SVG:    next to every output file")
+	}
+	if params.compare != "" {
+		console.Printf("- Compare:          %s, %s, %dpx gap, in %s\n", params.compare, params.compareDirection, params.compareGap, path.Join(params.targetDir, compareDir))
+	}
+	console.Println("")
+
+	if params.tmpDir != "" {
+		if err := checkTmpDir(params.tmpDir); err != nil {
+			console.Printf("ERROR: Can not use temporary directory: %s\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	if params.force && params.noClobber {
+		console.Println("ERROR: --force and --no-clobber can not be used together")
+		os.Exit(exitUsage)
+	}
+
+	if params.compare != "" {
+		if !contains(compareLayouts, params.compare) {
+			console.Printf("ERROR: Unknown comparison layout '%s', use one of [%s]\n", params.compare, strings.Join(compareLayouts, ", "))
+			os.Exit(exitUsage)
+		}
+		if !contains(compareDirections, params.compareDirection) {
+			console.Printf("ERROR: Unknown comparison direction '%s', use one of [%s]\n", params.compareDirection, strings.Join(compareDirections, ", "))
+			os.Exit(exitUsage)
+		}
+		if params.compareGap < 0 || params.compareGap > 1000 {
+			console.Printf("ERROR: --compare-gap must be between 0 and 1000 pixels, got %d\n", params.compareGap)
+			os.Exit(exitUsage)
+		}
+		if params.noWatermark || params.overlayOnly {
+			console.Println("ERROR: --compare shows the photo before and after watermarking, it can not be used with --no-watermark or --overlay-only")
+			os.Exit(exitUsage)
+		}
+	}
+	if params.contactSheet && (params.contactCols <= 0 || params.contactThumb <= 0) {
+		console.Println("ERROR: Contact sheet columns and thumbnail size must be greater than 0")
+		os.Exit(exitUsage)
+	}
+
+	if params.rotateSource != 0 && params.rotateSource != 90 && params.rotateSource != 180 && params.rotateSource != 270 {
+		console.Printf("ERROR: Unknown rotation %d, use one of [90, 180, 270]\n", params.rotateSource)
+		os.Exit(exitUsage)
+	}
+
+	if params.offsetX < 0 || params.offsetX >= 1 || params.offsetY < 0 || params.offsetY >= 1 {
+		console.Printf("ERROR: Offsets are fractions of the photo size, at least 0 and below 1, got %g and %g\n", params.offsetX, params.offsetY)
+		os.Exit(exitUsage)
+	}
+	if params.anchor.isSet() && (params.offsetX != 0 || params.offsetY != 0) {
+		console.Println("ERROR: --anchor moves the watermark with its own nudges, it can not be used with --offset-x and --offset-y")
+		os.Exit(exitUsage)
+	}
+
+	if params.safeZone < 0 || params.safeZone >= 50 {
+		console.Printf("ERROR: Safe zone is a percentage of the photo size, at least 0 and below 50, got %g\n", params.safeZone)
+		os.Exit(exitUsage)
+	}
+
+	if params.smartQuality < 0 || params.smartQuality >= 1 {
+		console.Printf("ERROR: Smart quality is the SSIM to reach, between 0 and 1 such as 0.98, got %g\n", params.smartQuality)
+		os.Exit(exitUsage)
+	}
+
+	if params.recolorTolerance < 0 || params.recolorTolerance > 255 {
+		console.Printf("ERROR: Recolor tolerance must be between 0 and 255, got %d\n", params.recolorTolerance)
+		os.Exit(exitUsage)
+	}
+
+	if params.minSourceRatio < 0 {
+		console.Printf("ERROR: Minimum source ratio must not be negative, got %g\n", params.minSourceRatio)
+		os.Exit(exitUsage)
+	}
+
+	if params.rate < 0 {
+		console.Printf("ERROR: Rate must not be negative, got %g\n", params.rate)
+		os.Exit(exitUsage)
+	}
+	if params.maxErrors < 0 {
+		console.Printf("ERROR: Max errors must not be negative, got %d\n", params.maxErrors)
+		os.Exit(exitUsage)
+	}
+
+	if params.deadline < 0 {
+		console.Printf("ERROR: Deadline must not be negative, got %s\n", params.deadline)
+		os.Exit(exitUsage)
+	}
+	if params.fileTimeout < 0 {
+		console.Printf("ERROR: File timeout must not be negative, got %s\n", params.fileTimeout)
+		os.Exit(exitUsage)
+	}
+
+	if params.watermarkCache < 0 {
+		console.Printf("ERROR: Watermark cache size must not be negative, got %d\n", params.watermarkCache)
+		os.Exit(exitUsage)
+	}
+
+	if params.timings < 0 {
+		console.Printf("ERROR: Timings must not be negative, got %d\n", params.timings)
+		os.Exit(exitUsage)
+	}
+	if params.logEvery < 0 {
+		console.Printf("ERROR: Log every must not be negative, got %d\n", params.logEvery)
+		os.Exit(exitUsage)
+	}
+
+	if params.proofOpacity < 0 || params.proofOpacity > 100 || params.finalOpacity < 0 || params.finalOpacity > 100 {
+		console.Println("ERROR: Proof and final opacity must be between 0 and 100")
+		os.Exit(exitUsage)
+	}
+
+	if params.backdropBlur < 0 || params.backdropBlur > 100 {
+		console.Printf("ERROR: Backdrop blur must be between 0 and 100 pixels, got %g\n", params.backdropBlur)
+		os.Exit(exitUsage)
+	}
+	if params.backdropPadding < 0 || params.backdropPadding > 2 {
+		console.Printf("ERROR: Backdrop padding must be between 0 and 2 times the watermark height, got %g\n", params.backdropPadding)
+		os.Exit(exitUsage)
+	}
+	if params.backdropOpacity < 0 || params.backdropOpacity > 100 {
+		console.Printf("ERROR: Backdrop opacity must be between 0 and 100, got %d\n", params.backdropOpacity)
+		os.Exit(exitUsage)
+	}
+	if params.backdropColor.isSet() && (params.bar || params.noWatermark) {
+		console.Println("ERROR: --backdrop-color draws a panel behind the watermark, it can not be used with --bar or --no-watermark")
+		os.Exit(exitUsage)
+	}
+	if params.backdropBlur > 0 && (params.bar || params.noWatermark || params.overlayOnly) {
+		console.Println("ERROR: --backdrop-blur blurs the photo behind the watermark, it can not be used with --bar, --no-watermark or --overlay-only")
+		os.Exit(exitUsage)
+	}
+	if params.sharpen < 0 || params.sharpenRadius <= 0 {
+		console.Println("ERROR: Sharpen amount must not be negative and its radius must be greater than 0")
+		os.Exit(exitUsage)
+	}
+
+	if params.vignette < 0 || params.vignette > 1 || params.vignetteRadius < 0 || params.vignetteRadius >= 1 {
+		console.Println("ERROR: Vignette strength must be between 0 and 1, and its radius at least 0 and less than 1")
+		os.Exit(exitUsage)
+	}
+
+	if params.shape != "" && params.shape != "circle" && params.shape != "rounded" {
+		console.Printf("ERROR: Unknown shape '%s', use circle or rounded\n", params.shape)
+		os.Exit(exitUsage)
+	}
+	if params.shape != "" && params.outputFormat != "png" {
+		console.Println("ERROR: --shape makes the corners of photos transparent, use it with -output-format png")
+		os.Exit(exitUsage)
+	}
+	if params.radius < 0 || params.radius > 50 {
+		console.Printf("ERROR: Radius must be between 0 and 50, got %d\n", params.radius)
+		os.Exit(exitUsage)
+	}
+
+	if params.encodePath && strings.ContainsAny(params.pathSeparator, `/\`) {
+		console.Printf("ERROR: Path separator '%s' can not contain a slash\n", params.pathSeparator)
+		os.Exit(exitUsage)
+	}
+
+	if params.border < 0 {
+		console.Printf("ERROR: Border width must not be negative, got %d\n", params.border)
+		os.Exit(exitUsage)
+	}
+
+	if params.barEdge != "top" && params.barEdge != "bottom" {
+		console.Printf("ERROR: Unknown bar edge '%s', use one of [top, bottom]\n", params.barEdge)
+		os.Exit(exitUsage)
+	}
+
+	if !contains(locations, params.location) {
+		console.Printf("ERROR: Unknown location '%s', use one of [%s]\n", params.location, strings.Join(locations, ", "))
+		os.Exit(exitUsage)
+	}
+
+	if !contains(adaptiveModes, params.adaptiveOpacity) {
+		console.Printf("ERROR: Unknown adaptive opacity '%s', use one of [%s]\n", params.adaptiveOpacity, strings.Join(adaptiveModes, ", "))
+		os.Exit(exitUsage)
+	}
+
+	if params.adaptiveMin < 0 || params.adaptiveMax > 100 || params.adaptiveMin > params.adaptiveMax {
+		console.Printf("ERROR: Adaptive opacity range %d-%d must be within 0 and 100\n", params.adaptiveMin, params.adaptiveMax)
+		os.Exit(exitUsage)
+	}
+
+	if params.opacityRamp && (params.rampStart < 0 || params.rampStart > 100 || params.rampEnd < 0 || params.rampEnd > 100) {
+		console.Printf("ERROR: Opacity ramp %d-%d must be within 0 and 100\n", params.rampStart, params.rampEnd)
+		os.Exit(exitUsage)
+	}
+
+	if params.watermarkDir != "" && (params.bar || params.noWatermark || params.textTemplate != "") {
+		console.Println("ERROR: --watermark-dir replaces the watermark file, it can not be used with --bar, --no-watermark or --text-template")
+		os.Exit(exitUsage)
+	}
+	if params.watermarkRandomDir != "" && (params.bar || params.noWatermark || params.textTemplate != "" || params.watermarkDir != "") {
+		console.Println("ERROR: --watermark-random-dir replaces the watermark file, it can not be used with --bar, --no-watermark, --text-template or --watermark-dir")
+		os.Exit(exitUsage)
+	}
+	if params.autoOpacity && (params.bar || params.noWatermark || params.textTemplate != "" || params.watermarkDir != "" || params.watermarkRandomDir != "") {
+		console.Println("ERROR: --auto-opacity-from-watermark needs a watermark file, it can not be used with --bar, --no-watermark, --text-template, --watermark-dir or --watermark-random-dir")
+		os.Exit(exitUsage)
+	}
+	if params.autoOpacity && (params.opacityRamp || params.adaptiveOpacity != "off" || params.location == "tile") {
+		console.Println("ERROR: --auto-opacity-from-watermark sets the -opacity, which --opacity-ramp, --adaptive-opacity and the tile location replace")
+		os.Exit(exitUsage)
+	}
+	if params.opacityRamp && params.adaptiveOpacity != "off" {
+		console.Println("ERROR: --opacity-ramp and --adaptive-opacity both set the opacity per photo, they can not be used together")
+		os.Exit(exitUsage)
+	}
+
+	if !contains(outputFormats, params.outputFormat) {
+		console.Printf("ERROR: Unknown output format '%s', use one of [%s]\n", params.outputFormat, strings.Join(outputFormats, ", "))
+		os.Exit(exitUsage)
+	}
+	if params.verifyOutput && params.outputFormat == "avif" {
+		console.Println("ERROR: --verify-output can not read AVIF files back, use it with another -output-format")
+		os.Exit(exitUsage)
+	}
+	if !contains(jpegEncoders, params.encoder) {
+		console.Printf("ERROR: Unknown JPEG encoder '%s', use one of [%s]\n", params.encoder, strings.Join(jpegEncoders, ", "))
+		os.Exit(exitUsage)
+	}
+	if params.encoder == "turbo" {
+		if !turboSupported {
+			console.Println("ERROR: This build of WaterMarker has no turbo encoder, build it with libjpeg-turbo and -tags jpegturbo")
+			os.Exit(exitUsage)
+		}
+		if params.smartQuality > 0 {
+			console.Println("ERROR: --smart-quality searches the quality with the std encoder, it can not be used with -encoder turbo")
+			os.Exit(exitUsage)
+		}
+		if params.dct == "" {
+			params.dct = "islow"
+		}
+		if params.subsampling == "" {
+			params.subsampling = "420"
+		}
+		if !contains(dctMethods, params.dct) {
+			console.Printf("ERROR: Unknown DCT method '%s', use one of [%s]\n", params.dct, strings.Join(dctMethods, ", "))
+			os.Exit(exitUsage)
+		}
+		if !contains(chromaSubsamplings, params.subsampling) {
+			console.Printf("ERROR: Unknown chroma subsampling '%s', use one of [%s]\n", params.subsampling, strings.Join(chromaSubsamplings, ", "))
+			os.Exit(exitUsage)
+		}
+	} else if params.dct != "" || params.subsampling != "" {
+		console.Println("ERROR: --dct and --subsampling are settings of the turbo encoder, use them with -encoder turbo")
+		os.Exit(exitUsage)
+	}
+	if params.outputFormat == "avif" && !avifSupported {
+		console.Println("ERROR: This build of WaterMarker can not write AVIF, build it with libavif and -tags avif")
+		os.Exit(exitUsage)
+	}
+
+	if _, ok := pngCompressionLevels[params.pngCompression]; !ok {
+		console.Printf("ERROR: Unknown PNG compression '%s', use one of [default, none, speed, best]\n", params.pngCompression)
+		os.Exit(exitUsage)
+	}
+
+	if params.overlayOnly && (params.outputFormat != "png" || params.blend != "normal" || params.noWatermark || params.invisible != "" || params.border > 0) {
+		console.Println("ERROR: --overlay-only writes the watermark on a transparent canvas, use it with -output-format png and without -blend, -no-watermark, -invisible or -border")
+		os.Exit(exitUsage)
+	}
+
+	if params.invisible != "" && params.outputFormat != "png" {
+		console.Println("ERROR: The invisible watermark is destroyed by JPEG compression, use it with -output-format png")
+		os.Exit(exitUsage)
+	}
+
+	if params.dpi < 0 || params.dpi > 0xffff {
+		console.Printf("ERROR: DPI must be between 1 and 65535, got %d\n", params.dpi)
+		os.Exit(exitUsage)
+	}
+	if (params.copyright != "" || params.comment != "") && params.outputFormat != "jpeg" && params.outputFormat != "png" {
+		console.Println("ERROR: --copyright and --comment are stored in JPEG and PNG output, use them with -output-format jpeg or png")
+		os.Exit(exitUsage)
+	}
+	if len(params.copyright) > maxTextMetadata || len(params.comment) > maxTextMetadata {
+		console.Printf("ERROR: --copyright and --comment can be at most %d bytes long\n", maxTextMetadata)
+		os.Exit(exitUsage)
+	}
+	if params.noRecompress {
+		if !params.noWatermark || params.outputFormat != "jpeg" {
+			console.Println("ERROR: --no-recompress copies photos without changing their pixels, use it with --no-watermark and -output-format jpeg")
+			os.Exit(exitUsage)
+		}
+		if len(params.sizes) > 0 || params.webSize > 0 || params.printSize.isSet() || params.aspect.isSet() || params.rotateSource != 0 || params.proof ||
+			params.sharpen > 0 || params.vignette > 0 || params.border > 0 || params.srgb || params.dpi > 0 {
+			console.Println("ERROR: --no-recompress can not be used with options that change the pixels or their encoding, such as --sizes, --rotate-source, --sharpen, --border, --srgb or --dpi")
+			os.Exit(exitUsage)
+		}
+		if params.verifyOutput || params.contactSheet {
+			console.Println("ERROR: --no-recompress doesn't decode the photos, it can not be used with --verify-output or --contact-sheet")
+			os.Exit(exitUsage)
+		}
+	}
+	if params.placementCombined && !params.placementSVG {
+		console.Println("ERROR: --placement-svg-combined needs --placement-svg")
+		os.Exit(exitUsage)
+	}
+	if params.textTemplate != "" {
+		if params.bar || params.noWatermark {
+			console.Println("ERROR: --text-template replaces the watermark file, it can not be used with --bar or --no-watermark")
+			os.Exit(exitUsage)
+		}
+		if err := checkTextTemplate(params.textTemplate); err != nil {
+			console.Printf("ERROR: %s\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if params.filesFrom != "" && params.sourceArchive != "" {
+		console.Println("ERROR: --files-from lists photos on disk, it can not be used with --source-archive")
+		os.Exit(exitUsage)
+	}
+	if params.filesFrom == "-" && params.interactive {
+		console.Println("ERROR: --files-from - reads the list from stdin, which --interactive needs for its commands")
+		os.Exit(exitUsage)
+	}
+	if params.printSize.isSet() && params.dpi == 0 {
+		console.Println("ERROR: --print-size needs the --dpi to print at")
+		os.Exit(exitUsage)
+	}
+	if params.printSize.isSet() && len(params.sizes) > 0 {
+		console.Println("ERROR: --print-size and --sizes both set the size of the output, they can not be used together")
+		os.Exit(exitUsage)
+	}
+	if params.webSize < 0 {
+		console.Printf("ERROR: Web size must not be negative, got %d\n", params.webSize)
+		os.Exit(exitUsage)
+	}
+	if params.webSize > 0 && (len(params.sizes) > 0 || params.printSize.isSet()) {
+		console.Println("ERROR: --web-size writes a full size and a web copy, it can not be used with --sizes or --print-size")
+		os.Exit(exitUsage)
+	}
+
+	if !contains(sortOrders, params.sortOrder) {
+		console.Printf("ERROR: Unknown sort order '%s', use one of [%s]\n", params.sortOrder, strings.Join(sortOrders, ", "))
+		os.Exit(exitUsage)
+	}
+
+	if !contains(opacityPixelModes, params.opacityPixels) {
+		console.Printf("ERROR: Unknown opacity pixels '%s', use one of [%s]\n", params.opacityPixels, strings.Join(opacityPixelModes, ", "))
+		os.Exit(exitUsage)
+	}
+	if !contains(scaleModes, params.scaleMode) {
+		console.Printf("ERROR: Unknown scale mode '%s', use one of [%s]\n", params.scaleMode, strings.Join(scaleModes, ", "))
+		os.Exit(exitUsage)
+	}
+
+	if params.alternate && (params.location == "smart" || params.location == "auto-corner" || params.location == "tile") {
+		console.Printf("ERROR: --alternate picks the left or right corner, it can not be used with the %s location\n", params.location)
+		os.Exit(exitUsage)
+	}
+
+	if params.opacity < 0 || params.opacity > 100 {
+		console.Printf("ERROR: Opacity must be between 0 and 100, got %d\n", params.opacity)
+		os.Exit(exitUsage)
+	}
+	if params.tileOpacity < 0 || params.tileOpacity > 100 {
+		console.Println("ERROR: Tile opacity must be between 0 and 100")
+		os.Exit(exitUsage)
+	}
+
+	if params.bar && params.location == "tile" {
+		console.Println("ERROR: --bar runs along an edge of the photo, it can not be used with the tile location")
+		os.Exit(exitUsage)
+	}
+
+	if params.bar && params.noWatermark {
+		console.Println("ERROR: --bar and --no-watermark can not be used together")
+		os.Exit(exitUsage)
+	}
+
+	if params.bar && params.watermarkBox.isSet() {
+		console.Println("ERROR: --watermark-box can not be used with --bar, the bar always spans the photo")
+		os.Exit(exitUsage)
+	}
+	if params.referenceResolution.isSet() && (params.bar || params.watermarkBox.isSet()) {
+		console.Println("ERROR: --reference-resolution scales the watermark with the photo, it can not be used with --bar or --watermark-box")
+		os.Exit(exitUsage)
+	}
+
+	if !contains(blendModes, params.blend) {
+		console.Printf("ERROR: Unknown blend mode '%s', use one of [%s]\n", params.blend, strings.Join(blendModes, ", "))
+		os.Exit(exitUsage)
+	}
+	if !contains(channelModes, params.channels) {
+		console.Printf("ERROR: Unknown channels '%s', use one of [%s]\n", params.channels, strings.Join(channelModes, ", "))
+		os.Exit(exitUsage)
+	}
+
+	if err := checkWatermark(params); err != nil {
+		console.Printf("ERROR: %s\n", err)
+		os.Exit(exitUsage)
+	}
+
+	if params.sourceDir == "-" {
+		os.Exit(streamMode(params))
+	} else if params.base64 {
+		console.Println("ERROR: -base64 only applies when reading a photo from stdin with -source -")
+		os.Exit(exitUsage)
+	}
+
+	// Photos are read from the source folder, or from inside an archive without extracting it
+	var source fs.FS = osFS{}
+	sourceRoot, skipDir := params.sourceDir, params.targetDir
+	if params.sourceArchive != "" {
+		archive, err := openArchive(params.sourceArchive)
+		if err != nil {
+			console.Printf("ERROR: Could not open source archive '%s': %s\n", params.sourceArchive, err)
+			os.Exit(exitIO)
+		}
+		source, sourceRoot, skipDir = archive, ".", ""
+	} else if _, err := os.Stat(params.sourceDir); os.IsNotExist(err) {
 		// Source folder does not exist
-		fmt.Printf("ERROR: Source folder (folder containing images) '%s' does not exist in this directory\n", sourceDir)
-		os.Exit(1)
+		console.Printf("ERROR: Source folder (folder containing images) '%s' does not exist in this directory\n", params.sourceDir)
+		os.Exit(exitUsage)
 	}
 
-	if _, err := os.Stat(targetDir); err == nil {
+	var files []sourceFile
+	var err error
+	if params.filesFrom != "" {
+		if files, err = readFileList(params.filesFrom, params.sourceDir); err != nil {
+			console.Printf("ERROR: Could not read the list of photos: %s\n", err)
+			os.Exit(exitUsage)
+		}
+	} else {
+		if files, err = getFiles(source, sourceRoot, params.depth, skipDir, params.includeHidden); err != nil {
+			console.Printf("ERROR: Could not read source folder '%s': %s\n", params.sourceDir, err)
+			os.Exit(exitIO)
+		}
+	}
+	if params.match.Regexp != nil {
+		total := len(files)
+		files = filterMatch(files, params.match.Regexp, false)
+		console.Printf("Found %d of %d files matching %s\n", len(files), total, params.match.String())
+	}
+	if params.exclude.Regexp != nil {
+		total := len(files)
+		files = filterMatch(files, params.exclude.Regexp, true)
+		console.Printf("Excluded %d of %d files matching %s\n", total-len(files), total, params.exclude.String())
+	}
+	if !params.since.IsZero() {
+		total := len(files)
+		files = filterSince(files, params.since.Time)
+		console.Printf("Found %d of %d files modified since %s\n", len(files), total, params.since.String())
+	}
+	if params.subjectMasks {
+		files = filterSubjectMasks(files)
+	}
+	sortFiles(files, params.sortOrder)
+	numberImages(files)
+	images := countImages(files)
+	if images == 0 {
+		console.Printf("No images found in source directory '%s', nothing to do\n", params.sourceDir)
+		os.Exit(exitNoImages)
+	}
+	var state *runState
+	if params.stateFile != "" {
+		var err error
+		if state, err = openState(params.stateFile, params.fsync); err != nil {
+			console.Printf("ERROR: Could not open state file '%s': %s\n", params.stateFile, err)
+			os.Exit(exitIO)
+		}
+		// Photos are numbered before the ones done are left out, so -alternate and -opacity-ramp
+		// give a resumed photo the same watermark as an uninterrupted run would have
+		total := len(files)
+		files = state.filter(files)
+		if len(files) < total {
+			console.Printf("Resuming: %d of %d files are already done according to '%s'\n", total-len(files), total, params.stateFile)
+		}
+	}
+
+	if _, err := os.Stat(params.targetDir); err == nil {
 		// Target dir already exists
-		fmt.Printf("WARNING: Target folder '%s' already exists in this directory. \n", targetDir)
-		if force {
-			fmt.Println("         Using --force, so will overwrite existing files")
+		console.Printf("WARNING: Target folder '%s' already exists in this directory. \n", params.targetDir)
+		if params.force {
+			console.Println("         Using --force, so will overwrite existing files")
+		} else if state != nil && len(state.done) > 0 {
+			console.Println("         Resuming from the state file, so will write the photos not done yet")
+		} else if params.noClobber {
+			console.Println("         Using --no-clobber, so photos that already exist in it will be skipped with an error")
 		} else {
-			fmt.Println("         Use --force to overwrite existing files")
-			fmt.Println("         Exiting to avoid overwriting existing files.")
-			os.Exit(1)
+			console.Println("         Use --force to overwrite existing files, or --no-clobber to only add new files")
+			console.Println("         Exiting to avoid overwriting existing files.")
+			os.Exit(exitUsage)
 		}
-	} else {
-		os.Mkdir(targetDir, 0755)
 	}
-	fmt.Print("\n--------------------------------------\n")
 
-	watermark := openImage(watermarkFile, "png")
-	mask := image.NewUniform(color.Alpha{uint8(watermarkOpacity * 255)})
-	files := getFiles(sourceDir)
+	renditions := newRenditions(params)
+	for _, r := range renditions {
+		if err := os.MkdirAll(path.Join(params.targetDir, r.dir), 0755); err != nil {
+			console.Printf("ERROR: Could not create target folder: %s\n", err)
+			os.Exit(exitIO)
+		}
+	}
+	console.Print("\n--------------------------------------\n")
 
-	fmt.Printf("Starting: Processing %d files\n\n", len(files))
+	watermark, err := loadWatermark(params)
+	if err != nil {
+		console.Printf("ERROR: Could not read watermark file '%s': %s\n", params.watermark, err)
+		os.Exit(exitIO)
+	}
+	if params.autoOpacity {
+		if params.opacity = watermarkOpacity(watermark); params.opacity < 0 {
+			console.Printf("ERROR: Watermark file '%s' is fully transparent, it has no alpha to take the opacity from\n", params.watermark)
+			os.Exit(exitUsage)
+		}
+		console.Printf("Using opacity %d, the mean alpha of the watermark\n", params.opacity)
+	}
+	b := newBatch(params, watermark, renditions)
+	b.source, b.sourceRoot = source, sourceRoot
+	if params.watermarkDir != "" {
+		if b.watermarkDir, err = loadWatermarkDir(params.watermarkDir, params); err != nil {
+			console.Printf("ERROR: %s\n", err)
+			os.Exit(exitIO)
+		}
+		names := make([]string, len(b.watermarkDir))
+		for i, layer := range b.watermarkDir {
+			names[i] = layer.name
+		}
+		console.Printf("Using %d watermarks from '%s': %s\n", len(names), params.watermarkDir, strings.Join(names, ", "))
+	}
+	if params.watermarkRandomDir != "" {
+		if b.randomWatermarks, err = loadWatermarkDir(params.watermarkRandomDir, params); err != nil {
+			console.Printf("ERROR: %s\n", err)
+			os.Exit(exitIO)
+		}
+		console.Printf("Picking from %d watermarks in '%s'\n", len(b.randomWatermarks), params.watermarkRandomDir)
+	}
+	b.images = images
+	if params.maxMemory > 0 {
+		b.memory = newMemoryLimiter(int64(params.maxMemory))
+	}
+	if params.watermarkCache > 0 {
+		b.watermarkCache = newWatermarkCache(params.watermarkCache)
+	}
+	if params.contactSheet {
+		b.contactSheet = newContactSheet(params.contactCols, params.contactThumb)
+	}
+	if params.heatmap {
+		b.heatmap = newHeatmap(heatmapSize)
+	}
+	if params.csvReport != "" {
+		b.report = &csvReport{}
+	}
+	if params.emitPlacement != "" || params.placementSVG {
+		b.placements = &placementReport{}
+	}
 
+	if params.interactive {
+		for _, file := range files {
+			if sourceType(file.Name()) == "" {
+				continue
+			}
+			if !b.tune(file) {
+				console.Println("Stopped, nothing was processed")
+				console.Close()
+				os.Exit(exitSuccess)
+			}
+			break
+		}
+	}
+
+	if params.deadline > 0 {
+		var cancel context.CancelFunc
+		b.open, cancel = context.WithTimeout(b.ctx, params.deadline)
+		defer cancel()
+	}
+
+	console.Printf("Starting: Processing %d files\n\n", len(files))
+
+	// The workers log through the goroutine of the console, so they don't wait for each other
+	console.start()
 	var wg sync.WaitGroup
 	wg.Add(len(files))
 	start := time.Now()
 	for _, file := range files {
-		go func(file os.FileInfo, watermark image.Image, mask image.Image, watermarkLocation string, watermarkScale float64, sourceDir string, targetDir string) {
+		go func(file sourceFile) {
 			defer wg.Done()
-			if !(strings.HasSuffix(file.Name(), ".jpg")) && !(strings.HasSuffix(file.Name(), ".jpeg")) {
-				fmt.Printf("Skipping photo '%s' because it is not a .jpg or .jpeg\n", file.Name())
+			defer b.progress(len(files))
+			err := b.safeProcessFile(file)
+			if err != nil {
+				if errors.Is(err, errAborted) {
+					b.summary.abort(file.relPath)
+					return
+				}
+				reason := b.summary.skip(err)
+				if b.report != nil {
+					b.report.addSkipped(file.relPath, err)
+				}
+				console.Skipf(file.relPath, params.logEvery > 0, "Skipping photo '%s' (%s): %s\n", file.relPath, reason, err)
+				b.countFailure(err)
 				return
 			}
+			b.summary.edit()
+			if state != nil {
+				if err := state.markDone(file.relPath); err != nil {
+					console.Photof(file.relPath, "WARNING: Could not record photo '%s' in the state file: %s\n", file.relPath, err)
+				}
+			}
+		}(file)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	console.stop()
 
-			srcImage := openImage(path.Join(sourceDir, file.Name()), "jpeg")
-
-			imgSize := srcImage.Bounds()
+	if b.contactSheet != nil {
+		if _, err := saveImage(context.Background(), b.contactSheet.render(), params.targetDir, contactSheetName, saveOptions{}); err != nil {
+			console.Printf("ERROR: Could not write contact sheet: %s\n", err)
+		} else {
+			console.Printf("\nWrote contact sheet to '%s'\n", path.Join(params.targetDir, contactSheetName))
+		}
+	}
+	if b.heatmap != nil {
+		if _, err := saveImage(context.Background(), b.heatmap.render(), params.targetDir, heatmapName, saveOptions{}); err != nil {
+			console.Printf("ERROR: Could not write heatmap: %s\n", err)
+		} else {
+			console.Printf("\nWrote watermark heatmap to '%s'\n", path.Join(params.targetDir, heatmapName))
+		}
+	}
+	if b.report != nil {
+		if err := b.report.write(params.csvReport); err != nil {
+			console.Printf("ERROR: Could not write CSV report: %s\n", err)
+		} else {
+			console.Printf("\nWrote CSV report to '%s'\n", params.csvReport)
+		}
+	}
+	if params.emitPlacement != "" {
+		if err := b.placements.write(params.emitPlacement); err != nil {
+			console.Printf("ERROR: Could not write watermark placements: %s\n", err)
+		} else {
+			console.Printf("\nWrote watermark placements to '%s'\n", params.emitPlacement)
+		}
+	}
+	if params.placementSVG {
+		if err := b.placements.writeSVG(params.targetDir, params.placementCombined); err != nil {
+			console.Printf("ERROR: Could not write placement SVG: %s\n", err)
+		} else if params.placementCombined {
+			console.Printf("\nWrote placement SVG to '%s'\n", path.Join(params.targetDir, placementSVGName))
+		} else {
+			console.Println("\nWrote placement SVG files next to the output files")
+		}
+	}
 
-			scaledWatermark := resize.Resize(0, uint(watermarkScale*float64(imgSize.Dy())), watermark, resize.NearestNeighbor)
+	console.Printf("\nAll done! Edited %d files in %s\n", b.summary.edited, elapsed)
+	b.summary.print()
+	if b.randomWatermarks != nil {
+		b.summary.printWatermarks()
+	}
+	if params.stats {
+		b.summary.printDimensions()
+	}
+	if params.timings > 0 {
+		b.summary.printSlowest(params.timings)
+	}
+	console.Print("\n--------------------------------------\n")
+	if waitForKey(params) {
+		console.Println("")
+		console.Println("Press any key to exit")
+		fmt.Scanln()
+	}
+	// Work abandoned after the -file-timeout stops before moving its output into place, and the
+	// temporary files it is still writing go with it
+	b.abort()
+	b.save.temps.removeAll()
+	if state != nil {
+		state.Close()
+	}
+	console.Close()
+	os.Exit(b.summary.exitCode())
+}
 
-			wmSize := scaledWatermark.Bounds()
-			canvas := image.NewRGBA(imgSize)
-			var watermarkOffset image.Point
-			if watermarkLocation == "left" {
-				watermarkOffset = image.Point{0, imgSize.Max.Y - wmSize.Max.Y}
-			} else if watermarkLocation == "right" {
-				watermarkOffset = image.Point{imgSize.Max.X - wmSize.Max.X, imgSize.Max.Y - wmSize.Max.Y}
-			}
+var (
+	// errWatermarkMissing is returned by checkWatermark when the watermark file does not exist
+	errWatermarkMissing = errors.New("watermark file does not exist")
 
-			draw.Draw(canvas, imgSize, srcImage, image.Point{0, 0}, draw.Src)
-			draw.DrawMask(canvas, imgSize.Add(watermarkOffset), scaledWatermark, image.Point{0, 0}, mask, image.Point{0, 0}, draw.Over)
+	// errWatermarkFormat is returned by checkWatermark when the watermark file is not a PNG or SVG file
+	errWatermarkFormat = errors.New("watermark file is not a PNG or SVG file")
+)
 
-			saveImage(canvas, targetDir, file.Name())
-		}(file, watermark, mask, watermarkLocation, watermarkScale, sourceDir, targetDir)
+// checkWatermark returns an error when the watermark file is needed but can't be used. A bar is
+// generated on the fly and -no-watermark draws nothing, so neither needs a watermark file.
+func checkWatermark(params parameters) error {
+	if params.bar || params.noWatermark || params.textTemplate != "" || params.watermarkDir != "" || params.watermarkRandomDir != "" {
+		return nil
 	}
-	wg.Wait()
-	elapsed := time.Since(start)
+	if _, err := os.Stat(params.watermark); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: '%s'", errWatermarkMissing, params.watermark)
+	}
+	if !strings.HasSuffix(params.watermark, ".png") && !strings.HasSuffix(params.watermark, ".svg") {
+		return fmt.Errorf("%w: '%s'", errWatermarkFormat, params.watermark)
+	}
+	return nil
+}
 
-	fmt.Printf("\nAll done! Editted %d files in %s", len(files), elapsed)
-	fmt.Print("\n--------------------------------------\n")
-	fmt.Println("")
-	fmt.Println("Press any key to exit")
-	fmt.Scanln()
+func printBanner() {
+	console.Println("**************************************************************************")
+	console.Println("*                                                                        *")
+	console.Println("*      WaterMarker v1.0 - Written by Tjeerd Bakker (ICheered) in Go      *")
+	console.Println("*                                                                        *")
+	console.Println("**************************************************************************")
+	console.Println("")
+	console.Println("For help: run the program from command line with the -h flag")
+	console.Println("Having issues? Please let me know at Tjeerd992@gmail.com")
+	console.Println("")
 }
 
-func getFiles(dirname string) []os.FileInfo {
-	entries, err := os.ReadDir(dirname)
-	if err != nil {
-		log.Fatal(err)
+// loadWatermark reads the watermark file, or returns nil where no file is used: in bar mode,
+// with -no-watermark or -text-template, and with -watermark-dir and -watermark-random-dir
+// which loadWatermarkDir reads
+func loadWatermark(params parameters) (image.Image, error) {
+	if params.bar || params.noWatermark || params.textTemplate != "" || params.watermarkDir != "" || params.watermarkRandomDir != "" {
+		return nil, nil
 	}
-	infos := make([]fs.FileInfo, 0, len(entries))
-	for _, entry := range entries {
-		info, err := entry.Info()
+	return loadWatermarkFile(params.watermark, params)
+}
+
+// loadWatermarkFile reads the PNG or SVG watermark fname, recolored and converted from
+// premultiplied alpha as the parameters ask
+func loadWatermarkFile(fname string, params parameters) (image.Image, error) {
+	if strings.HasSuffix(fname, ".svg") {
+		svg, err := loadSVGWatermark(fname, params.recolor, params.recolorTolerance)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		infos = append(infos, info)
+		return svg, nil
 	}
-	return infos
+	watermark, err := openImage(osFS{}, fname, "png")
+	if err != nil {
+		return nil, err
+	}
+	if params.premultiplied {
+		watermark = unpremultiply(watermark)
+	} else if looksPremultiplied(watermark) {
+		console.Println("WARNING: The watermark looks like it was saved with premultiplied alpha, which leaves a dark")
+		console.Println("         halo around it. Use --premultiplied if that is the case.")
+	}
+	if len(params.recolor) > 0 {
+		watermark = recolor(watermark, params.recolor, params.recolorTolerance)
+	}
+	return watermark, nil
 }
 
-func getParameters() (int, string, float64, string, string, string, bool) {
-	paramOpacity := flag.Int("opacity", 70, "Watermark opacity between 0 and 100")
-	paramLocation := flag.String("location", "right", "Location of watermark [left, right]")
-	paramScale := flag.Float64("scale", 0.2, "Specify the size of the watermark as a portion of the image (between 0 and 1)")
-	paramWatermark := flag.String("watermark", "watermark.png", "Name of PNG image to be used as watermark")
-	paramSourceDir := flag.String("source", "photos", "Source directory (location to find un-watermarked photos)")
-	paramTargetDir := flag.String("target", "watermarked", "Target directory (location to put watermarked photos")
-	paramForce := flag.Bool("force", false, "Force overwrite of target directory if it already exists")
-
-	flag.Parse()
-	opacity := *paramOpacity
-	location := *paramLocation
-	scale := *paramScale
-	watermark := *paramWatermark
-	sourceDir := *paramSourceDir
-	targetDir := *paramTargetDir
-	force := *paramForce
-
-	return opacity, location, scale, watermark, sourceDir, targetDir, force
-}
+// newBatch returns the batch that renders the given renditions of every photo
+func newBatch(params parameters, watermark image.Image, renditions []rendition) *batch {
+	ctx, abort := context.WithCancel(context.Background())
+	var limiter *rate.Limiter
+	if params.rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(params.rate), 1)
+	}
+	return &batch{
+		params:    params,
+		ctx:       ctx,
+		abort:     abort,
+		open:      ctx,
+		watermark: watermark,
+		limiter:   limiter,
 
-func saveImage(img image.Image, pname, fname string) error {
-	fpath := path.Join(pname, fname)
-	outputFile, err := os.Create(fpath)
+		save: saveOptions{
+			noClobber:      params.noClobber,
+			tmpDir:         params.tmpDir,
+			fsync:          params.fsync,
+			srgb:           params.srgb,
+			dpi:            params.dpi,
+			copyright:      params.copyright,
+			comment:        params.comment,
+			format:         params.outputFormat,
+			pngCompression: pngCompressionLevels[params.pngCompression],
+			encoder:        params.encoder,
+			dct:            params.dct,
+			subsampling:    params.subsampling,
+			smartQuality:   params.smartQuality,
+			temps:          newTempFiles(),
+		},
 
-	if err != nil {
-		log.Fatalf("failed to create: %s", err)
+		renditions: renditions,
 	}
-	var opt jpeg.Options
-	opt.Quality = 95
+}
 
-	jpeg.Encode(outputFile, img, &opt)
-	defer outputFile.Close()
-	return nil
+// Exit codes, so scripts can tell how a run went
+const (
+	exitSuccess  = 0 // all photos were watermarked
+	exitUsage    = 1 // invalid parameters or missing input, nothing was processed
+	exitIO       = 2 // reading the watermark or source folder, or creating the target folder failed
+	exitPartial  = 3 // the run completed, but some files were skipped
+	exitNoImages = 4 // the source folder contains no images to process
+	exitAborted  = 5 // the run was stopped after -max-errors photos failed or at the -deadline
+)
+
+// parameters holds the command line options for a single run
+type parameters struct {
+	opacity             int
+	opacityPixels       string
+	adaptiveOpacity     string
+	adaptiveMin         int
+	adaptiveMax         int
+	autoOpacity         bool
+	opacityRamp         bool
+	rampStart           int
+	rampEnd             int
+	location            string
+	anchor              anchorFlag
+	tileOpacity         int
+	alternate           bool
+	parseNames          bool
+	paramsFromExif      bool
+	offsetX             float64
+	offsetY             float64
+	safeZone            float64
+	scale               scaleFlag
+	blend               string
+	linearBlend         bool
+	channels            string
+	watermark           string
+	noWatermark         bool
+	overlayOnly         bool
+	subjectMasks        bool
+	sourceDir           string
+	sourceArchive       string
+	base64              bool
+	depth               int
+	includeHidden       bool
+	filesFrom           string
+	encodePath          bool
+	pathSeparator       string
+	targetDir           string
+	force               bool
+	noClobber           bool
+	tmpDir              string
+	fsync               bool
+	verifyOutput        bool
+	stateFile           string
+	srgb                bool
+	dpi                 int
+	copyright           string
+	comment             string
+	noRecompress        bool
+	printSize           printSizeFlag
+	since               sinceFlag
+	sortOrder           string
+	match               regexpFlag
+	exclude             regexpFlag
+	minDimension        int
+	minSourceRatio      float64
+	minSourceRatioSkip  bool
+	background          colorFlag
+	outputFormat        string
+	pngCompression      string
+	encoder             string
+	dct                 string
+	subsampling         string
+	smartQuality        float64
+	invisible           string
+	extract             string
+	verify              string
+	stats               bool
+	interactive         bool
+	timings             int
+	logFile             string
+	logAppend           bool
+	logEvery            int
+	logJSON             bool
+	noBanner            bool
+	contactSheet        bool
+	contactCols         int
+	contactThumb        int
+	heatmap             bool
+	compare             string
+	compareDirection    string
+	compareGap          int
+	csvReport           string
+	emitPlacement       string
+	placementSVG        bool
+	placementCombined   bool
+	maxMemory           byteSizeFlag
+	noRecover           bool
+	fileTimeout         time.Duration
+	deadline            time.Duration
+	rate                float64
+	maxErrors           int
+	sizes               sizesFlag
+	webSize             int
+	rotateSource        int
+	proof               bool
+	proofOpacity        int
+	final               bool
+	finalOpacity        int
+	sharpen             float64
+	sharpenRadius       float64
+	vignette            float64
+	vignetteRadius      float64
+	shape               string
+	radius              int
+	aspect              aspectFlag
+	scaleMode           string
+	watermarkBox        boxFlag
+	referenceResolution boxFlag
+	watermarkCache      int
+	noUpscale           bool
+	premultiplied       bool
+	recolor             recolorFlag
+	recolorTolerance    int
+	bar                 bool
+	barColor            colorFlag
+	barEdge             string
+	text                string
+	textColor           colorFlag
+	textTemplate        string
+	watermarkDir        string
+	watermarkRandomDir  string
+	seed                int64
+	border              int
+	borderColor         colorFlag
+	backdropBlur        float64
+	backdropPadding     float64
+	backdropColor       colorFlag
+	backdropOpacity     int
 }
 
-func openImage(fname string, ftype string) image.Image {
-	inputfile, err := os.Open(fname)
-	if err != nil {
-		log.Fatalf("failed to open: %s", err)
+func getParameters() parameters {
+	var params parameters
+	flag.IntVar(&params.opacity, "opacity", 70, "Watermark opacity between 0 and 100")
+	flag.StringVar(&params.opacityPixels, "opacity-pixels", "all", "Pixels of the watermark the opacity applies to, the others keep their own alpha ["+strings.Join(opacityPixelModes, ", ")+"]")
+	flag.StringVar(&params.adaptiveOpacity, "adaptive-opacity", "off", "Vary the opacity per photo with the brightness under the watermark ["+strings.Join(adaptiveModes, ", ")+"], bright makes it more opaque on bright photos")
+	flag.BoolVar(&params.autoOpacity, "auto-opacity-from-watermark", false, "Use the mean alpha of the visible pixels of the watermark file as the -opacity, so the strength is set in the watermark itself")
+	flag.IntVar(&params.adaptiveMin, "adaptive-min", 30, "Lowest opacity used by -adaptive-opacity")
+	flag.IntVar(&params.adaptiveMax, "adaptive-max", 90, "Highest opacity used by -adaptive-opacity")
+	flag.BoolVar(&params.opacityRamp, "opacity-ramp", false, "Change the opacity evenly from photo to photo in -sort order, from -ramp-start to -ramp-end, for slideshows")
+	flag.IntVar(&params.rampStart, "ramp-start", 40, "Opacity of the first photo with -opacity-ramp")
+	flag.IntVar(&params.rampEnd, "ramp-end", 90, "Opacity of the last photo with -opacity-ramp")
+	flag.StringVar(&params.location, "location", "right", "Location of watermark ["+strings.Join(locations, ", ")+"], left and right are the bottom corners, smart picks the corner with least detail, auto-corner the bottom corner with least detail, tile repeats it over the whole photo, and tl to br are the cells of the anchor grid")
+	flag.Var(&params.anchor, "anchor", "Cell of the 3x3 grid the watermark is placed in, replacing -location ["+strings.Join(anchors, ", ")+"], with optional nudges in from its edges in pixels or percent, such as bl+24+16 or tc+0+5%")
+	flag.IntVar(&params.tileOpacity, "tile-opacity", 20, "Watermark opacity used instead of -opacity with -location tile, as a repeated watermark is much more visible")
+	flag.BoolVar(&params.parseNames, "parse-names", false, "Read the location and opacity of a photo from its file name, such as photo__loc-left__op-50.jpg, overriding -location and -opacity")
+	flag.BoolVar(&params.paramsFromExif, "params-from-exif", false, "Read the location and opacity of a photo from a keyword, description or comment in its metadata, such as Watermark:left;op:60, overriding -location and -opacity")
+	flag.BoolVar(&params.alternate, "alternate", false, "Place the watermark of every other photo on the left and right, in -sort order, for a balanced gallery grid")
+	flag.Float64Var(&params.offsetX, "offset-x", 0, "Move the watermark in from its corner by this fraction of the photo width, e.g. 0.03")
+	flag.Float64Var(&params.offsetY, "offset-y", 0, "Move the watermark in from its corner by this fraction of the photo height, e.g. 0.03")
+	flag.Float64Var(&params.safeZone, "safe-zone", 0, "Keep the watermark out of this percentage of the photo size along every edge, e.g. 5, for photos that will be cropped or matted later")
+	params.scale = 0.2
+	flag.Var(&params.scale, "scale", "Specify the size of the watermark as a portion of the image (between 0 and 1, or a percentage like 20%)")
+	flag.Var(&params.referenceResolution, "reference-resolution", "Size the watermark as if every photo were this resolution in pixels, WxH such as 6000x4000, and scale it with the photo, so crops of a shot get the same watermark as the shot")
+	flag.Var(&params.watermarkBox, "watermark-box", "Scale the watermark to fit in a box of WxH pixels, such as 200x100, the same on every photo instead of -scale")
+	flag.IntVar(&params.watermarkCache, "watermark-cache", 0, "Number of scaled variants of the watermarks kept for reuse on photos of the same size, such as 16, which mostly helps SVG watermarks, rendered and recolored again at every size (default 0, render them for every photo)")
+	flag.StringVar(&params.scaleMode, "scale-mode", "height", "Image dimension the -scale is a portion of ["+strings.Join(scaleModes, ", ")+"]")
+	flag.BoolVar(&params.noUpscale, "no-upscale", false, "Never enlarge the watermark beyond its original size, to keep small logos crisp")
+	flag.StringVar(&params.blend, "blend", "normal", "Blend mode used to composite the watermark ["+strings.Join(blendModes, ", ")+"]")
+	flag.BoolVar(&params.linearBlend, "linear-blend", false, "Blend the watermark in linear light instead of on the sRGB tone curve, so soft and semi-transparent edges don't leave a dark fringe")
+	flag.StringVar(&params.channels, "channels", "rgb", "Color channels of the photo the watermark composites into ["+strings.Join(channelModes, ", ")+"], luma only changes the brightness and keeps the colors of the photo")
+	flag.StringVar(&params.watermark, "watermark", "watermark.png", "Name of PNG image, or SVG file for a logo that stays sharp at any size, to be used as watermark")
+	flag.Var(&params.recolor, "recolor", "Replace colors of the watermark, as a comma separated list of old:new hex colors such as #000000:#ffffff, for dark and light variants of one logo")
+	flag.IntVar(&params.recolorTolerance, "recolor-tolerance", 8, "Maximum difference per color channel (0-255) for a watermark pixel to match an old -recolor color")
+	flag.BoolVar(&params.premultiplied, "premultiplied", false, "The watermark PNG was exported with premultiplied alpha, convert it to avoid dark edges")
+	flag.BoolVar(&params.subjectMasks, "subject-masks", false, "Put the watermark behind the subject of photos that have a mask of it, a PNG next to the photo named like photo.mask.png for photo.jpg")
+	flag.BoolVar(&params.overlayOnly, "overlay-only", false, "Write only the placed and scaled watermark on a transparent canvas the size of each photo, to layer it over the photo in an image editor, needs -output-format png")
+	flag.BoolVar(&params.noWatermark, "no-watermark", false, "Don't watermark the photos, only resize and convert them with -sizes, -output-format and the other options")
+	flag.BoolVar(&params.bar, "bar", false, "Use a colored bar along the edge of the photo as watermark instead of a PNG image, -scale sets its height")
+	params.barColor = colorFlag{color.RGBA{0, 0, 0, 0xff}}
+	flag.Var(&params.barColor, "bar-color", "Hex color of the bar drawn with -bar")
+	flag.StringVar(&params.barEdge, "bar-edge", "bottom", "Edge of the photo the bar is placed along [top, bottom]")
+	flag.StringVar(&params.text, "text", "", "Text written on the bar drawn with -bar, aligned according to -location")
+	params.textColor = colorFlag{color.RGBA{0xff, 0xff, 0xff, 0xff}}
+	flag.Var(&params.textColor, "text-color", "Hex color of the text written with -text or -text-template")
+	flag.StringVar(&params.watermarkRandomDir, "watermark-random-dir", "", "Draw one of the PNG and SVG watermarks in this folder on every photo instead of the watermark file, picked at random with the -seed, so removing them automatically is harder")
+	flag.Int64Var(&params.seed, "seed", 0, "Seed of the random choices of -watermark-random-dir, runs with the same seed pick the same watermark for every photo")
+	flag.StringVar(&params.watermarkDir, "watermark-dir", "", "Draw every PNG and SVG watermark in this folder instead of the watermark file, in order of their names, each with the location, opacity and scale of its sidecar JSON file such as logo.json for logo.png")
+	flag.StringVar(&params.textTemplate, "text-template", "", "Watermark every photo with this text instead of the watermark file, with {name} and {file} replaced by the file name of the photo without and with extension, and {date} and {year} by the date it was taken, e.g. \"{name} © 2024\"")
+	flag.StringVar(&params.sourceDir, "source", "photos", "Source directory (location to find un-watermarked photos), or - to watermark a single photo read from stdin and write it to stdout")
+	flag.StringVar(&params.sourceArchive, "source-archive", "", "Read the photos from this .zip or .tar archive instead of the source directory, without extracting it, use -depth -1 for photos in folders")
+	flag.BoolVar(&params.base64, "base64", false, "With -source -, write the photo to stdout as a base64 data URI, for embedding in JSON or HTML")
+	flag.StringVar(&params.filesFrom, "files-from", "", "Only process the photos listed in this file, one path per line, or - to read the list from stdin, for example from find, instead of listing the source directory")
+	flag.BoolVar(&params.includeHidden, "include-hidden", false, "Also process hidden files and folders, whose name starts with a dot, which are ignored by default")
+	flag.IntVar(&params.depth, "depth", 0, "Number of levels of subdirectories of the source directory to process, mirrored in the target directory (-1 for unlimited)")
+	flag.BoolVar(&params.encodePath, "encode-path", false, "Put all photos found with -depth directly in the target directory, with their subdirectories in the file name")
+	flag.StringVar(&params.pathSeparator, "path-separator", "_", "Separator between the subdirectories in file names written with -encode-path")
+	flag.StringVar(&params.targetDir, "target", "watermarked", "Target directory (location to put watermarked photos")
+	flag.BoolVar(&params.force, "force", false, "Force overwrite of target directory if it already exists")
+	flag.BoolVar(&params.noClobber, "no-clobber", false, "Allow an existing target directory, but report an error for every photo whose output file already exists")
+	flag.StringVar(&params.copyright, "copyright", "", "Copyright notice stored in JPEG and PNG output, in the XMP rights of JPEG and a Copyright text chunk of PNG")
+	flag.StringVar(&params.comment, "comment", "", "Comment stored in JPEG and PNG output, in a comment segment of JPEG and a Comment text chunk of PNG")
+	flag.BoolVar(&params.noRecompress, "no-recompress", false, "With -no-watermark, copy JPEG photos to JPEG output as they are and only add the -copyright and -comment, so their quality is not lost to encoding them again")
+	flag.IntVar(&params.dpi, "dpi", 0, "Print density in dots per inch stored in the output, e.g. 300, so print software prints photos at the intended size")
+	flag.Var(&params.printSize, "print-size", "Scale photos to fit a print of this size in inches at the -dpi, such as 8x10 for 2400x3000 pixels at 300 DPI")
+	flag.BoolVar(&params.srgb, "srgb", false, "Convert photos with a color profile such as Adobe RGB or Display P3 to sRGB, and tag the output as sRGB, for the same colors in every browser")
+	flag.StringVar(&params.stateFile, "state", "", "Record the photos that are done in this file, and skip them when a run with the same file is started again, to resume an interrupted run")
+	flag.BoolVar(&params.verifyOutput, "verify-output", false, "Read every written photo back and check it is a complete image, deleting it and reporting the photo as failed when it is not, for critical batches and network storage")
+	flag.BoolVar(&params.fsync, "fsync", false, "Flush every photo to disk before moving on, so the written photos survive a crash or power loss, at the cost of speed")
+	flag.StringVar(&params.tmpDir, "tmpdir", "", "Directory for the temporary files photos are written to before they are moved into the target directory, e.g. a local disk when the target is a network share (default the target directory)")
+	flag.Var(&params.match, "match", "Only process files whose name matches this regular expression, such as IMG_.*\\.jpg")
+	flag.Var(&params.exclude, "exclude", "Skip files whose name matches this regular expression, such as _wm\\.jpg$, even if they match -match")
+	flag.StringVar(&params.sortOrder, "sort", "name", "Order of the photos for -alternate and -opacity-ramp ["+strings.Join(sortOrders, ", ")+"], mtime is the time they were modified and size their file size")
+	flag.Var(&params.since, "since", "Only process photos modified after this time, either a duration ago such as 24h or 7d, or a date such as 2024-05-01")
+	flag.IntVar(&params.minDimension, "min-dimension", 0, "Skip photos whose longest side is smaller than this many pixels, such as thumbnails")
+	flag.Float64Var(&params.minSourceRatio, "min-source-ratio", 0, "Warn about photos whose area is less than this many times the area of the watermark, e.g. 10, as the watermark would overpower them")
+	flag.BoolVar(&params.minSourceRatioSkip, "min-source-ratio-skip", false, "Skip the photos found by -min-source-ratio instead of only warning about them")
+	flag.StringVar(&params.outputFormat, "output-format", "jpeg", "Image format of the watermarked photos ["+strings.Join(outputFormats, ", ")+"]")
+	flag.StringVar(&params.encoder, "encoder", "std", "JPEG encoder, std is built in and turbo is libjpeg-turbo, which needs a build with -tags jpegturbo [std, turbo]")
+	flag.StringVar(&params.dct, "dct", "", "DCT method of the turbo encoder, trading accuracy for speed [islow, ifast, float] (default islow)")
+	flag.StringVar(&params.subsampling, "subsampling", "", "Chroma subsampling of the turbo encoder, 444 keeps the colors at full resolution [444, 422, 420] (default 420)")
+	flag.Float64Var(&params.smartQuality, "smart-quality", 0, "Pick the lowest JPEG quality per photo that keeps this similarity (SSIM) to the full quality photo, e.g. 0.98, for smaller files (default the fixed quality 95)")
+	flag.StringVar(&params.pngCompression, "png-compression", "default", "Compression of PNG output, trading speed for file size [default, none, speed, best]")
+	flag.StringVar(&params.invisible, "invisible", "", "Also hide this text invisibly in the pixels of every photo, needs -output-format png")
+	flag.StringVar(&params.extract, "extract", "", "Print the invisible text hidden in this image with -invisible, and exit")
+	flag.StringVar(&params.verify, "verify", "", "Check the invisible text hidden in this image is the -invisible text, and exit")
+	params.background = colorFlag{color.RGBA{0xff, 0xff, 0xff, 0xff}}
+	flag.Var(&params.background, "background", "Hex color used to fill transparent areas of PNG photos, as JPEG has no transparency")
+	flag.Var(&params.aspect, "aspect", "Pad photos with the background color to an aspect ratio such as 1:1 or 4:5 before watermarking")
+	flag.IntVar(&params.border, "border", 0, "Width in pixels of a frame drawn around the watermarked photo")
+	params.borderColor = colorFlag{color.RGBA{0xff, 0xff, 0xff, 0xff}}
+	flag.Var(&params.borderColor, "border-color", "Hex color of the frame drawn with -border")
+	flag.IntVar(&params.webSize, "web-size", 0, "Write every photo at full size to the "+fullDir+" folder and scaled down to this longest side in pixels, e.g. 2048, to the "+webDir+" folder, with the watermark sized for each")
+	flag.Var(&params.sizes, "sizes", "Comma separated list of sizes, e.g. 2000,1000,500, to write one copy per size (longest side in pixels) into a folder per size")
+	flag.IntVar(&params.rotateSource, "rotate-source", 0, "Rotate all photos clockwise by 90, 180 or 270 degrees before watermarking, for batches shot with a rotated camera")
+	flag.BoolVar(&params.noBanner, "no-banner", false, "Don't print the banner with the version and contact details at startup")
+	flag.BoolVar(&params.logJSON, "log-json", false, "Also write every warning, error and skipped photo to stderr as a line of JSON with its file, level, message and timestamp, for log aggregators")
+	flag.IntVar(&params.logEvery, "log-every", 0, "Print a progress line every N files instead of a line for every skipped photo, which are then only written to the -logfile")
+	flag.IntVar(&params.maxErrors, "max-errors", 0, "Stop the run once this many photos failed, as something is likely wrong with all of them (default no limit)")
+	flag.Float64Var(&params.rate, "rate", 0, "Start at most this many photos per second, such as 2 or 0.5, so a background run doesn't saturate the disk of a shared machine (default no limit)")
+	flag.DurationVar(&params.deadline, "deadline", 0, "Stop starting photos once the run took this long, such as 2h, and list the ones not processed, photos in progress are finished (default no limit)")
+	flag.DurationVar(&params.fileTimeout, "file-timeout", 0, "Give up on a photo that takes longer than this to process, such as 30s, and skip it (default no limit)")
+	flag.BoolVar(&params.noRecover, "no-recover", false, "Stop with a stack trace when processing a photo panics, instead of skipping the photo, for debugging")
+	flag.BoolVar(&params.proof, "proof", false, "Write a review copy of every photo, stamped PROOF and with a strong watermark, to the proof folder")
+	flag.IntVar(&params.proofOpacity, "proof-opacity", 90, "Watermark opacity of the -proof copies")
+	flag.BoolVar(&params.final, "final", false, "Write a delivery copy of every photo, with a subtle watermark, to the final folder")
+	flag.IntVar(&params.finalOpacity, "final-opacity", 30, "Watermark opacity of the -final copies")
+	flag.Float64Var(&params.sharpen, "sharpen", 0, "Amount of unsharp mask sharpening applied to photos after resizing, e.g. 0.5, with 8 bits per channel, so 16-bit photos lose their extra precision (default none)")
+	flag.Float64Var(&params.sharpenRadius, "sharpen-radius", 1, "Radius in pixels of the blur used by -sharpen")
+	flag.Float64Var(&params.backdropBlur, "backdrop-blur", 0, "Blur the photo behind the watermark with this radius in pixels, e.g. 8, so it reads clearly over busy detail (default none)")
+	flag.Var(&params.backdropColor, "backdrop-color", "Hex color of a panel with rounded ends drawn behind the watermark, such as 000 for a dark pill behind a light logo, so it is always legible (default none)")
+	flag.IntVar(&params.backdropOpacity, "backdrop-opacity", 50, "Opacity of the panel of -backdrop-color between 0 and 100")
+	flag.Float64Var(&params.backdropPadding, "backdrop-padding", 0.25, "Margin around the watermark of -backdrop-blur and -backdrop-color, as a fraction of the height of the watermark")
+	flag.Float64Var(&params.vignette, "vignette", 0, "Darken the corners of photos before watermarking, from 0 (default none) to 1 for black corners")
+	flag.Float64Var(&params.vignetteRadius, "vignette-radius", 0.5, "Where the -vignette starts to darken, as a fraction of the distance from the center to the corners")
+	flag.StringVar(&params.shape, "shape", "", "Cut photos to a shape with transparent corners before watermarking, circle or rounded, for avatars and profile pictures, needs -output-format png")
+	flag.IntVar(&params.radius, "radius", 10, "Radius of the corners of -shape rounded, as a percentage of the shorter side of the photo, 0 keeps them square")
+	flag.Var(&params.maxMemory, "max-memory", "Limit the memory used for photos being processed at the same time, e.g. 512MB or 2GB (default unlimited)")
+	flag.BoolVar(&params.heatmap, "heatmap", false, "Also write "+heatmapName+", showing where the watermarks of all photos landed over the first photo, to check their placement")
+	flag.StringVar(&params.compare, "compare", "", "Also write every photo before and after watermarking to the "+compareDir+" folder, for documentation and client approval ["+strings.Join(compareLayouts, ", ")+"], side puts them next to each other and split shows half of each")
+	flag.StringVar(&params.compareDirection, "compare-direction", "horizontal", "Direction of the -compare layout ["+strings.Join(compareDirections, ", ")+"], horizontal puts the photo after watermarking on the right and vertical below")
+	flag.IntVar(&params.compareGap, "compare-gap", 16, "Width in pixels of the gap between the photos of -compare side, or of the divider line of -compare split")
+	flag.BoolVar(&params.contactSheet, "contact-sheet", false, "Also write "+contactSheetName+" with thumbnails of all watermarked photos, for proofing")
+	flag.IntVar(&params.contactCols, "contact-columns", 5, "Number of columns on the contact sheet")
+	flag.IntVar(&params.contactThumb, "contact-thumb", 300, "Size in pixels of the thumbnails on the contact sheet")
+	flag.StringVar(&params.logFile, "logfile", "", "Also write all messages, with timestamps and the parameters used, to this file")
+	flag.StringVar(&params.emitPlacement, "emit-placement", "", "Also write where the watermark was drawn on every output file, with its scale, opacity and blend mode, to this JSON file, to reproduce or remove it in other tools")
+	flag.BoolVar(&params.placementSVG, "placement-svg", false, "Also write an SVG file next to every output file, showing the output with a rectangle around the watermark, to review the placement in vector tools")
+	flag.BoolVar(&params.placementCombined, "placement-svg-combined", false, "Write a single "+placementSVGName+" with all output files for -placement-svg, instead of a file for every output file")
+	flag.StringVar(&params.csvReport, "csv", "", "Also write a report with a row for every output file and skipped photo to this CSV file, for spreadsheets")
+	flag.BoolVar(&params.logAppend, "log-append", false, "Append to the -logfile instead of replacing it")
+	flag.IntVar(&params.timings, "timings", 0, "Report the N files that took the longest to decode, watermark and save, to find slow photos in large batches")
+	flag.BoolVar(&params.interactive, "interactive", false, "Preview the watermark on the first photo in the terminal and adjust its opacity, scale and location before starting the batch, with commands typed one per line and confirmed with Enter")
+	flag.BoolVar(&params.stats, "stats", false, "Report the distinct photo resolutions that were processed")
+
+	// Invalid flags are usage errors, not the flag package's default exit code 2
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(exitSuccess)
+	} else if err != nil {
+		os.Exit(exitUsage)
+	}
+	// The cell of the anchor is the location, so -alternate and the overrides work with it
+	if params.anchor.isSet() {
+		params.location = params.anchor.cell
 	}
+	return params
+}
 
-	var srcimage image.Image
+// waitForKey reports whether to wait for a key before exiting, which keeps the window of a run
+// started by double clicking open. Runs from scripts, whose stdin is not a terminal, and runs
+// that read -files-from or the -log-json output in a pipeline end right away.
+func waitForKey(params parameters) bool {
+	if params.filesFrom == "-" || params.logJSON {
+		return false
+	}
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// Input from /dev/null, as cron and service managers give it, is a character device too
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
 
-	if ftype == "jpeg" {
-		srcimage, err = jpeg.Decode(inputfile)
-		if err != nil {
-			log.Fatalf("failed to decode: %s", err)
+// contains reports whether value is one of the options
+func contains(options []string, value string) bool {
+	for _, option := range options {
+		if option == value {
+			return true
 		}
-		defer inputfile.Close()
-	} else if ftype == "png" {
-		srcimage, err = png.Decode(inputfile)
-		if err != nil {
-			log.Fatalf("failed to decode: %s", err)
-		}
-		defer inputfile.Close()
 	}
+	return false
+}
 
-	if err != nil {
-		log.Fatalf("failed to decode: %s", err)
+// opacityAlpha converts an opacity percentage (0-100) into an 8-bit alpha value. It is rounded
+// to the nearest value, truncating would make every opacity that isn't a multiple of 20 slightly
+// weaker, such as 127 instead of 128 for 50%.
+func opacityAlpha(opacity int) uint8 {
+	if opacity < 0 {
+		opacity = 0
+	} else if opacity > 100 {
+		opacity = 100
 	}
-	defer inputfile.Close()
-	return srcimage
+	return uint8((opacity*255 + 50) / 100)
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runMainEnv makes the test binary run the tool instead of the tests, for the tests that run
+// it end to end with runTool
+const runMainEnv = "WATERMARKER_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(exitSuccess)
+	}
+	os.Exit(m.Run())
+}
+
+// runTool runs the tool in dir with the arguments, and returns its exit code and output
+func runTool(t *testing.T, dir string, env []string, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-no-banner"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), runMainEnv+"=1"), env...)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), string(out)
+	} else if err != nil {
+		t.Fatalf("Running the tool failed: %s", err)
+	}
+	return exitSuccess, string(out)
+}
+
+// writeTestImage encodes img as JPEG or PNG into fname, by its extension
+func writeTestImage(t *testing.T, fname string, img image.Image) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if strings.HasSuffix(fname, ".png") {
+		err = png.Encode(f, img)
+	} else {
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testWatermark returns a watermark with a semi-transparent edge around an opaque center
+func testWatermark(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			a := uint8(0xff)
+			if x < 2 || y < 2 || x >= w-2 || y >= h-2 {
+				a = 0x80
+			}
+			img.SetNRGBA(x, y, color.NRGBA{0xff, 0xff, 0xff, a})
+		}
+	}
+	return img
+}
+
+// newTestSource creates a photos folder with a few photos and a watermark.png in dir
+func newTestSource(t *testing.T, dir string) {
+	t.Helper()
+	writeTestImage(t, filepath.Join(dir, "watermark.png"), testWatermark(60, 20))
+	writeTestImage(t, filepath.Join(dir, "photos", "a.jpg"), testPhoto(320, 240))
+	writeTestImage(t, filepath.Join(dir, "photos", "b.jpg"), testPhoto(240, 320))
+	writeTestImage(t, filepath.Join(dir, "photos", "c.png"), testPhoto(200, 200))
+	writeTestImage(t, filepath.Join(dir, "photos", "trip", "d.jpg"), testPhoto(400, 300))
+	writeTestImage(t, filepath.Join(dir, "photos", "trip", "e.jpg"), testPhoto(300, 300))
+}
+
+// hashTree returns the SHA-256 of every file below dir, by its path relative to dir
+func hashTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	hashes := map[string]string{}
+	err := filepath.WalkDir(dir, func(fpath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(fpath)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, fpath)
+		sum := sha256.Sum256(data)
+		hashes[filepath.ToSlash(rel)] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hashes
+}
+
+func TestReproducibleOutput(t *testing.T) {
+	source := t.TempDir()
+	newTestSource(t, source)
+	marks := filepath.Join(source, "marks")
+	writeTestImage(t, filepath.Join(marks, "one.png"), testWatermark(40, 20))
+	writeTestImage(t, filepath.Join(marks, "two.png"), testWatermark(20, 40))
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"defaults", nil},
+		{"smart quality", []string{"-smart-quality", "0.98"}},
+		{"order dependent", []string{"-opacity-ramp", "-alternate", "-sort", "name-desc"}},
+		{"random watermark", []string{"-watermark-random-dir", marks, "-seed", "7"}},
+		{"text template", []string{"-text-template", "{name} {year}"}},
+		{"sizes", []string{"-sizes", "200,100", "-output-format", "png"}},
+		{"reports", []string{"-contact-sheet", "-heatmap", "-csv", "target/report.csv", "-emit-placement", "target/placements.json"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The runs differ in their working folder and in how many photos are processed at
+			// the same time, so the photos finish in a different order
+			var hashes []map[string]string
+			for _, procs := range []string{"GOMAXPROCS=1", "GOMAXPROCS=8"} {
+				dir := t.TempDir()
+				args := append([]string{"-source", filepath.Join(source, "photos"), "-target", "target", "-watermark", filepath.Join(source, "watermark.png")}, test.args...)
+				if code, out := runTool(t, dir, []string{procs}, args...); code != exitSuccess {
+					t.Fatalf("The run exited with %d:\n%s", code, out)
+				}
+				hashes = append(hashes, hashTree(t, filepath.Join(dir, "target")))
+			}
+			if len(hashes[0]) == 0 {
+				t.Fatal("The run wrote no files")
+			}
+			for name, hash := range hashes[0] {
+				if other, ok := hashes[1][name]; !ok {
+					t.Errorf("The second run didn't write %s", name)
+				} else if other != hash {
+					t.Errorf("The runs wrote different %s", name)
+				}
+			}
+			if len(hashes[1]) != len(hashes[0]) {
+				t.Errorf("The runs wrote %d and %d files", len(hashes[0]), len(hashes[1]))
+			}
+		})
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	newTestSource(t, dir)
+	writeFile := func(fname, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(filepath.Join(dir, "broken", "empty.jpg"), "")
+	writeTestImage(t, filepath.Join(dir, "broken", "good.jpg"), testPhoto(64, 48))
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+		writeFile(filepath.Join(dir, "failing", name), "not a photo")
+	}
+	writeFile(filepath.Join(dir, "notes", "notes.txt"), "no photos here")
+	writeTestImage(t, filepath.Join(dir, "readme", "good.jpg"), testPhoto(64, 48))
+	writeFile(filepath.Join(dir, "readme", "README.md"), "not a photo")
+	writeFile(filepath.Join(dir, "broken.png"), "not a watermark")
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"success", []string{"-source", "photos"}, exitSuccess},
+		{"invalid flag value", []string{"-source", "photos", "-opacity", "150"}, exitUsage},
+		{"unknown flag", []string{"-source", "photos", "-no-such-flag"}, exitUsage},
+		{"missing source", []string{"-source", "missing"}, exitUsage},
+		{"missing watermark", []string{"-source", "photos", "-watermark", "missing.png"}, exitUsage},
+		{"broken watermark", []string{"-source", "photos", "-watermark", "broken.png"}, exitIO},
+		{"some skipped", []string{"-source", "broken"}, exitPartial},
+		{"other files skipped", []string{"-source", "readme"}, exitSuccess},
+		{"small photos skipped", []string{"-source", "readme", "-min-dimension", "100"}, exitSuccess},
+		{"overpowered photos skipped", []string{"-source", "photos", "-min-source-ratio", "1000", "-min-source-ratio-skip", "-max-errors", "1"}, exitSuccess},
+		{"no images", []string{"-source", "notes"}, exitNoImages},
+		{"too many errors", []string{"-source", "failing", "-max-errors", "1", "-rate", "4"}, exitAborted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{"-target", filepath.Join(t.TempDir(), "target")}, test.args...)
+			code, out := runTool(t, dir, nil, args...)
+			if code != test.want {
+				t.Errorf("Got exit code %d, want %d:\n%s", code, test.want, out)
+			}
+			// The input of the tests is not a terminal, so there is nobody to press a key
+			if strings.Contains(out, "Press any key") {
+				t.Errorf("The run waited for a key:\n%s", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// openArchive opens a .zip or .tar archive of photos as a read-only file system. The photos
+// are read from the archive on demand, nothing is extracted to disk. The archive stays open
+// for the rest of the run.
+func openArchive(fname string) (fs.FS, error) {
+	switch strings.ToLower(path.Ext(fname)) {
+	case ".zip":
+		archive, err := zip.OpenReader(fname)
+		if err != nil {
+			return nil, err
+		}
+		return &archive.Reader, nil
+	case ".tar":
+		return openTar(fname)
+	}
+	return nil, fmt.Errorf("not a .zip or .tar archive")
+}
+
+// tarFS is an fs.FS for an uncompressed tar archive. A tar has no index, so it is read once
+// to note where the contents of every file start, after which files are read concurrently
+// with ReadAt on the archive.
+type tarFS struct {
+	archive *os.File
+	files   map[string]tarEntry
+	dirs    map[string]map[string]fs.DirEntry // the entries in every directory, by name
+}
+
+// tarEntry is a file in a tar archive
+type tarEntry struct {
+	info   fs.FileInfo
+	offset int64
+}
+
+func openTar(fname string) (*tarFS, error) {
+	archive, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	t := &tarFS{
+		archive: archive,
+		files:   map[string]tarEntry{},
+		dirs:    map[string]map[string]fs.DirEntry{".": {}},
+	}
+
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			archive.Close()
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean(header.Name), "/")
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			// The tar reader reads the archive block by block, so it is now at the file's contents
+			offset, err := archive.Seek(0, io.SeekCurrent)
+			if err != nil {
+				archive.Close()
+				return nil, err
+			}
+			t.files[name] = tarEntry{header.FileInfo(), offset}
+			t.addEntry(name, fs.FileInfoToDirEntry(header.FileInfo()))
+		case tar.TypeDir:
+			t.addDir(name)
+		}
+	}
+	return t, nil
+}
+
+// addEntry adds an entry to its parent directory, adding the parent directories as needed
+func (t *tarFS) addEntry(name string, entry fs.DirEntry) {
+	dir := path.Dir(name)
+	t.addDir(dir)
+	t.dirs[dir][path.Base(name)] = entry
+}
+
+// addDir adds a directory, which tar archives often only imply by the paths of their files
+func (t *tarFS) addDir(name string) {
+	if _, ok := t.dirs[name]; ok {
+		return
+	}
+	t.dirs[name] = map[string]fs.DirEntry{}
+	t.addEntry(name, fs.FileInfoToDirEntry(tarDirInfo(path.Base(name))))
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if entry, ok := t.files[name]; ok {
+		return &tarFile{io.NewSectionReader(t.archive, entry.offset, entry.info.Size()), entry.info}, nil
+	}
+	if _, ok := t.dirs[name]; ok {
+		entries, _ := t.ReadDir(name)
+		return &tarDir{tarDirInfo(path.Base(name)), entries}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir returns the entries of a directory sorted by name, as fs.ReadDir expects
+func (t *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	dir, ok := t.dirs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries := make([]fs.DirEntry, 0, len(dir))
+	for _, entry := range dir {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// tarFile is an open file in a tarFS
+type tarFile struct {
+	*io.SectionReader
+	info fs.FileInfo
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *tarFile) Close() error               { return nil }
+
+// tarDir is an open directory in a tarFS, which returns its entries in name order
+type tarDir struct {
+	info    tarDirInfo
+	entries []fs.DirEntry // the entries not read yet
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *tarDir) Close() error               { return nil }
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries, or all the remaining entries when n <= 0
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		n = len(d.entries)
+	} else if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	entries := d.entries[:minInt(n, len(d.entries))]
+	d.entries = d.entries[len(entries):]
+	return entries, nil
+}
+
+// tarDirInfo is the fs.FileInfo of a directory in a tarFS
+type tarDirInfo string
+
+func (d tarDirInfo) Name() string       { return string(d) }
+func (d tarDirInfo) Size() int64        { return 0 }
+func (d tarDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
+func (d tarDirInfo) ModTime() time.Time { return time.Time{} }
+func (d tarDirInfo) IsDir() bool        { return true }
+func (d tarDirInfo) Sys() interface{}   { return nil }
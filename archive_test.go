@@ -0,0 +1,188 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+)
+
+// testArchiveFiles are the files written into the test archives. The tar leaves out the
+// entry of the trip folder, as many archivers do.
+var testArchiveFiles = []struct {
+	name    string
+	content string
+}{
+	{"a.jpg", "photo a"},
+	{"notes.txt", "not a photo"},
+	{"trip/b.jpg", "photo b"},
+	{"trip/day2/c.jpg", "photo c"},
+}
+
+// writeTestArchive writes the files into a .zip or .tar archive in dir, by the extension of name
+func writeTestArchive(t *testing.T, dir, name string, files map[string][]byte) string {
+	t.Helper()
+	fname := filepath.Join(dir, name)
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if filepath.Ext(name) == ".zip" {
+		archive := zip.NewWriter(f)
+		for _, name := range names {
+			w, err := archive.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(files[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = archive.Close()
+	} else {
+		archive := tar.NewWriter(f)
+		for _, name := range names {
+			header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+			if err := archive.WriteHeader(header); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := archive.Write(files[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = archive.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestOpenArchive(t *testing.T) {
+	files := map[string][]byte{}
+	var names []string
+	for _, file := range testArchiveFiles {
+		files[file.name] = []byte(file.content)
+		names = append(names, file.name)
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"photos.zip", "photos.tar", "PHOTOS.TAR"} {
+		t.Run(name, func(t *testing.T) {
+			archive, err := openArchive(writeTestArchive(t, dir, name, files))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fstest.TestFS(archive, names...); err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range testArchiveFiles {
+				data, err := fs.ReadFile(archive, file.name)
+				if err != nil {
+					t.Errorf("Could not read %s: %s", file.name, err)
+				} else if string(data) != file.content {
+					t.Errorf("Got %q in %s, want %q", data, file.name, file.content)
+				}
+			}
+			if _, err := archive.Open("missing.jpg"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Got error %v for a missing file, want %v", err, fs.ErrNotExist)
+			}
+		})
+	}
+
+	t.Run("unknown extension", func(t *testing.T) {
+		fname := filepath.Join(dir, "photos.rar")
+		if err := os.WriteFile(fname, []byte("not an archive"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openArchive(fname); err == nil {
+			t.Error("Opening a .rar archive succeeded")
+		}
+	})
+}
+
+// TestTarConcurrentReads reads the files of a tar at the same time, which share the one open archive
+func TestTarConcurrentReads(t *testing.T) {
+	files := map[string][]byte{}
+	for i := 0; i < 8; i++ {
+		files[string(rune('a'+i))+".bin"] = bytes.Repeat([]byte{byte(i)}, 64<<10)
+	}
+	archive, err := openTar(writeTestArchive(t, t.TempDir(), "data.tar", files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.archive.Close()
+	errs := make(chan error, len(files))
+	for name, want := range files {
+		go func(name string, want []byte) {
+			f, err := archive.Open(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer f.Close()
+			data, err := io.ReadAll(f)
+			if err == nil && !bytes.Equal(data, want) {
+				err = errors.New("read the wrong contents of " + name)
+			}
+			errs <- err
+		}(name, want)
+	}
+	for range files {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSourceArchive(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "watermark.png"), testWatermark(60, 20))
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, testPhoto(320, 240), nil); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"a.jpg": photo.Bytes(), "trip/b.jpg": photo.Bytes()}
+	tests := []struct {
+		name    string
+		archive string
+		args    []string
+		want    []string
+	}{
+		{"zip", "photos.zip", nil, []string{"a.jpg"}},
+		{"tar", "photos.tar", nil, []string{"a.jpg"}},
+		{"tar with folders", "photos.tar", []string{"-depth", "-1"}, []string{"a.jpg", "trip/b.jpg"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeTestArchive(t, dir, test.archive, files)
+			target := filepath.Join(t.TempDir(), "target")
+			args := append([]string{"-source-archive", test.archive, "-target", target}, test.args...)
+			if code, out := runTool(t, dir, nil, args...); code != exitSuccess {
+				t.Fatalf("The run exited with %d:\n%s", code, out)
+			}
+			written := hashTree(t, target)
+			for _, name := range test.want {
+				if _, ok := written[name]; !ok {
+					t.Errorf("The run didn't write %s, got %v", name, written)
+				}
+			}
+			if len(written) != len(test.want) {
+				t.Errorf("Got %d files written, want %d", len(written), len(test.want))
+			}
+		})
+	}
+}
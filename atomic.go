@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// createTemp creates the temporary file an output is written to before it is moved into place
+// by commitTemp, so an interrupted run never leaves a partial photo behind. It is created in
+// tmpDir, or next to the output when tmpDir is empty. The name starts with a dot, so the file
+// is hidden while it is being written.
+func createTemp(fpath, tmpDir string) (*os.File, error) {
+	dir := tmpDir
+	if dir == "" {
+		dir = filepath.Dir(fpath)
+	}
+	return os.CreateTemp(dir, "."+filepath.Base(fpath)+".*.tmp")
+}
+
+// commitTemp moves the finished temporary file tmpName to fpath, replacing it unless noClobber
+// is set. A rename is atomic, but not possible from another file system such as a -tmpdir on a
+// different disk. The file is then copied next to the output and moved from there instead.
+// The temporary file is removed when the move fails.
+func commitTemp(tmpName, fpath string, noClobber bool) error {
+	if noClobber {
+		// A quick check, moveFile makes sure no file that appears meanwhile is replaced
+		if _, err := os.Lstat(fpath); err == nil {
+			os.Remove(tmpName)
+			return fmt.Errorf("%w: '%s'", errOutputExists, fpath)
+		}
+	}
+	// Temporary files are only readable by their owner
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	err := moveFile(tmpName, fpath, noClobber)
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyAndRename(tmpName, fpath, noClobber)
+		os.Remove(tmpName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		if errors.Is(err, errOutputExists) {
+			return err
+		}
+		return fmt.Errorf("failed to move into place: %w", err)
+	}
+	return nil
+}
+
+// moveFile renames src to dst. With noClobber it links dst to src instead, which fails when dst
+// exists, and then removes src, so a file that appeared at dst since it was checked is never
+// replaced. File systems without hard links fall back to the check and a rename.
+func moveFile(src, dst string, noClobber bool) error {
+	if !noClobber {
+		return os.Rename(src, dst)
+	}
+	err := os.Link(src, dst)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%w: '%s'", errOutputExists, dst)
+	}
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.ENOSYS) {
+		if _, err := os.Lstat(dst); err == nil {
+			return fmt.Errorf("%w: '%s'", errOutputExists, dst)
+		}
+		return os.Rename(src, dst)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// tempFiles are the temporary files of outputs being written. Work abandoned after the
+// -file-timeout may still be writing them when the run exits, so they are removed then. It is
+// safe for concurrent use, and a nil *tempFiles records nothing.
+type tempFiles struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func newTempFiles() *tempFiles {
+	return &tempFiles{names: map[string]bool{}}
+}
+
+func (t *tempFiles) add(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.names[name] = true
+}
+
+func (t *tempFiles) remove(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.names, name)
+}
+
+// removeAll removes the temporary files that are still being written
+func (t *tempFiles) removeAll() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name := range t.names {
+		os.Remove(name)
+		delete(t.names, name)
+	}
+}
+
+// copyAndRename copies the file src to a temporary file next to dst, syncs it so the copy is
+// complete on disk, and moves it to dst with moveFile
+func copyAndRename(src, dst string, noClobber bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createTemp(dst, "")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err == nil {
+		err = moveFile(out.Name(), dst, noClobber)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
+
+// syncDir flushes the entries of the directory dir to disk, so a file renamed into it is
+// still there after a power loss
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// checkTmpDir returns an error when dir can't hold the temporary files of -tmpdir
+func checkTmpDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: "tmpdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// dirNames returns the names of the files in dir
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestSaveFileContextDone(t *testing.T) {
+	tests := []struct {
+		name     string
+		cancel   bool // before saving
+		cancelIn bool // while encoding
+	}{
+		{"cancelled before", true, false},
+		{"cancelled while encoding", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancel {
+				cancel()
+			}
+			temps := newTempFiles()
+			_, err := saveFile(ctx, dir, "photo.jpg", saveOptions{temps: temps}, func(w io.Writer) (string, error) {
+				if test.cancelIn {
+					cancel()
+				}
+				_, err := w.Write([]byte("data"))
+				return "95", err
+			})
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got error %v, want %v", err, context.Canceled)
+			}
+			if names := dirNames(t, dir); len(names) != 0 {
+				t.Errorf("folder holds %v, want no files", names)
+			}
+			if len(temps.names) != 0 {
+				t.Errorf("temporary files %v are still recorded", temps.names)
+			}
+		})
+	}
+}
+
+func TestTempFilesRemoveAll(t *testing.T) {
+	dir := t.TempDir()
+	temps := newTempFiles()
+	file, err := createTemp(filepath.Join(dir, "photo.jpg"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	temps.add(file.Name())
+	temps.removeAll()
+	if names := dirNames(t, dir); len(names) != 0 {
+		t.Errorf("folder holds %v after removeAll, want no files", names)
+	}
+	var none *tempFiles
+	none.add("x")
+	none.removeAll()
+}
+
+// writeTemp writes a temporary file for the output fpath with the given content
+func writeTemp(t *testing.T, fpath, content string) string {
+	t.Helper()
+	file, err := createTemp(fpath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestCommitTempNoClobber(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  bool
+		noClobber bool
+		want      string
+		exists    bool // errOutputExists is returned
+	}{
+		{"new file", false, true, "new", false},
+		{"replaced", true, false, "new", false},
+		{"kept", true, true, "old", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fpath := filepath.Join(dir, "photo.jpg")
+			if test.existing {
+				if err := os.WriteFile(fpath, []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := commitTemp(writeTemp(t, fpath, "new"), fpath, test.noClobber)
+			if got := errors.Is(err, errOutputExists); got != test.exists || (err != nil && !test.exists) {
+				t.Errorf("got error %v, want output exists %v", err, test.exists)
+			}
+			data, _ := os.ReadFile(fpath)
+			if string(data) != test.want {
+				t.Errorf("output holds '%s', want '%s'", data, test.want)
+			}
+			if names := dirNames(t, dir); len(names) != 1 {
+				t.Errorf("folder holds %v, want only the output", names)
+			}
+		})
+	}
+}
+
+// TestMoveFileNoClobber covers a file that appears after commitTemp checked for it
+func TestMoveFileNoClobber(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "photo.jpg")
+	tmp := writeTemp(t, fpath, "new")
+	if err := os.WriteFile(fpath, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveFile(tmp, fpath, true); !errors.Is(err, errOutputExists) {
+		t.Errorf("got error %v, want %v", err, errOutputExists)
+	}
+	if data, _ := os.ReadFile(fpath); string(data) != "old" {
+		t.Errorf("output holds '%s', want 'old'", data)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("temporary file is gone: %v", err)
+	}
+}
+
+// otherFileSystem returns a temporary folder on another file system than dir, such as a tmpfs,
+// or skips the test when there is none
+func otherFileSystem(t *testing.T, dir string) string {
+	t.Helper()
+	for _, parent := range []string{"/dev/shm", os.TempDir()} {
+		other, err := os.MkdirTemp(parent, "tmpdir")
+		if err != nil {
+			continue
+		}
+		t.Cleanup(func() { os.RemoveAll(other) })
+		probe := filepath.Join(other, "probe")
+		if err := os.WriteFile(probe, nil, 0644); err != nil {
+			continue
+		}
+		err = os.Rename(probe, filepath.Join(dir, "probe"))
+		os.Remove(probe)
+		os.Remove(filepath.Join(dir, "probe"))
+		if errors.Is(err, syscall.EXDEV) {
+			return other
+		}
+	}
+	t.Skip("No other file system to rename across")
+	return ""
+}
+
+// TestCommitTempAcrossFileSystems writes outputs with a -tmpdir on another file system, where
+// they can't be renamed into place and are copied next to it first
+func TestCommitTempAcrossFileSystems(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  bool
+		noClobber bool
+		want      string
+		exists    bool // errOutputExists is returned
+	}{
+		{"new file", false, false, "new", false},
+		{"new file without clobbering", false, true, "new", false},
+		{"replaced", true, false, "new", false},
+		{"kept", true, true, "old", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tmpDir := otherFileSystem(t, dir)
+			fpath := filepath.Join(dir, "photo.jpg")
+			if test.existing {
+				if err := os.WriteFile(fpath, []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			file, err := createTemp(fpath, tmpDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := file.WriteString("new"); err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+
+			err = commitTemp(file.Name(), fpath, test.noClobber)
+			if got := errors.Is(err, errOutputExists); got != test.exists || (err != nil && !test.exists) {
+				t.Errorf("got error %v, want output exists %v", err, test.exists)
+			}
+			data, _ := os.ReadFile(fpath)
+			if string(data) != test.want {
+				t.Errorf("output holds '%s', want '%s'", data, test.want)
+			}
+			if info, err := os.Stat(fpath); err == nil && info.Mode().Perm() != 0644 {
+				t.Errorf("output has mode %v, want 0644", info.Mode().Perm())
+			}
+			if names := dirNames(t, dir); len(names) != 1 {
+				t.Errorf("folder holds %v, want only the output", names)
+			}
+			if names := dirNames(t, tmpDir); len(names) != 0 {
+				t.Errorf("temporary folder still holds %v", names)
+			}
+		})
+	}
+}
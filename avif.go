@@ -0,0 +1,68 @@
+//go:build avif
+
+package main
+
+/*
+#cgo pkg-config: libavif
+#include <avif/avif.h>
+
+// encode_avif encodes 8 bit RGBA pixels as AVIF into out, which the caller frees with avifRWDataFree
+static avifResult encode_avif(uint8_t *pixels, uint32_t width, uint32_t height, uint32_t stride, int quality, avifRWData *out) {
+	avifImage *image = avifImageCreate(width, height, 8, AVIF_PIXEL_FORMAT_YUV444);
+	if (image == NULL) {
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+	avifRGBImage rgb;
+	avifRGBImageSetDefaults(&rgb, image);
+	rgb.format = AVIF_RGB_FORMAT_RGBA;
+	rgb.depth = 8;
+	rgb.pixels = pixels;
+	rgb.rowBytes = stride;
+	avifResult result = avifImageRGBToYUV(image, &rgb);
+	if (result != AVIF_RESULT_OK) {
+		avifImageDestroy(image);
+		return result;
+	}
+
+	avifEncoder *encoder = avifEncoderCreate();
+	if (encoder == NULL) {
+		avifImageDestroy(image);
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+	encoder->quality = quality;
+	encoder->qualityAlpha = quality;
+	encoder->maxThreads = 1;
+	result = avifEncoderWrite(encoder, image, out);
+	avifEncoderDestroy(encoder);
+	avifImageDestroy(image);
+	return result;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"unsafe"
+)
+
+// avifSupported reports whether this build can write AVIF, which needs libavif through cgo
+const avifSupported = true
+
+// encodeAVIF writes img to w as AVIF using libavif
+func encodeAVIF(w io.Writer, img image.Image) error {
+	rgba := toRGBA(img)
+	if rgba.Rect.Empty() {
+		return fmt.Errorf("can not encode an empty image as AVIF")
+	}
+	var out C.avifRWData
+	result := C.encode_avif((*C.uint8_t)(unsafe.Pointer(&rgba.Pix[0])), C.uint32_t(rgba.Rect.Dx()), C.uint32_t(rgba.Rect.Dy()),
+		C.uint32_t(rgba.Stride), C.int(avifQuality), &out)
+	defer C.avifRWDataFree(&out)
+	if result != C.AVIF_RESULT_OK {
+		return fmt.Errorf("libavif: %s", C.GoString(C.avifResultToString(result)))
+	}
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out.data), C.int(out.size)))
+	return err
+}
@@ -0,0 +1,17 @@
+//go:build !avif
+
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// avifSupported reports whether this build can write AVIF, which needs libavif through cgo
+const avifSupported = false
+
+// encodeAVIF is not available without the avif build tag
+func encodeAVIF(w io.Writer, img image.Image) error {
+	return errors.New("AVIF output is not supported by this build, rebuild with -tags avif")
+}
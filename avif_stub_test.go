@@ -0,0 +1,29 @@
+//go:build !avif
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAVIFUnsupported checks that a build without the avif tag rejects AVIF output before
+// processing anything
+func TestAVIFUnsupported(t *testing.T) {
+	var out bytes.Buffer
+	if err := encodeAVIF(&out, testPhoto(8, 8)); err == nil || !strings.Contains(err.Error(), "-tags avif") {
+		t.Errorf("Got error %v, want an error naming the build tag", err)
+	}
+
+	dir := t.TempDir()
+	newTestSource(t, dir)
+	code, output := runTool(t, dir, nil, "-source", "photos", "-target", "target", "-output-format", "avif")
+	if code != exitUsage {
+		t.Errorf("Got exit code %d, want %d:\n%s", code, exitUsage, output)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "target", "*")); len(names) > 0 {
+		t.Errorf("Wrote %v", names)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build avif
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestEncodeAVIF(t *testing.T) {
+	var out bytes.Buffer
+	if err := encodeAVIF(&out, testPhoto(64, 48)); err != nil {
+		t.Fatal(err)
+	}
+	// An AVIF file starts with the file type box of the ISO base media format
+	if data := out.Bytes(); len(data) < 12 || string(data[4:8]) != "ftyp" || string(data[8:12]) != "avif" {
+		t.Errorf("Got %d bytes without the AVIF file type box", out.Len())
+	}
+	if err := encodeAVIF(&out, image.NewRGBA(image.Rectangle{})); err == nil {
+		t.Error("An empty image was encoded")
+	}
+}
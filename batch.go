@@ -0,0 +1,879 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/time/rate"
+)
+
+// batch holds the state shared by all workers processing the photos of a run
+type batch struct {
+	params       parameters
+	ctx          context.Context    // cancelled by abort when the run is stopped
+	abort        context.CancelFunc // stops the run, photos not finished yet are not written
+	open         context.Context    // done at the -deadline or when the run is stopped, photos not started yet are not processed
+	source       fs.FS              // the photos are read from the source directory on disk, or from -source-archive
+	sourceRoot   string             // directory of the photos within source
+	watermark    image.Image
+	summary      runSummary
+	memory       *memoryLimiter
+	save         saveOptions
+	contactSheet *contactSheet
+	heatmap      *heatmap
+	report       *csvReport
+	placements   *placementReport
+	limiter      *rate.Limiter // paces the photos with -rate, nil without
+
+	// sharpenWarning warns once that -sharpen loses the precision of 16-bit photos
+	sharpenWarning sync.Once
+
+	// watermarkCache holds the recently used variants of the watermarks, nil with -watermark-cache 0
+	watermarkCache *watermarkCache
+
+	// watermarkDir are the watermarks of -watermark-dir, nil for a single watermark
+	watermarkDir []watermarkLayer
+
+	// randomWatermarks are the watermarks of -watermark-random-dir, nil without
+	randomWatermarks []watermarkLayer
+
+	// renditions are the outputs written for every photo
+	renditions []rendition
+
+	// images is the number of photos in the run, for -opacity-ramp
+	images int
+
+	// done counts the files finished, for the progress lines of -log-every
+	done atomic.Int64
+
+	// failed counts the photos that failed, for -max-errors
+	failed atomic.Int64
+}
+
+// countFailure counts a skipped photo towards -max-errors, and stops the run once that many
+// photos failed. Files that are skipped on purpose, see skippedOnPurpose, don't count.
+func (b *batch) countFailure(err error) {
+	if skippedOnPurpose(err) {
+		return
+	}
+	failed := b.failed.Add(1)
+	if max := b.params.maxErrors; max > 0 && failed == int64(max) {
+		console.Printf("ERROR: %d photos failed, stopping the run\n", failed)
+		b.abort()
+	}
+}
+
+// progress counts a finished file, and with -log-every prints a progress line every N files
+// and after the last one
+func (b *batch) progress(total int) {
+	done := int(b.done.Add(1))
+	every := b.params.logEvery
+	if every > 0 && (done%every == 0 || done == total) {
+		console.Printf("Processed %d of %d files, %d skipped so far\n", done, total, b.summary.skippedCount())
+	}
+}
+
+// fullDir and webDir are the folders of the full size and web outputs of -web-size
+const (
+	fullDir = "full"
+	webDir  = "web"
+)
+
+// rendition is one output written for every photo, in its own folder inside the target directory
+type rendition struct {
+	dir     string // relative to the target directory, empty for the target directory itself
+	maxSize int    // longest side in pixels, 0 keeps the size of the photo
+	opacity int    // opacity of the watermark, -1 uses the -opacity of the run
+	proof   bool   // stamp the output with a large PROOF text
+	bare    bool   // without the watermark, the photo before watermarking of -compare
+}
+
+// newRenditions returns the outputs requested by the parameters. With -web-size the photo is
+// written at full size to the full folder and scaled down to the web folder. With -proof and
+// -final every size is written twice, once in the proof folder and once in the final folder.
+func newRenditions(params parameters) []rendition {
+	sized := []rendition{{opacity: -1}}
+	if len(params.sizes) > 0 {
+		sized = make([]rendition, 0, len(params.sizes))
+		for _, size := range params.sizes {
+			sized = append(sized, rendition{dir: strconv.Itoa(size), maxSize: size, opacity: -1})
+		}
+	} else if params.webSize > 0 {
+		sized = []rendition{{dir: fullDir, opacity: -1}, {dir: webDir, maxSize: params.webSize, opacity: -1}}
+	}
+	if !params.proof && !params.final {
+		return sized
+	}
+
+	var renditions []rendition
+	for _, r := range sized {
+		if params.proof {
+			renditions = append(renditions, rendition{dir: path.Join("proof", r.dir), maxSize: r.maxSize, opacity: params.proofOpacity, proof: true})
+		}
+		if params.final {
+			renditions = append(renditions, rendition{dir: path.Join("final", r.dir), maxSize: r.maxSize, opacity: params.finalOpacity})
+		}
+	}
+	return renditions
+}
+
+// errPanic is returned by safeProcessFile when processing a photo panicked, for example in a
+// decoder or encoder on a malformed file
+var errPanic = errors.New("crashed")
+
+// errWatermarkTooLarge is returned with -min-source-ratio-skip for photos the watermark would overpower
+var errWatermarkTooLarge = errors.New("watermark too large")
+
+// errTimeout is returned with -file-timeout for photos that took too long to process
+var errTimeout = errors.New("timed out")
+
+// errAborted is returned for photos that were not finished because the run was stopped, or not
+// started because the -deadline passed
+var errAborted = errors.New("run stopped")
+
+// safeProcessFile is processFile, but a panic is turned into an error for the photo so a single
+// pathological file doesn't stop the whole batch. With -no-recover the panic is not caught.
+func (b *batch) safeProcessFile(file sourceFile) (err error) {
+	defer b.recoverPanic(file, &err)
+	return b.processFile(file)
+}
+
+// recoverPanic is deferred by workers to turn a panic into an error in *err
+func (b *batch) recoverPanic(file sourceFile, err *error) {
+	if b.params.noRecover {
+		return
+	}
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%w while processing '%s': %v", errPanic, file.relPath, r)
+	}
+}
+
+// withTimeout runs work. With -file-timeout it runs in its own goroutine, which is abandoned
+// when it takes longer so the worker can move on. The work is passed a context that is
+// cancelled at that point, and should stop at its next check of the context.
+func (b *batch) withTimeout(file sourceFile, work func(ctx context.Context) error) error {
+	timeout := b.params.fileTimeout
+	if timeout <= 0 {
+		return work(b.ctx)
+	}
+	ctx, cancel := context.WithTimeout(b.ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { done <- err }()
+		defer b.recoverPanic(file, &err)
+		err = work(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if b.ctx.Err() != nil {
+			return errAborted
+		}
+		return fmt.Errorf("%w after %s", errTimeout, timeout)
+	}
+}
+
+// processFile watermarks a single photo from the source directory and saves it in the same place in the target directory
+func (b *batch) processFile(file sourceFile) error {
+	params := b.params
+	ftype := sourceType(file.Name())
+	if ftype == "" {
+		return errUnsupportedType
+	}
+	if b.ctx.Err() != nil || b.open.Err() != nil {
+		return errAborted
+	}
+	if b.limiter != nil {
+		// Photos wait for their turn before reading anything, no longer than the run is open
+		if err := b.limiter.Wait(b.open); err != nil {
+			return errAborted
+		}
+	}
+
+	// Reading the header is cheap, so unwanted or broken photos are skipped before decoding them
+	fname := path.Join(b.sourceRoot, file.relPath)
+	config, err := imageConfig(b.source, fname, ftype)
+	if err != nil {
+		return err
+	}
+	if err := b.checkConfig(config); err != nil {
+		return err
+	}
+
+	// The memory is only released once the work is done, even if the worker gave up on it
+	release := func() {}
+	if b.memory != nil {
+		cost := estimateMemory(config, params.aspect)
+		b.memory.acquire(cost)
+		release = func() { b.memory.release(cost) }
+		// Waiting for memory can take long, the deadline may have passed meanwhile
+		if b.open.Err() != nil {
+			release()
+			return errAborted
+		}
+	}
+	// The time for -timings starts once the photo is admitted, so waiting for -rate or
+	// -max-memory doesn't count
+	start := time.Now()
+	err = b.withTimeout(file, func(ctx context.Context) error {
+		defer release()
+		return b.processImage(ctx, file, fname, ftype)
+	})
+	if b.ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		return errAborted
+	}
+	if params.timings > 0 && !errors.Is(err, errAborted) {
+		b.summary.recordDuration(file.relPath, time.Since(start))
+	}
+	return err
+}
+
+// processImage decodes, watermarks and saves a photo, after processFile has checked it. It
+// stops early, without writing more output, when ctx is cancelled.
+func (b *batch) processImage(ctx context.Context, file sourceFile, fname string, ftype string) error {
+	params := b.params
+	if params.noRecompress && ftype == "jpeg" {
+		return b.copyJPEG(ctx, file, fname)
+	}
+	var srcImage image.Image
+	var pages []image.Image // the other pages of a multi-page TIFF photo, for TIFF output
+	var err error
+	if ftype == "tiff" && params.outputFormat == "tiff" {
+		var all []image.Image
+		if all, err = readTIFFPages(b.source, fname); err == nil {
+			srcImage, pages = all[0], all[1:]
+		}
+	} else {
+		srcImage, err = openImage(b.source, fname, ftype)
+	}
+	if err != nil {
+		return err
+	}
+
+	if params.srgb {
+		srcImage = b.convertToSRGB(file, fname, ftype, srcImage)
+	}
+	sourceSize := srcImage.Bounds().Size()
+	b.summary.recordDimensions(sourceSize)
+	srcImage = rotate(srcImage, params.rotateSource)
+	for i := range pages {
+		pages[i] = rotate(pages[i], params.rotateSource)
+	}
+	settings := b.photoSettings(file)
+	if params.subjectMasks {
+		settings.subject = b.subjectMask(file, fname, srcImage.Bounds().Size())
+	}
+
+	for i, r := range b.renditions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		output, placements, err := b.renderRendition(settings, srcImage, r)
+		if err != nil {
+			return err
+		}
+		if len(pages) > 0 {
+			if output, err = b.renderPages(ctx, settings, output, pages, r); err != nil {
+				return err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if i == 0 && b.contactSheet != nil {
+			b.contactSheet.add(file.relPath, output)
+		}
+		if i == 0 && params.compare != "" {
+			if err := b.writeComparison(ctx, settings, srcImage, r, output, file.relPath); err != nil {
+				return err
+			}
+		}
+		relDir, name := b.outputPath(file.relPath)
+		dir := path.Join(params.targetDir, r.dir, relDir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create folder: %w", err)
+		}
+		saved, err := saveImage(ctx, output, dir, name, b.save)
+		if err != nil {
+			return err
+		}
+		if params.verifyOutput {
+			if err := verifyOutput(output, dir, name, params.outputFormat); err != nil {
+				os.Remove(path.Join(dir, name))
+				return err
+			}
+		}
+		if b.report != nil {
+			b.report.addOutput(file.relPath, path.Join(dir, name), sourceSize, output.Bounds().Size(), settings.location, saved)
+		}
+		if b.placements != nil {
+			for _, placed := range placements {
+				if !placed.rect.Empty() {
+					b.placements.add(b.placementEntry(file.relPath, path.Join(dir, name), output.Bounds().Size(), placed))
+				}
+			}
+		}
+	}
+	if b.randomWatermarks != nil {
+		b.summary.recordWatermark(b.randomWatermarks[settings.random].name)
+	}
+	return nil
+}
+
+// copyJPEG writes a JPEG photo to the output with -no-recompress: its data is copied as is, with
+// only the -copyright and -comment segments added, so its pixels are exactly those of the photo
+func (b *batch) copyJPEG(ctx context.Context, file sourceFile, fname string) error {
+	config, err := imageConfig(b.source, fname, "jpeg")
+	if err != nil {
+		return err
+	}
+	inputfile, reader, err := openSource(b.source, fname, "jpeg")
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(reader)
+	inputfile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	data = addTextMetadata(data, "jpeg", b.params.copyright, b.params.comment)
+	size := image.Point{config.Width, config.Height}
+	b.summary.recordDimensions(size)
+
+	for _, r := range b.renditions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relDir, name := b.outputPath(file.relPath)
+		dir := path.Join(b.params.targetDir, r.dir, relDir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create folder: %w", err)
+		}
+		saved, err := saveFile(ctx, dir, name, b.save, func(w io.Writer) (string, error) {
+			_, err := w.Write(data)
+			return "lossless", err
+		})
+		if err != nil {
+			return err
+		}
+		if b.report != nil {
+			b.report.addOutput(file.relPath, path.Join(dir, name), size, size, b.photoSettings(file).location, saved)
+		}
+	}
+	return nil
+}
+
+// renderPages watermarks the other pages of a multi-page TIFF photo like its first page, which
+// was rendered as first, and returns all of them for TIFF output. The subject mask only
+// belongs to the first page.
+func (b *batch) renderPages(ctx context.Context, settings photoSettings, first image.Image, pages []image.Image, r rendition) (image.Image, error) {
+	settings.subject = nil
+	stack := &multiPage{Image: first, pages: []image.Image{first}}
+	for _, page := range pages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		output, _, err := b.renderRendition(settings, page, r)
+		if err != nil {
+			return nil, err
+		}
+		stack.pages = append(stack.pages, output)
+	}
+	return stack, nil
+}
+
+// placementEntry describes the watermark drawn on the output of a photo for -emit-placement
+// and -placement-svg
+func (b *batch) placementEntry(source, output string, outputSize image.Point, placed watermarkPlacement) placementEntry {
+	entry := placementEntry{
+		Source: source, Output: output, outputSize: outputSize, Watermark: placed.watermark, Location: placed.location,
+		X: placed.rect.Min.X, Y: placed.rect.Min.Y, Width: placed.rect.Dx(), Height: placed.rect.Dy(),
+		Opacity: placed.opacity, Blend: b.params.blend,
+	}
+	// The scale is left out for the bar, which is generated for every photo and has no
+	// watermark file to be a scale of
+	if placed.scale > 0 {
+		entry.Scale = math.Round(placed.scale*1e4) / 1e4
+	}
+	return entry
+}
+
+// convertToSRGB converts a photo with an embedded color profile to sRGB for -srgb. Photos
+// without a profile are taken to be sRGB already. A profile that can't be used is reported,
+// and the photo is used as it is.
+func (b *batch) convertToSRGB(file sourceFile, fname string, ftype string, photo image.Image) image.Image {
+	if ftype == "tiff" {
+		// The profile of TIFF photos is not read
+		return photo
+	}
+	data, err := readICCProfile(b.source, fname, ftype)
+	if err != nil {
+		console.Photof(file.relPath, "WARNING: Photo '%s': could not read color profile, keeping its colors: %s\n", file.relPath, err)
+		return photo
+	}
+	if data == nil {
+		return photo
+	}
+	profile, err := parseICCProfile(data)
+	if err != nil {
+		console.Photof(file.relPath, "WARNING: Photo '%s': keeping its colors: %s\n", file.relPath, err)
+		return photo
+	}
+	return convertToSRGB(photo, profile)
+}
+
+// subjectMask returns the subject mask of a photo for -subject-masks, turned like the photo, or
+// nil when the photo has none. A mask that can't be used is reported and left out.
+func (b *batch) subjectMask(file sourceFile, fname string, photoSize image.Point) image.Image {
+	mask, err := loadSubjectMask(b.source, fname)
+	if err != nil {
+		console.Photof(file.relPath, "WARNING: Photo '%s': ignoring its subject mask: %s\n", file.relPath, err)
+		return nil
+	}
+	if mask == nil {
+		return nil
+	}
+	rotated := rotate(mask, b.params.rotateSource)
+	if rotated.Bounds().Size() != photoSize {
+		console.Photof(file.relPath, "WARNING: Photo '%s': ignoring its subject mask, it is %dx%d instead of the %dx%d of the photo\n",
+			file.relPath, rotated.Bounds().Dx(), rotated.Bounds().Dy(), photoSize.X, photoSize.Y)
+		return nil
+	}
+	return rotated
+}
+
+// photoSettings are the settings that can differ between the photos of a batch
+type photoSettings struct {
+	name     string // path of the photo relative to the source, used in messages
+	location string
+	opacity  int         // opacity of the watermark, -1 uses the -opacity of the run
+	subject  image.Image // with -subject-masks, the mask of the subject drawn over the watermark, or nil
+
+	// watermark is the watermark of the photo, the watermark of the run unless the photo has
+	// its own such as the text of -text-template
+	watermark image.Image
+
+	// random is the index of the watermark of -watermark-random-dir picked for the photo
+	random int
+}
+
+// photoSettings returns the settings for a photo of the batch. With -alternate the photos
+// take turns on the left and the right, and with -opacity-ramp the opacity changes from photo
+// to photo, in the order they are listed. With -parse-names the settings in the file name of
+// the photo take precedence.
+func (b *batch) photoSettings(file sourceFile) photoSettings {
+	settings := photoSettings{name: file.relPath, location: b.params.location, opacity: -1, watermark: b.watermark}
+	if b.params.alternate {
+		settings.location = alternateLocation(b.params.location, file.index%2 == 1)
+	}
+	if b.params.opacityRamp {
+		settings.opacity = rampOpacity(file.index, b.images, b.params.rampStart, b.params.rampEnd)
+	}
+	if b.params.paramsFromExif {
+		b.metadataOverrides(file, &settings)
+	}
+	if b.params.parseNames {
+		overrides, problems := parseNameOverrides(file.relPath)
+		for _, problem := range problems {
+			console.Photof(file.relPath, "WARNING: Photo '%s': ignoring %s in its name\n", file.relPath, problem)
+		}
+		if overrides.location != "" {
+			settings.location = overrides.location
+		}
+		if overrides.opacity >= 0 {
+			settings.opacity = overrides.opacity
+		}
+	}
+	if b.randomWatermarks != nil {
+		settings.random = randomWatermark(b.params.seed, file.relPath, len(b.randomWatermarks))
+	}
+	if b.params.textTemplate != "" {
+		settings.watermark = nativeText(expandTextTemplate(b.params.textTemplate, file.relPath, b.dateTaken(file)), b.params.textColor.RGBA)
+	}
+	return settings
+}
+
+// metadataOverrides applies the -params-from-exif settings in the metadata of a photo. A photo
+// without them, or whose metadata can't be read, keeps the settings of the run.
+func (b *batch) metadataOverrides(file sourceFile, settings *photoSettings) {
+	texts, err := readPhotoTexts(b.source, path.Join(b.sourceRoot, file.relPath), sourceType(file.Name()))
+	if err != nil {
+		console.Photof(file.relPath, "WARNING: Photo '%s': could not read its metadata, keeping the settings of the run: %s\n", file.relPath, err)
+		return
+	}
+	overrides, problems, _ := parseMetadataOverrides(texts)
+	for _, problem := range problems {
+		console.Photof(file.relPath, "WARNING: Photo '%s': ignoring %s in its metadata\n", file.relPath, problem)
+	}
+	if overrides.location != "" {
+		settings.location = overrides.location
+	}
+	if overrides.opacity >= 0 {
+		settings.opacity = overrides.opacity
+	}
+}
+
+// dateTaken returns the date a photo was taken for -text-template, from its EXIF data or else
+// the time the file was last modified
+func (b *batch) dateTaken(file sourceFile) time.Time {
+	if strings.Contains(b.params.textTemplate, "{date}") || strings.Contains(b.params.textTemplate, "{year}") {
+		taken, err := readDateTaken(b.source, path.Join(b.sourceRoot, file.relPath), sourceType(file.Name()))
+		if err == nil && !taken.IsZero() {
+			return taken
+		}
+	}
+	return file.ModTime()
+}
+
+// renderRendition resizes, sharpens and vignettes the decoded photo as needed for the rendition, and
+// returns it watermarked and ready to be saved
+func (b *batch) renderRendition(settings photoSettings, srcImage image.Image, r rendition) (image.Image, []watermarkPlacement, error) {
+	name := settings.name
+	params := b.params
+	photo := srcImage
+	if r.maxSize > 0 {
+		photo = resizeToFit(srcImage, r.maxSize)
+	}
+	if params.printSize.isSet() {
+		photo = resizeForPrint(photo, params.printSize, params.dpi)
+	}
+	if params.minSourceRatio > 0 && !params.noWatermark && !r.bare {
+		for _, layer := range b.layers(settings) {
+			if err := b.checkCoverage(b.canvasSize(photo.Bounds().Size()), layer); err != nil {
+				if params.minSourceRatioSkip {
+					return nil, nil, err
+				}
+				console.Photof(name, "WARNING: Photo '%s': %s\n", name, err)
+			}
+		}
+	}
+	if params.sharpen > 0 {
+		if b.deepColor(photo) {
+			b.sharpenWarning.Do(func() {
+				console.Println("WARNING: -sharpen works with 8 bits per channel, sharpened 16-bit photos are saved with 8 bits of precision")
+			})
+		}
+		photo = sharpen(photo, params.sharpen, params.sharpenRadius)
+	}
+	if params.vignette > 0 {
+		photo = vignette(photo, params.vignette, params.vignetteRadius)
+	}
+	output, placements := b.render(photo, r, settings)
+	if r.bare {
+		return output, nil, nil
+	}
+	if b.heatmap != nil {
+		rects := make([]image.Rectangle, len(placements))
+		for i, placed := range placements {
+			rects[i] = placed.rect
+		}
+		b.heatmap.add(name, output, rects)
+	}
+	if params.invisible != "" {
+		// The invisible watermark is always rendered with 8 bits per channel, see deepColor
+		if err := embedText(output.(*image.RGBA), params.invisible); err != nil {
+			return nil, placements, err
+		}
+	}
+	return output, placements, nil
+}
+
+// outputPath returns the directory, relative to the target directory, and the file name of
+// the output for a photo. Subdirectories of the source are mirrored, or with -encode-path
+// they are encoded into the file name so all outputs land in one folder, e.g. 2023/trip/a.jpg
+// becomes 2023_trip_a.jpg.
+func (b *batch) outputPath(relPath string) (string, string) {
+	name := outputName(path.Base(relPath), b.params.outputFormat)
+	dir := path.Dir(relPath)
+	if !b.params.encodePath || dir == "." {
+		return dir, name
+	}
+	return "", strings.Join(append(strings.Split(dir, "/"), name), b.params.pathSeparator)
+}
+
+// checkConfig returns an error for photos that should be skipped based on their
+// dimensions, as read from their header by imageConfig
+func (b *batch) checkConfig(config image.Config) error {
+	if longest := maxInt(config.Width, config.Height); longest < b.params.minDimension {
+		return fmt.Errorf("%w: %dx%d is below %dpx", errTooSmall, config.Width, config.Height, b.params.minDimension)
+	}
+	return nil
+}
+
+// watermarkPlacement describes the watermark drawn on an output, for the heatmap and -emit-placement
+type watermarkPlacement struct {
+	rect    image.Rectangle // where it was drawn, the whole canvas for a tiled watermark
+	size    image.Point     // size of the scaled watermark, or of a single tile
+	scale   float64         // height of the scaled watermark relative to the watermark, 0 for the bar
+	opacity int
+
+	location  string
+	watermark string // file name of the watermark in -watermark-dir, empty for a single watermark
+}
+
+// watermarkLayer is a watermark drawn on a photo, with its own location, opacity and scale.
+// A photo has a single layer, its watermark or the bar, unless -watermark-dir gives several.
+type watermarkLayer struct {
+	image    image.Image // nil for the bar
+	name     string      // file name in -watermark-dir
+	location string
+	opacity  int // -1 uses the opacity of the photo
+	scale    float64
+}
+
+// layers returns the watermarks drawn on a photo with the given settings: the watermark of the
+// photo, the watermarks of -watermark-dir in order, or the one picked from -watermark-random-dir,
+// with the location and scale of the photo unless their sidecar file sets them
+func (b *batch) layers(settings photoSettings) []watermarkLayer {
+	scale := float64(b.params.scale)
+	candidates := b.watermarkDir
+	if b.randomWatermarks != nil {
+		candidates = b.randomWatermarks[settings.random : settings.random+1]
+	} else if candidates == nil {
+		return []watermarkLayer{{image: settings.watermark, location: settings.location, opacity: -1, scale: scale}}
+	}
+	layers := make([]watermarkLayer, len(candidates))
+	for i, layer := range candidates {
+		if layer.location == "" {
+			layer.location = settings.location
+		}
+		if layer.scale == 0 {
+			layer.scale = scale
+		}
+		layers[i] = layer
+	}
+	return layers
+}
+
+// render draws the photo on a new canvas and watermarks it for the given rendition. The canvas
+// is an *image.RGBA64 for photos with 16 bits per channel when deepColor allows it, otherwise
+// an *image.RGBA. It also returns where the watermark was drawn on the canvas, which is empty
+// with -no-watermark.
+func (b *batch) render(photo image.Image, r rendition, settings photoSettings) (draw.RGBA64Image, []watermarkPlacement) {
+	params := b.params
+	imgSize := photo.Bounds()
+
+	canvasSize := b.canvasSize(imgSize.Size())
+	canvasRect := image.Rectangle{Max: canvasSize}
+	photoRect := image.Rectangle{Max: imgSize.Size()}.Add(canvasSize.Sub(imgSize.Size()).Div(2))
+	var canvas draw.RGBA64Image = image.NewRGBA(canvasRect)
+	if b.deepColor(photo) {
+		canvas = image.NewRGBA64(canvasRect)
+	}
+
+	// Fill with the background first, so transparent areas of PNG photos don't turn black as JPEG
+	draw.Draw(canvas, canvasRect, image.NewUniform(params.background.RGBA), image.Point{0, 0}, draw.Src)
+	draw.Draw(canvas, photoRect, photo, imgSize.Min, draw.Over)
+	if params.shape != "" {
+		cutShape(canvas, params.shape, params.radius)
+	}
+
+	opacity := params.opacity
+	if r.opacity >= 0 {
+		opacity = r.opacity
+	} else if settings.opacity >= 0 {
+		opacity = settings.opacity
+	}
+	// With -overlay-only the photo is still drawn, as the smart location and adaptive opacity
+	// look at it, but the watermark goes on a transparent canvas that is written instead
+	dst := canvas
+	if params.overlayOnly {
+		dst = image.NewRGBA(canvasRect)
+		if b.deepColor(photo) {
+			dst = image.NewRGBA64(canvasRect)
+		}
+	}
+	var placements []watermarkPlacement
+	if !params.noWatermark && !r.bare {
+		for _, layer := range b.layers(settings) {
+			// The opacity of a rendition applies to all layers, the opacity of a layer to all photos
+			if r.opacity >= 0 || layer.opacity < 0 {
+				layer.opacity = opacity
+				if r.opacity < 0 && settings.opacity < 0 && layer.location == "tile" {
+					layer.opacity = params.tileOpacity
+				}
+			}
+			placements = append(placements, b.applyWatermark(dst, canvas, layer, r.opacity < 0))
+		}
+	}
+	if settings.subject != nil {
+		// The subject is drawn again over the watermark, so the watermark appears behind it. On
+		// an overlay the watermark is cut away there instead.
+		subject := fitSubjectMask(settings.subject, imgSize.Size())
+		if params.overlayOnly {
+			draw.DrawMask(dst, photoRect, image.Transparent, image.Point{}, subject, image.Point{}, draw.Src)
+		} else {
+			draw.DrawMask(dst, photoRect, photo, imgSize.Min, subject, image.Point{}, draw.Over)
+		}
+	}
+
+	if r.proof {
+		// A proof carries a large text across the middle, so it can't be used as the final photo
+		stamp := renderText("PROOF", canvasSize.Y/4, color.White)
+		if stamp.Bounds().Dx() > canvasSize.X*9/10 {
+			stamp = resize.Resize(uint(canvasSize.X*9/10), 0, stamp, resize.Bilinear)
+		}
+		stampRect := image.Rectangle{Max: stamp.Bounds().Size()}.Add(canvasSize.Sub(stamp.Bounds().Size()).Div(2))
+		drawWatermark(dst, stampRect, stamp, image.NewUniform(color.Alpha{opacityAlpha(opacity)}), "normal", params.linearBlend, "rgb")
+	}
+	canvas = dst
+
+	if params.border > 0 {
+		canvas = addBorder(canvas, params.border, params.borderColor.RGBA)
+		for i := range placements {
+			placements[i].rect = placements[i].rect.Add(image.Point{params.border, params.border})
+		}
+	}
+	return canvas, placements
+}
+
+// deepColor reports whether the photo is rendered with 16 bits per channel. That precision is
+// kept for photos that have it when writing PNG, JPEG only stores 8 bits. The invisible
+// watermark is hidden in the lowest of 8 bits, so it is always rendered with 8 bits.
+func (b *batch) deepColor(photo image.Image) bool {
+	if b.params.outputFormat != "png" || b.params.invisible != "" {
+		return false
+	}
+	return isDeepColor(photo)
+}
+
+// canvasSize returns the size of the canvas for a photo of the given size: the photo itself,
+// or the photo centered on a padded canvas with -aspect
+func (b *batch) canvasSize(photoSize image.Point) image.Point {
+	if b.params.aspect.isSet() {
+		return padToAspect(photoSize, b.params.aspect)
+	}
+	return photoSize
+}
+
+// watermarkSizeFor returns the size of the watermark, or of the bar, of a layer on a canvas of
+// the given size
+func (b *batch) watermarkSizeFor(canvasSize image.Point, layer watermarkLayer) image.Point {
+	params := b.params
+	if params.bar {
+		return image.Point{canvasSize.X, int(layer.scale * float64(canvasSize.Y))}
+	}
+	wmSize := layer.image.Bounds().Size()
+	size := watermarkSize(canvasSize, wmSize, layer.scale, params.scaleMode)
+	if params.referenceResolution.isSet() {
+		size = referenceWatermarkSize(canvasSize, params.referenceResolution.Point, wmSize, layer.scale, params.scaleMode)
+	}
+	if params.watermarkBox.isSet() {
+		size = fitToBox(wmSize, params.watermarkBox.Point)
+	}
+	if params.noUpscale && size.Y >= wmSize.Y {
+		return wmSize
+	}
+	return size
+}
+
+// checkCoverage returns an error when the canvas is less than -min-source-ratio times the
+// area of the watermark, which happens when the -scale is too high for small photos
+func (b *batch) checkCoverage(canvasSize image.Point, layer watermarkLayer) error {
+	// Only the part of the watermark that fits on the canvas covers the photo
+	wmSize := b.watermarkSizeFor(canvasSize, layer)
+	wmArea := float64(minInt(wmSize.X, canvasSize.X)) * float64(minInt(wmSize.Y, canvasSize.Y))
+	canvasArea := float64(canvasSize.X) * float64(canvasSize.Y)
+	if wmArea > 0 && canvasArea/wmArea < b.params.minSourceRatio {
+		return fmt.Errorf("%w: it covers %.0f%% of the %dx%d photo", errWatermarkTooLarge, 100*wmArea/canvasArea, canvasSize.X, canvasSize.Y)
+	}
+	return nil
+}
+
+// placement returns the fine-tuning of the watermark position set by the parameters
+func (b *batch) placement() placement {
+	anchor := b.params.anchor
+	return placement{offsetX: b.params.offsetX + anchor.offsetX, offsetY: b.params.offsetY + anchor.offsetY, nudge: anchor.nudge, safeZone: b.params.safeZone / 100}
+}
+
+// applyWatermark scales and places the watermark of a layer, or generates the bar, for the
+// photo on the canvas and composites it onto dst with the opacity of the layer, dst is the
+// canvas itself unless -overlay-only is set. With adaptive set the opacity of
+// -adaptive-opacity replaces it. It returns where and how the watermark was drawn.
+func (b *batch) applyWatermark(dst, canvas draw.RGBA64Image, layer watermarkLayer, adaptive bool) watermarkPlacement {
+	params := b.params
+	watermark, opacity, location := layer.image, layer.opacity, layer.location
+	canvasRect := canvas.Bounds()
+	canvasSize := canvasRect.Size()
+
+	// The smart location and adaptive opacity measure the photo at 8 bits per channel
+	var preview *image.RGBA
+	analysis := func() *image.RGBA {
+		if preview == nil {
+			preview = toRGBA(canvas)
+		}
+		return preview
+	}
+
+	var scaledWatermark image.Image
+	var watermarkOffset image.Point
+	var scale float64
+	size := b.watermarkSizeFor(canvasSize, layer)
+	if params.bar {
+		scaledWatermark = makeBar(size.X, size.Y, params.barColor.RGBA, params.text, params.textColor.RGBA, location)
+		if params.barEdge == "bottom" {
+			watermarkOffset = image.Point{0, canvasSize.Y - size.Y}
+		}
+	} else {
+		// The watermark of -text-template is new for every photo, so there is nothing to reuse
+		if b.watermarkCache != nil && params.textTemplate == "" {
+			key := variantKey{source: watermark, size: size}
+			scaledWatermark = b.watermarkCache.get(key, func() image.Image {
+				return scaleWatermark(watermark, size, params.noUpscale)
+			})
+		} else {
+			scaledWatermark = scaleWatermark(watermark, size, params.noUpscale)
+		}
+		scale = float64(scaledWatermark.Bounds().Dy()) / float64(watermark.Bounds().Dy())
+		if location == "tile" {
+			// A tiled watermark covers the whole photo, so there is no area to adapt the opacity to
+			mask := opacityMask(scaledWatermark, opacity, params.opacityPixels)
+			for _, offset := range tileOffsets(canvasRect, scaledWatermark.Bounds()) {
+				r := image.Rectangle{Max: scaledWatermark.Bounds().Size()}.Add(offset)
+				drawWatermark(dst, r, scaledWatermark, mask, params.blend, params.linearBlend, params.channels)
+			}
+			return watermarkPlacement{rect: canvasRect, size: scaledWatermark.Bounds().Size(), scale: scale, opacity: opacity, location: location, watermark: layer.name}
+		}
+		if location == "smart" {
+			watermarkOffset = smartOffset(analysis(), scaledWatermark.Bounds(), b.placement(), corners)
+		} else if location == "auto-corner" {
+			watermarkOffset = smartOffset(analysis(), scaledWatermark.Bounds(), b.placement(), bottomCorners)
+		} else {
+			watermarkOffset = computeOffset(canvasRect, scaledWatermark.Bounds(), location, b.placement())
+		}
+	}
+	wmRect := image.Rectangle{Max: scaledWatermark.Bounds().Size()}.Add(watermarkOffset)
+
+	if adaptive && params.adaptiveOpacity != "off" {
+		opacity = adaptiveOpacity(meanLuminance(analysis(), wmRect), params.adaptiveOpacity, params.adaptiveMin, params.adaptiveMax)
+	}
+	if params.backdropBlur > 0 {
+		blurBackdrop(canvas, backdropRect(wmRect, params.backdropPadding).Intersect(canvasRect), params.backdropBlur)
+	}
+	if params.backdropColor.isSet() {
+		panelRect := backdropRect(wmRect, params.backdropPadding)
+		panel := backdropPanel(panelRect.Size(), params.backdropColor.RGBA)
+		drawWatermark(dst, panelRect, panel, image.NewUniform(color.Alpha{opacityAlpha(params.backdropOpacity)}), "normal", params.linearBlend, "rgb")
+	}
+	drawWatermark(dst, wmRect, scaledWatermark, opacityMask(scaledWatermark, opacity, params.opacityPixels), params.blend, params.linearBlend, params.channels)
+	return watermarkPlacement{rect: wmRect, size: scaledWatermark.Bounds().Size(), scale: scale, opacity: opacity, location: location, watermark: layer.name}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlacementEntryScale(t *testing.T) {
+	tests := []struct {
+		name   string
+		placed watermarkPlacement
+		want   string
+	}{
+		{"watermark", watermarkPlacement{rect: image.Rect(10, 20, 70, 40), scale: 0.123456, opacity: 70, location: "br"}, `"scale":0.1235`},
+		{"bar", watermarkPlacement{rect: image.Rect(0, 80, 100, 100), opacity: 70, location: "right"}, ""},
+	}
+	b := &batch{params: parameters{blend: "normal"}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := json.Marshal(b.placementEntry("a.jpg", "a.jpg", image.Point{100, 100}, test.placed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.want == "" && strings.Contains(string(data), `"scale"`) {
+				t.Errorf("Got %s, want no scale", data)
+			} else if test.want != "" && !strings.Contains(string(data), test.want) {
+				t.Errorf("Got %s, want %s", data, test.want)
+			}
+		})
+	}
+}
+
+// TestTimingsExcludeQueue checks that -timings measures the work on a photo, not the time it
+// waited for its turn under -rate
+func TestTimingsExcludeQueue(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "watermark.png"), testWatermark(30, 10))
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg", "f.jpg"} {
+		writeTestImage(t, filepath.Join(dir, "photos", name), testPhoto(64, 48))
+	}
+	// One photo starts every 0.25 seconds, so the last one waits for more than a second
+	start := time.Now()
+	code, out := runTool(t, dir, nil, "-source", "photos", "-target", "target", "-rate", "4", "-timings", "6")
+	if code != exitSuccess {
+		t.Fatalf("The run exited with %d:\n%s", code, out)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("The run took %s, so the photos didn't wait for their turn", elapsed)
+	}
+	_, report, ok := strings.Cut(out, "Slowest 6 files:\n")
+	if !ok {
+		t.Fatalf("The run reported no timings:\n%s", out)
+	}
+	lines := strings.Split(report, "\n")[:6]
+	for _, line := range lines {
+		fields := strings.Fields(strings.TrimPrefix(line, "- "))
+		if len(fields) != 2 {
+			t.Fatalf("Got timing line %q", line)
+		}
+		d, err := time.ParseDuration(fields[0])
+		if err != nil {
+			t.Fatalf("Got timing line %q: %s", line, err)
+		}
+		if d > 200*time.Millisecond {
+			t.Errorf("Got %s for %s, which includes the time it waited", d, fields[1])
+		}
+	}
+}
+
+func TestCountFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		errs    []error
+		aborted bool
+	}{
+		{"failures", []error{errNotAnImage, &decodeError{errors.New("bad data")}}, true},
+		{"one failure", []error{errNotAnImage, errUnsupportedType}, false},
+		{"skipped on purpose", []error{errUnsupportedType, errTooSmall, errWatermarkTooLarge, fmt.Errorf("%w: it covers 80%%", errWatermarkTooLarge)}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, abort := context.WithCancel(context.Background())
+			defer abort()
+			b := &batch{params: parameters{maxErrors: 2}, ctx: ctx, abort: abort}
+			for _, err := range test.errs {
+				b.countFailure(err)
+			}
+			if aborted := ctx.Err() != nil; aborted != test.aborted {
+				t.Errorf("Got aborted %v, want %v", aborted, test.aborted)
+			}
+		})
+	}
+}
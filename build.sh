@@ -1,5 +1,5 @@
-GOOS=windows GOARCH=amd64 go build -o bin/WaterMarker_Windows.exe WaterMarker.go
+GOOS=windows GOARCH=amd64 go build -o bin/WaterMarker_Windows.exe .
 
-GOOS=darwin GOARCH=amd64 go build -o bin/WaterMarker_MacOS WaterMarker.go
+GOOS=darwin GOARCH=amd64 go build -o bin/WaterMarker_MacOS .
 
-GOOS=linux GOARCH=amd64 go build -o bin/WaterMarker_Linux WaterMarker.go
\ No newline at end of file
+GOOS=linux GOARCH=amd64 go build -o bin/WaterMarker_Linux .
\ No newline at end of file
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// variantKey identifies a variant of a watermark: the watermark it is made from and the size it
+// is scaled to. The -recolor mappings are the same for the whole run, and are applied when the
+// watermark is loaded or, for SVG watermarks, by every render, so they are part of the variant.
+type variantKey struct {
+	source image.Image
+	size   image.Point
+}
+
+// watermarkCache keeps the most recently used variants of the watermarks, scaled to the size
+// of a photo, so workers don't render and recolor an SVG watermark again for every photo of
+// the same size.
+// It is safe for concurrent use and holds at most limit variants.
+type watermarkCache struct {
+	mu      sync.Mutex
+	limit   int
+	entries map[variantKey]*list.Element
+	order   *list.List // of *cachedWatermark, most recently used first
+}
+
+// cachedWatermark is the variant of a watermark for its key
+type cachedWatermark struct {
+	key   variantKey
+	image image.Image
+}
+
+func newWatermarkCache(limit int) *watermarkCache {
+	return &watermarkCache{limit: limit, entries: map[variantKey]*list.Element{}, order: list.New()}
+}
+
+// get returns the variant for key, calling create to make it if it is not cached. Workers
+// missing the same variant at the same time may each create it, one result is kept.
+func (c *watermarkCache) get(key variantKey, create func() image.Image) image.Image {
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		return element.Value.(*cachedWatermark).image
+	}
+	c.mu.Unlock()
+
+	variant := create()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.order.PushFront(&cachedWatermark{key, variant})
+		if c.order.Len() > c.limit {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cachedWatermark).key)
+		}
+	}
+	return variant
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const testSVG = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 200 100">
+<rect x="10" y="10" width="180" height="80" rx="20" fill="#000000"/>
+<circle cx="100" cy="50" r="30" fill="#ff0000"/>
+</svg>`
+
+func loadTestSVG(tb testing.TB, mappings []colorMapping) *svgWatermark {
+	tb.Helper()
+	fname := filepath.Join(tb.TempDir(), "logo.svg")
+	if err := os.WriteFile(fname, []byte(testSVG), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	svg, err := loadSVGWatermark(fname, mappings, 8)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return svg
+}
+
+func TestWatermarkCacheKeys(t *testing.T) {
+	cache := newWatermarkCache(2)
+	sources := map[string]image.Image{"logo": image.NewNRGBA(image.Rect(0, 0, 4, 4)), "badge": image.NewNRGBA(image.Rect(0, 0, 4, 4))}
+	created := 0
+	get := func(size int, source string) image.Image {
+		key := variantKey{source: sources[source], size: image.Point{size, size}}
+		return cache.get(key, func() image.Image {
+			created++
+			return image.NewNRGBA(image.Rect(0, 0, size, size))
+		})
+	}
+
+	tests := []struct {
+		size    int
+		source  string
+		created int
+	}{
+		{10, "logo", 1},
+		{10, "logo", 1},  // cached
+		{10, "badge", 2}, // another watermark of the same size is another variant
+		{10, "logo", 2},  // still cached, and now the most recently used
+		{20, "logo", 3},  // evicts the badge
+		{10, "badge", 4}, // created again, evicting the least recently used
+		{20, "logo", 4},
+		{10, "logo", 5},
+	}
+	for i, test := range tests {
+		img := get(test.size, test.source)
+		if img.Bounds().Dx() != test.size {
+			t.Errorf("step %d: got a variant of size %d, want %d", i, img.Bounds().Dx(), test.size)
+		}
+		if created != test.created {
+			t.Errorf("step %d: created %d variants, want %d", i, created, test.created)
+		}
+	}
+	if cache.order.Len() != 2 || len(cache.entries) != 2 {
+		t.Errorf("cache holds %d entries in order and %d in the map, want 2", cache.order.Len(), len(cache.entries))
+	}
+}
+
+func TestWatermarkCacheConcurrent(t *testing.T) {
+	cache := newWatermarkCache(4)
+	svg := loadTestSVG(t, []colorMapping{{from: color.RGBA{0, 0, 0, 255}, to: color.RGBA{255, 255, 255, 255}}})
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			size := image.Point{40 + 20*(i%6), 20 + 10*(i%6)}
+			key := variantKey{source: svg, size: size}
+			img := cache.get(key, func() image.Image { return scaleWatermark(svg, size, false) })
+			if img.Bounds().Size() != size {
+				t.Errorf("got a variant of size %v, want %v", img.Bounds().Size(), size)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if cache.order.Len() > 4 {
+		t.Errorf("cache holds %d variants, want at most 4", cache.order.Len())
+	}
+}
+
+// BenchmarkWatermarkVariants renders the variant of a recolored SVG watermark for a batch of
+// photos of three sizes, with and without the cache
+func BenchmarkWatermarkVariants(b *testing.B) {
+	svg := loadTestSVG(b, []colorMapping{{from: color.RGBA{0, 0, 0, 255}, to: color.RGBA{255, 255, 255, 255}}})
+	sizes := []image.Point{{800, 400}, {600, 300}, {400, 200}}
+	for _, limit := range []int{0, 16} {
+		name := "uncached"
+		if limit > 0 {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			cache := newWatermarkCache(limit)
+			for i := 0; i < b.N; i++ {
+				size := sizes[i%len(sizes)]
+				if limit == 0 {
+					scaleWatermark(svg, size, false)
+					continue
+				}
+				key := variantKey{source: svg, size: size}
+				cache.get(key, func() image.Image { return scaleWatermark(svg, size, false) })
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path"
+)
+
+// compareDir is the folder in the target directory the -compare images are written to, which
+// mirrors the folders of the outputs
+const compareDir = "compare"
+
+// compareLayouts are the values of the -compare flag: side puts the photo before and after
+// watermarking next to each other, split shows half of each in one image
+var compareLayouts = []string{"side", "split"}
+
+// compareDirections are the values of the -compare-direction flag
+var compareDirections = []string{"horizontal", "vertical"}
+
+// writeComparison writes the -compare image of a photo, with the output of its rendition r
+// after watermarking and the same rendition rendered without the watermark before it
+func (b *batch) writeComparison(ctx context.Context, settings photoSettings, srcImage image.Image, r rendition, after image.Image, relPath string) error {
+	bare := r
+	bare.bare, bare.proof = true, false
+	before, _, err := b.renderRendition(settings, srcImage, bare)
+	if err != nil {
+		return err
+	}
+	relDir, name := b.outputPath(relPath)
+	dir := path.Join(b.params.targetDir, compareDir, relDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create folder: %w", err)
+	}
+	img := compareImage(before, after, b.params.compare, b.params.compareDirection, b.params.compareGap)
+	if _, err := saveImage(ctx, img, dir, name, b.save); err != nil {
+		return fmt.Errorf("failed to write the comparison: %w", err)
+	}
+	return nil
+}
+
+// compareImage lays out two images of the same size for -compare. The side layout puts them
+// next to each other, left and right or top and bottom, with a white gap in between. The split
+// layout has the size of one image, with the first half of before and the second half of after
+// divided by a white line as wide as the gap.
+func compareImage(before, after image.Image, layout, direction string, gap int) *image.RGBA {
+	size := before.Bounds().Size()
+	vertical := direction == "vertical"
+	// The step from the origin of before to that of after
+	step := image.Point{size.X + gap, 0}
+	if vertical {
+		step = image.Point{0, size.Y + gap}
+	}
+
+	if layout == "side" {
+		out := image.NewRGBA(image.Rectangle{Max: size.Add(step)})
+		draw.Draw(out, out.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(out, image.Rectangle{Max: size}, before, before.Bounds().Min, draw.Src)
+		draw.Draw(out, image.Rectangle{Max: size}.Add(step), after, after.Bounds().Min, draw.Src)
+		return out
+	}
+
+	out := image.NewRGBA(image.Rectangle{Max: size})
+	draw.Draw(out, out.Rect, before, before.Bounds().Min, draw.Src)
+	half, divider := image.Rect(size.X/2, 0, size.X, size.Y), image.Rect(size.X/2-gap/2, 0, size.X/2-gap/2+gap, size.Y)
+	if vertical {
+		half, divider = image.Rect(0, size.Y/2, size.X, size.Y), image.Rect(0, size.Y/2-gap/2, size.X, size.Y/2-gap/2+gap)
+	}
+	draw.Draw(out, half, after, after.Bounds().Min.Add(half.Min), draw.Src)
+	draw.Draw(out, divider.Intersect(out.Rect), image.NewUniform(color.White), image.Point{}, draw.Src)
+	return out
+}
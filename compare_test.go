@@ -0,0 +1,89 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareImage(t *testing.T) {
+	red, blue, white := color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}
+	// before is cut out of a larger photo, so it doesn't start at the origin
+	before := subImage(solidPhoto(60, 50, red), image.Rect(10, 10, 50, 40))
+	after := solidPhoto(40, 30, blue)
+	type pixel struct {
+		x, y int
+		want color.RGBA
+	}
+	tests := []struct {
+		name      string
+		layout    string
+		direction string
+		gap       int
+		size      image.Point
+		pixels    []pixel
+	}{
+		{"side horizontal", "side", "horizontal", 4, image.Pt(84, 30), []pixel{{0, 0, red}, {39, 29, red}, {40, 10, white}, {43, 10, white}, {44, 0, blue}, {83, 29, blue}}},
+		{"side vertical", "side", "vertical", 4, image.Pt(40, 64), []pixel{{0, 0, red}, {39, 29, red}, {10, 30, white}, {10, 33, white}, {0, 34, blue}, {39, 63, blue}}},
+		{"side without gap", "side", "horizontal", 0, image.Pt(80, 30), []pixel{{39, 10, red}, {40, 10, blue}}},
+		{"split horizontal", "split", "horizontal", 4, image.Pt(40, 30), []pixel{{0, 0, red}, {17, 29, red}, {18, 10, white}, {21, 10, white}, {22, 0, blue}, {39, 29, blue}}},
+		{"split vertical", "split", "vertical", 4, image.Pt(40, 30), []pixel{{0, 0, red}, {39, 12, red}, {10, 13, white}, {10, 16, white}, {0, 17, blue}, {39, 29, blue}}},
+		{"split without divider", "split", "horizontal", 0, image.Pt(40, 30), []pixel{{19, 10, red}, {20, 10, blue}}},
+		{"split with a wide divider", "split", "horizontal", 100, image.Pt(40, 30), []pixel{{0, 10, white}, {39, 10, white}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := compareImage(before, after, test.layout, test.direction, test.gap)
+			if img.Rect.Size() != test.size {
+				t.Fatalf("Got size %v, want %v", img.Rect.Size(), test.size)
+			}
+			for _, p := range test.pixels {
+				if got := img.RGBAAt(p.x, p.y); got != p.want {
+					t.Errorf("Got %v at %d,%d, want %v", got, p.x, p.y, p.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareRun(t *testing.T) {
+	dir := t.TempDir()
+	newTestSource(t, dir)
+	tests := []struct {
+		name string
+		args []string
+		want image.Point // the size of the comparison of the 320x240 a.jpg
+	}{
+		{"side", []string{"-compare", "side"}, image.Pt(2*320+16, 240)},
+		{"side vertical", []string{"-compare", "side", "-compare-direction", "vertical", "-compare-gap", "10"}, image.Pt(320, 2*240+10)},
+		{"split", []string{"-compare", "split"}, image.Pt(320, 240)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "target")
+			args := append([]string{"-source", "photos", "-target", target}, test.args...)
+			if code, out := runTool(t, dir, nil, args...); code != exitSuccess {
+				t.Fatalf("The run exited with %d:\n%s", code, out)
+			}
+			f, err := os.Open(filepath.Join(target, compareDir, "a.jpg"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			config, err := jpeg.DecodeConfig(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := image.Pt(config.Width, config.Height); got != test.want {
+				t.Errorf("Got a comparison of %v, want %v", got, test.want)
+			}
+			// The outputs themselves are written as without -compare
+			if _, err := os.Stat(filepath.Join(target, "a.jpg")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// blendModes lists the supported values for the -blend flag
+var blendModes = []string{"normal", "multiply", "screen"}
+
+// channelModes lists the supported values for the -channels flag: the watermark composites
+// into all color channels, into only the red, green or blue one, or into the luminance alone
+var channelModes = []string{"rgb", "r", "g", "b", "luma"}
+
+// opacityPixelModes are the pixels of the watermark that -opacity-pixels applies the opacity to
+var opacityPixelModes = []string{"all", "opaque", "translucent"}
+
+// opacityMask returns the mask that sets the opacity of the watermark. The opacity multiplies
+// the alpha of the watermark's own pixels. With mode "all" it applies to every pixel, with
+// "opaque" only to the fully opaque pixels, so the soft edges and shadows of a logo keep their
+// own alpha, and with "translucent" only to the others, so a solid outline stays fully opaque.
+func opacityMask(watermark image.Image, opacity int, mode string) image.Image {
+	alpha := opacityAlpha(opacity)
+	if mode == "all" {
+		return image.NewUniform(color.Alpha{alpha})
+	}
+	bounds := watermark.Bounds()
+	mask := image.NewAlpha(image.Rectangle{Max: bounds.Size()})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			_, _, _, a := watermark.At(x, y).RGBA()
+			if (a == 0xffff) == (mode == "opaque") {
+				mask.Pix[mask.PixOffset(x-bounds.Min.X, y-bounds.Min.Y)] = alpha
+			} else {
+				mask.Pix[mask.PixOffset(x-bounds.Min.X, y-bounds.Min.Y)] = 0xff
+			}
+		}
+	}
+	return mask
+}
+
+// drawWatermark composites the watermark onto the canvas within rectangle r, using the
+// alpha of mask to set the opacity of the watermark. The normal blend mode uses the
+// standard library's Porter-Duff 'over' operator, other modes blend every pixel by hand.
+//
+// The canvas holds premultiplied colors, while PNG watermarks are decoded with straight alpha
+// as an *image.NRGBA. Both paths read the watermark through RGBA, which premultiplies it once
+// at 16 bits, and never convert it to an 8-bit *image.RGBA first, which would round the color
+// of faint edge pixels away. The watermark is scaled with straight alpha kept intact as well,
+// see scaleWatermark. SVG watermarks, text and bars are drawn premultiplied as *image.RGBA,
+// and are composited as they are, without converting them to straight alpha and back.
+//
+// With linear the colors are blended in linear light instead of on the sRGB tone curve, which
+// keeps the soft edges of a watermark from darkening the photo around it. Channels limits the
+// color channels the watermark changes to one of the channelModes: with a single channel the
+// others keep the canvas, with luma the canvas keeps its colors and only takes the change in
+// luminance the watermark makes.
+func drawWatermark(canvas draw.RGBA64Image, r image.Rectangle, watermark image.Image, mask image.Image, blend string, linear bool, channels string) {
+	if blend == "normal" && !linear && channels == "rgb" {
+		draw.DrawMask(canvas, r, watermark, watermark.Bounds().Min, mask, image.Point{0, 0}, draw.Over)
+		return
+	}
+
+	blendFunc := func(b, s float64) float64 { return s }
+	switch blend {
+	case "multiply":
+		blendFunc = func(b, s float64) float64 { return b * s }
+	case "screen":
+		blendFunc = func(b, s float64) float64 { return b + s - b*s }
+	}
+
+	origin := r.Min
+	wmOrigin := watermark.Bounds().Min.Sub(origin)
+	r = r.Intersect(canvas.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			_, _, _, ma := mask.At(x-origin.X, y-origin.Y).RGBA()
+			sr, sg, sb, sa := watermark.At(x+wmOrigin.X, y+wmOrigin.Y).RGBA()
+			if sa == 0 || ma == 0 {
+				continue
+			}
+			dst := canvas.RGBA64At(x, y)
+
+			// Effective source alpha, and unpremultiplied source/backdrop colors
+			as := float64(sa) / 0xffff * float64(ma) / 0xffff
+			ab := float64(dst.A) / 0xffff
+			cs := [3]float64{float64(sr) / float64(sa), float64(sg) / float64(sa), float64(sb) / float64(sa)}
+			cb := [3]float64{}
+			if dst.A > 0 {
+				cb = [3]float64{float64(dst.R) / float64(dst.A), float64(dst.G) / float64(dst.A), float64(dst.B) / float64(dst.A)}
+			}
+			if linear {
+				for i := range cs {
+					cs[i], cb[i] = srgbDecode(cs[i]), srgbDecode(cb[i])
+				}
+			}
+
+			// W3C compositing: blend where source and backdrop overlap, then source-over
+			var out [3]float64
+			for i := range out {
+				out[i] = as*(1-ab)*cs[i] + as*ab*blendFunc(cb[i], cs[i]) + (1-as)*ab*cb[i]
+			}
+			ao := as + ab*(1-as)
+			switch channels {
+			case "r", "g", "b":
+				for i := range out {
+					if i != strings.Index("rgb", channels) {
+						out[i] = cb[i] * ao
+					}
+				}
+			case "luma":
+				if ao > 0 {
+					shift := (0.2126*out[0]+0.7152*out[1]+0.0722*out[2])/ao - (0.2126*cb[0] + 0.7152*cb[1] + 0.0722*cb[2])
+					for i := range out {
+						out[i] = clampFloat(cb[i]+shift, 0, 1) * ao
+					}
+				}
+			}
+			if linear && ao > 0 {
+				for i := range out {
+					out[i] = srgbEncode(out[i]/ao) * ao
+				}
+			}
+			canvas.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(out[0]*0xffff + 0.5),
+				G: uint16(out[1]*0xffff + 0.5),
+				B: uint16(out[2]*0xffff + 0.5),
+				A: uint16(ao*0xffff + 0.5),
+			})
+		}
+	}
+}
+
+// addBorder returns a copy of img on a larger canvas of the same bit depth, framed with a solid
+// border of the given width
+func addBorder(img draw.RGBA64Image, width int, c color.Color) draw.RGBA64Image {
+	size := img.Bounds().Size()
+	var framed draw.RGBA64Image = image.NewRGBA(image.Rect(0, 0, size.X+2*width, size.Y+2*width))
+	if _, ok := img.(*image.RGBA64); ok {
+		framed = image.NewRGBA64(framed.Bounds())
+	}
+	draw.Draw(framed, framed.Bounds(), image.NewUniform(c), image.Point{0, 0}, draw.Src)
+	draw.Draw(framed, image.Rectangle{Max: size}.Add(image.Point{width, width}), img, img.Bounds().Min, draw.Src)
+	return framed
+}
+
+// adaptiveModes lists the supported values for the -adaptive-opacity flag
+var adaptiveModes = []string{"off", "bright", "dark"}
+
+// adaptiveOpacity maps the mean luminance (0-255) under the watermark to an opacity between
+// min and max. In bright mode the watermark is more opaque on bright areas, in dark mode it is
+// more opaque on dark areas.
+func adaptiveOpacity(luminance float64, mode string, min, max int) int {
+	t := luminance / 255
+	if mode == "dark" {
+		t = 1 - t
+	}
+	return min + int(math.Round(t*float64(max-min)))
+}
+
+// watermarkOpacity returns the opacity for -auto-opacity-from-watermark: the mean alpha of the
+// pixels of the watermark that are not fully transparent, as a percentage. It returns -1 for
+// a watermark without any visible pixels.
+func watermarkOpacity(watermark image.Image) int {
+	nrgba := toNRGBA(watermark)
+	var sum, count int
+	for i := 3; i < len(nrgba.Pix); i += 4 {
+		if a := int(nrgba.Pix[i]); a > 0 {
+			sum += a
+			count++
+		}
+	}
+	if count == 0 {
+		return -1
+	}
+	return int(math.Round(float64(sum) / float64(count) * 100 / 255))
+}
+
+// rampOpacity returns the opacity of the photo at index among total photos, going evenly from
+// start on the first photo to end on the last one
+func rampOpacity(index, total, start, end int) int {
+	if total <= 1 {
+		return start
+	}
+	return start + int(math.Round(float64(index)*float64(end-start)/float64(total-1)))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestDrawWatermarkEdges composites single semi-transparent watermark pixels, like those on
+// the soft edges of a logo, and compares them to reference values worked out with the W3C
+// compositing formulas. The straight alpha watermark must be premultiplied exactly once.
+func TestDrawWatermarkEdges(t *testing.T) {
+	tests := []struct {
+		name      string
+		watermark color.NRGBA
+		opacity   uint8
+		canvas    color.RGBA
+		blend     string
+		linear    bool
+		channels  string
+		want      color.RGBA
+	}{
+		{"half white over black", color.NRGBA{0xff, 0xff, 0xff, 128}, 0xff, color.RGBA{0, 0, 0, 0xff}, "normal", false, "rgb", color.RGBA{128, 128, 128, 0xff}},
+		{"red edge with opacity", color.NRGBA{0xff, 0, 0, 64}, 179, color.RGBA{100, 100, 100, 0xff}, "normal", false, "rgb", color.RGBA{127, 82, 82, 0xff}},
+		{"faint colored edge", color.NRGBA{200, 100, 50, 8}, 0xff, color.RGBA{0, 0, 0, 0xff}, "normal", false, "rgb", color.RGBA{6, 3, 2, 0xff}},
+		{"transparent pixel", color.NRGBA{0xff, 0xff, 0xff, 0}, 0xff, color.RGBA{100, 100, 100, 0xff}, "normal", false, "rgb", color.RGBA{100, 100, 100, 0xff}},
+		{"multiply", color.NRGBA{0xff, 128, 0, 128}, 0xff, color.RGBA{200, 200, 200, 0xff}, "multiply", false, "rgb", color.RGBA{200, 150, 100, 0xff}},
+		{"linear half white over black", color.NRGBA{0xff, 0xff, 0xff, 128}, 0xff, color.RGBA{0, 0, 0, 0xff}, "normal", true, "rgb", color.RGBA{188, 188, 188, 0xff}},
+		{"linear half white over gray", color.NRGBA{0xff, 0xff, 0xff, 128}, 0xff, color.RGBA{100, 100, 100, 0xff}, "normal", true, "rgb", color.RGBA{198, 198, 198, 0xff}},
+		{"linear faint edge", color.NRGBA{0xff, 0xff, 0xff, 8}, 0xff, color.RGBA{0, 0, 0, 0xff}, "normal", true, "rgb", color.RGBA{50, 50, 50, 0xff}},
+		{"linear multiply", color.NRGBA{0xff, 128, 0, 128}, 0xff, color.RGBA{200, 200, 200, 0xff}, "multiply", true, "rgb", color.RGBA{200, 160, 146, 0xff}},
+		{"red channel only", color.NRGBA{0xff, 0, 0, 64}, 179, color.RGBA{100, 100, 100, 0xff}, "normal", false, "r", color.RGBA{127, 100, 100, 0xff}},
+		{"luminance only", color.NRGBA{0xff, 0, 0, 128}, 0xff, color.RGBA{100, 100, 100, 0xff}, "normal", false, "luma", color.RGBA{77, 77, 77, 0xff}},
+		{"green channel only", color.NRGBA{0, 0xff, 0, 128}, 0xff, color.RGBA{100, 100, 100, 0xff}, "normal", false, "g", color.RGBA{100, 178, 100, 0xff}},
+		{"luminance of white", color.NRGBA{0xff, 0xff, 0xff, 128}, 0xff, color.RGBA{200, 100, 50, 0xff}, "normal", false, "luma", color.RGBA{255, 169, 119, 0xff}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			canvas := image.NewRGBA(image.Rect(0, 0, 1, 1))
+			canvas.SetRGBA(0, 0, test.canvas)
+			watermark := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+			watermark.SetNRGBA(0, 0, test.watermark)
+			mask := image.NewUniform(color.Alpha{test.opacity})
+			drawWatermark(canvas, canvas.Rect, watermark, mask, test.blend, test.linear, test.channels)
+			if got := canvas.RGBAAt(0, 0); !nearColor(got, test.want, 1) {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// nearColor reports whether every channel of a and b differs by at most tolerance, for the
+// rounding of the different compositing paths
+func nearColor(a, b color.RGBA, tolerance int) bool {
+	near := func(x, y uint8) bool { return int(x)-int(y) <= tolerance && int(y)-int(x) <= tolerance }
+	return near(a.R, b.R) && near(a.G, b.G) && near(a.B, b.B) && near(a.A, b.A)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// console prints all messages of a run. It is safe for concurrent use, so messages from
+// different workers never interleave mid-line.
+var console = &consoleLog{}
+
+// consoleLog writes messages to stdout and, with -logfile, also to a log file where every
+// line is prefixed with a timestamp. With -log-json every warning, error and skipped photo is
+// also written to stderr as a line of JSON. While the workers run, between start and stop,
+// messages are written by a single goroutine in the order they were sent, so workers don't
+// wait for the terminal or the disk. Only when that falls behind by more messages than fit
+// in the channel does a worker wait for room, without holding up the others that are sending.
+type consoleLog struct {
+	mu       sync.RWMutex // held for reading while sending to messages, and for writing otherwise
+	file     *os.File
+	midLine  bool // the last write to the file did not end with a newline
+	stderr   bool // write to stderr instead of stdout, which is used for the image in stream mode
+	json     bool // write events to stderr as JSON lines
+	messages chan logMessage
+	stopped  chan struct{}
+}
+
+// logMessage is a message sent to the goroutine of the console
+type logMessage struct {
+	text   string
+	photo  string // path of the photo the message is about, which tags its lines in the log file
+	screen bool   // write to the terminal
+	log    bool   // write to the log file
+	skip   bool   // the message is about a skipped photo
+}
+
+// logEvent is a line of -log-json
+type logEvent struct {
+	File      string `json:"file"`
+	Level     string `json:"level"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+}
+
+// start makes a goroutine write all messages until stop is called
+func (c *consoleLog) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	messages, stopped := make(chan logMessage, 256), make(chan struct{})
+	c.messages, c.stopped = messages, stopped
+	go func() {
+		defer close(stopped)
+		for m := range messages {
+			c.output(m)
+		}
+	}()
+}
+
+// stop writes the messages sent so far and ends the goroutine of start, after which messages
+// are written right away again
+func (c *consoleLog) stop() {
+	c.mu.Lock()
+	if c.messages == nil {
+		c.mu.Unlock()
+		return
+	}
+	close(c.messages)
+	c.messages = nil
+	stopped := c.stopped
+	c.mu.Unlock()
+	<-stopped
+}
+
+// openFile starts copying all messages to the file at fname, appending to it or replacing it.
+// The file starts with the values of all flags, so the settings of a batch can be reconstructed.
+func (c *consoleLog) openFile(fname string, appendFile bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendFile {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(fname, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.file = file
+	c.writeFile(fmt.Sprintf("WaterMarker run started with parameters: %v\n", os.Args[1:]), "")
+	flag.VisitAll(func(f *flag.Flag) {
+		c.writeFile(fmt.Sprintf("  -%s=%s\n", f.Name, f.Value.String()), "")
+	})
+	return nil
+}
+
+func (c *consoleLog) Close() error {
+	c.stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+func (c *consoleLog) Printf(format string, args ...interface{}) {
+	c.write(fmt.Sprintf(format, args...))
+}
+
+func (c *consoleLog) Println(args ...interface{}) {
+	c.write(fmt.Sprintln(args...))
+}
+
+func (c *consoleLog) Print(args ...interface{}) {
+	c.write(fmt.Sprint(args...))
+}
+
+// Logf writes a message to the log file only, for details that would flood the terminal
+func (c *consoleLog) Logf(format string, args ...interface{}) {
+	c.send(logMessage{text: fmt.Sprintf(format, args...), log: true})
+}
+
+// Photof writes a message about the photo relPath, whose lines are tagged with its path in
+// the log file
+func (c *consoleLog) Photof(relPath string, format string, args ...interface{}) {
+	c.send(logMessage{text: fmt.Sprintf(format, args...), photo: relPath, screen: true, log: true})
+}
+
+// PhotoLogf writes a message about the photo relPath to the log file only, like Photof
+func (c *consoleLog) PhotoLogf(relPath string, format string, args ...interface{}) {
+	c.send(logMessage{text: fmt.Sprintf(format, args...), photo: relPath, log: true})
+}
+
+// Skipf writes the message that the photo relPath is skipped, like Photof, or to the log file
+// only when quiet
+func (c *consoleLog) Skipf(relPath string, quiet bool, format string, args ...interface{}) {
+	c.send(logMessage{text: fmt.Sprintf(format, args...), photo: relPath, screen: !quiet, log: true, skip: true})
+}
+
+func (c *consoleLog) write(message string) {
+	c.send(logMessage{text: message, screen: true, log: true})
+}
+
+// Screen writes a message to the terminal only, for output such as the -interactive preview
+// that has no place in the log file
+func (c *consoleLog) Screen(message string) {
+	c.send(logMessage{text: message, screen: true})
+}
+
+// send passes a message to the goroutine of start, or writes it right away when it isn't running.
+// Senders share the read lock, which keeps stop from closing the channel while they wait for
+// room in it.
+func (c *consoleLog) send(m logMessage) {
+	c.mu.RLock()
+	if c.messages != nil {
+		c.messages <- m
+		c.mu.RUnlock()
+		return
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// start may have been called meanwhile
+	if c.messages != nil {
+		c.messages <- m
+		return
+	}
+	c.output(m)
+}
+
+// output writes a message, called with the lock held or by the goroutine of start
+func (c *consoleLog) output(m logMessage) {
+	if m.screen && c.stderr {
+		os.Stderr.WriteString(m.text)
+	} else if m.screen {
+		os.Stdout.WriteString(m.text)
+	}
+	if m.log && c.file != nil {
+		c.writeFile(m.text, m.photo)
+	}
+	if m.log && c.json {
+		c.writeEvent(m)
+	}
+}
+
+// writeEvent writes a warning, error or skipped photo to stderr as a line of JSON. The level of
+// other messages is taken from their WARNING: or ERROR: prefix, messages without one are not
+// events.
+func (c *consoleLog) writeEvent(m logMessage) {
+	text := strings.TrimSpace(m.text)
+	event := logEvent{File: m.photo, Message: text, Timestamp: time.Now().Format(time.RFC3339Nano)}
+	if m.skip {
+		event.Level = "skip"
+	} else if strings.HasPrefix(text, "WARNING: ") {
+		event.Level, event.Message = "warning", strings.TrimPrefix(text, "WARNING: ")
+	} else if strings.HasPrefix(text, "ERROR: ") {
+		event.Level, event.Message = "error", strings.TrimPrefix(text, "ERROR: ")
+	} else {
+		return
+	}
+	line, _ := json.Marshal(event)
+	os.Stderr.Write(append(line, '\n'))
+}
+
+// writeFile writes message to the log file, starting every line with a timestamp and, for a
+// message about a photo, its path
+func (c *consoleLog) writeFile(message string, photo string) {
+	stamp := time.Now().Format("2006-01-02 15:04:05.000 ")
+	if photo != "" {
+		stamp += "[" + photo + "] "
+	}
+	buf := make([]byte, 0, len(message)+len(stamp))
+	for i := 0; i < len(message); i++ {
+		if !c.midLine {
+			buf = append(buf, stamp...)
+			c.midLine = true
+		}
+		buf = append(buf, message[i])
+		if message[i] == '\n' {
+			c.midLine = false
+		}
+	}
+	c.file.Write(buf)
+}
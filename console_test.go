@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConsoleConcurrentLines logs messages of two lines from many workers at once, and checks
+// that the terminal and the log file get every line whole, in the order each worker sent them,
+// tagged with the photo of the worker in the log file
+func TestConsoleConcurrentLines(t *testing.T) {
+	dir := t.TempDir()
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	saved := os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = saved }()
+
+	c := &consoleLog{}
+	if err := c.openFile(filepath.Join(dir, "run.log"), false); err != nil {
+		t.Fatal(err)
+	}
+	const workers, messages = 16, 200
+	padding := strings.Repeat("x", 100)
+	c.start()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			photo := fmt.Sprintf("photo%d.jpg", w)
+			for m := 0; m < messages; m++ {
+				c.Photof(photo, "worker %d message %d %s\nworker %d message %d continued\n", w, m, padding, w, m)
+			}
+		}(w)
+	}
+	wg.Wait()
+	c.Close()
+	os.Stdout = saved
+
+	screen, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged, err := os.ReadFile(filepath.Join(dir, "run.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := regexp.MustCompile(`^worker (\d+) message (\d+) (` + padding + `|continued)$`)
+	tagged := regexp.MustCompile(`^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\.\d{3} (?:\[photo(\d+)\.jpg\] )?(.*)$`)
+	tests := []struct {
+		name    string
+		content []byte
+		stamped bool
+	}{
+		{"terminal", screen, false},
+		{"log file", logged, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := make([]int, workers) // line of every worker expected next, two per message
+			for _, text := range strings.Split(strings.TrimSuffix(string(test.content), "\n"), "\n") {
+				if test.stamped {
+					match := tagged.FindStringSubmatch(text)
+					if match == nil {
+						t.Fatalf("Line without timestamp: %q", text)
+					}
+					if match[1] == "" && (strings.HasPrefix(match[2], "WaterMarker run started") || strings.HasPrefix(match[2], "  -")) {
+						continue // the flags of the run at the start of the log
+					}
+					parsed := line.FindStringSubmatch(match[2])
+					if parsed == nil || parsed[1] != match[1] {
+						t.Fatalf("Line tagged with another photo: %q", text)
+					}
+					text = match[2]
+				}
+				match := line.FindStringSubmatch(text)
+				if match == nil {
+					t.Fatalf("Broken line: %q", text)
+				}
+				w, _ := strconv.Atoi(match[1])
+				m, _ := strconv.Atoi(match[2])
+				if m != next[w]/2 || (match[3] == "continued") != (next[w]%2 == 1) {
+					t.Fatalf("Line out of order: %q", text)
+				}
+				next[w]++
+			}
+			for w, n := range next {
+				if n != 2*messages {
+					t.Errorf("Got %d lines of worker %d, want %d", n, w, 2*messages)
+				}
+			}
+		})
+	}
+}
+
+// TestConsoleSlowTerminal logs more messages than the console can buffer to a terminal that
+// falls behind, so the workers wait for room in the channel, and checks none get lost
+func TestConsoleSlowTerminal(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+
+	c := &consoleLog{}
+	c.start()
+	const workers, messages = 8, 200
+	padding := strings.Repeat("x", 200)
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for m := 0; m < messages; m++ {
+				c.Printf("worker %d message %d %s\n", n, m, padding)
+			}
+		}(n)
+	}
+	// Nothing reads the terminal until more has been sent than the pipe and the channel hold
+	time.Sleep(100 * time.Millisecond)
+	lines := make(chan int)
+	go func() {
+		count := 0
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			count++
+		}
+		lines <- count
+	}()
+	wg.Wait()
+	c.stop()
+	os.Stdout = saved
+	w.Close()
+	if got := <-lines; got != workers*messages {
+		t.Errorf("Got %d lines, want %d", got, workers*messages)
+	}
+}
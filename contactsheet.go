@@ -0,0 +1,75 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+	"sync"
+
+	"github.com/nfnt/resize"
+)
+
+// contactSheetName is the file name of the contact sheet in the target directory
+const contactSheetName = "contact-sheet.jpg"
+
+// contactSheet collects watermarked thumbnails during a run and lays them out on a grid
+// for proofing. It is safe for concurrent use.
+type contactSheet struct {
+	mu        sync.Mutex
+	columns   int
+	thumbSize int
+	thumbs    map[string]image.Image
+}
+
+func newContactSheet(columns, thumbSize int) *contactSheet {
+	return &contactSheet{columns: columns, thumbSize: thumbSize, thumbs: map[string]image.Image{}}
+}
+
+// add stores a thumbnail of a watermarked photo, labelled with its file name
+func (c *contactSheet) add(name string, img image.Image) {
+	thumb := resize.Thumbnail(uint(c.thumbSize), uint(c.thumbSize), img, resize.Bilinear)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.thumbs[name] = thumb
+}
+
+// render lays out the thumbnails in name order on a white sheet, with the name below each thumbnail
+func (c *contactSheet) render() *image.RGBA {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.thumbs))
+	for name := range c.thumbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	gap := c.thumbSize / 10
+	labelHeight := c.thumbSize / 12
+	if labelHeight < 10 {
+		labelHeight = 10
+	}
+	cellW, cellH := c.thumbSize+gap, c.thumbSize+labelHeight+gap
+	columns := clampInt(len(names), 1, c.columns)
+	rows := (len(names) + columns - 1) / columns
+
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*cellW+gap, rows*cellH+gap))
+	draw.Draw(sheet, sheet.Rect, image.NewUniform(color.White), image.Point{0, 0}, draw.Src)
+	for i, name := range names {
+		cell := image.Point{gap + (i%columns)*cellW, gap + (i/columns)*cellH}
+
+		// Center the thumbnail in its square, and the label below it
+		thumb := c.thumbs[name]
+		pos := cell.Add(image.Point{c.thumbSize, c.thumbSize}.Sub(thumb.Bounds().Size()).Div(2))
+		draw.Draw(sheet, thumb.Bounds().Sub(thumb.Bounds().Min).Add(pos), thumb, thumb.Bounds().Min, draw.Src)
+
+		label := renderText(name, labelHeight*8/10, color.Black)
+		if label.Bounds().Dx() > c.thumbSize {
+			label = resize.Resize(uint(c.thumbSize), 0, label, resize.Bilinear)
+		}
+		pos = cell.Add(image.Point{(c.thumbSize - label.Bounds().Dx()) / 2, c.thumbSize + labelHeight/10})
+		draw.Draw(sheet, label.Bounds().Add(pos), label, image.Point{0, 0}, draw.Over)
+	}
+	return sheet
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"testing"
+)
+
+// solidPhoto returns a photo of a single color
+func solidPhoto(w, h int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestContactSheetLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		photos  int
+		columns int
+		size    image.Point
+	}{
+		// Thumbnails of 100 pixels take cells of 110 by 120 pixels, with a gap of 10 around them
+		{"full rows", 6, 3, image.Point{340, 250}},
+		{"last row partly filled", 7, 3, image.Point{340, 370}},
+		{"fewer photos than columns", 2, 5, image.Point{230, 130}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sheet := newContactSheet(test.columns, 100)
+			colors := make([]color.RGBA, test.photos)
+			// The photos are added from several workers in reverse order of their names
+			var wg sync.WaitGroup
+			for i := test.photos - 1; i >= 0; i-- {
+				colors[i] = color.RGBA{uint8(30 * i), uint8(255 - 30*i), 0x80, 0xff}
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					sheet.add(fmt.Sprintf("photo%02d.jpg", i), solidPhoto(200, 200, colors[i]))
+				}(i)
+			}
+			wg.Wait()
+
+			img := sheet.render()
+			if img.Rect.Size() != test.size {
+				t.Errorf("Got size %v, want %v", img.Rect.Size(), test.size)
+			}
+			for i, want := range colors {
+				center := image.Point{10 + (i%test.columns)*110 + 50, 10 + (i/test.columns)*120 + 50}
+				if got := img.RGBAAt(center.X, center.Y); !nearColor(got, want, 1) {
+					t.Errorf("Thumbnail %d has color %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestContactSheetReplaces(t *testing.T) {
+	sheet := newContactSheet(5, 100)
+	sheet.add("a.jpg", solidPhoto(100, 100, color.RGBA{0xff, 0, 0, 0xff}))
+	sheet.add("a.jpg", solidPhoto(100, 100, color.RGBA{0, 0, 0xff, 0xff}))
+	img := sheet.render()
+	if img.Rect.Size() != (image.Point{120, 130}) {
+		t.Errorf("Got size %v, want a single thumbnail", img.Rect.Size())
+	}
+	if got := img.RGBAAt(60, 60); got != (color.RGBA{0, 0, 0xff, 0xff}) {
+		t.Errorf("Got color %v, want the photo added last", got)
+	}
+}
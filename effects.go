@@ -0,0 +1,421 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// toRGBA returns img as an *image.RGBA with its origin at (0, 0), copying it if needed
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rectangle{Max: img.Bounds().Size()})
+	draw.Draw(rgba, rgba.Rect, img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// toRGBA64 returns img as an *image.RGBA64 with its origin at (0, 0), copying it if needed
+func toRGBA64(img image.Image) *image.RGBA64 {
+	if rgba, ok := img.(*image.RGBA64); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	rgba := image.NewRGBA64(image.Rectangle{Max: img.Bounds().Size()})
+	draw.Draw(rgba, rgba.Rect, img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// isDeepColor reports whether img has 16 bits per channel
+func isDeepColor(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// gaussianKernel returns normalised weights for a Gaussian with the given standard deviation,
+// covering three standard deviations on either side of the center
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// blurRect applies a separable Gaussian blur to the pixels of img inside r, in place.
+// Pixels outside r are used as input near its edges but are not changed.
+func blurRect(img *image.RGBA, r image.Rectangle, sigma float64) {
+	r = r.Intersect(img.Rect)
+	if r.Empty() || sigma <= 0 {
+		return
+	}
+	kernel := gaussianKernel(sigma)
+	radius := len(kernel) / 2
+	bounds := img.Rect
+
+	// Horizontal pass into a float buffer covering r plus the rows needed by the vertical pass
+	rows := image.Rect(r.Min.X, r.Min.Y-radius, r.Max.X, r.Max.Y+radius).Intersect(bounds)
+	w := rows.Dx()
+	tmp := make([]float64, w*rows.Dy()*4)
+	for y := rows.Min.Y; y < rows.Max.Y; y++ {
+		for x := rows.Min.X; x < rows.Max.X; x++ {
+			var acc [4]float64
+			for k, weight := range kernel {
+				sx := clampInt(x+k-radius, bounds.Min.X, bounds.Max.X-1)
+				i := img.PixOffset(sx, y)
+				for c := 0; c < 4; c++ {
+					acc[c] += weight * float64(img.Pix[i+c])
+				}
+			}
+			copy(tmp[((y-rows.Min.Y)*w+x-rows.Min.X)*4:], acc[:])
+		}
+	}
+
+	// Vertical pass back into the image
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			var acc [4]float64
+			for k, weight := range kernel {
+				sy := clampInt(y+k-radius, rows.Min.Y, rows.Max.Y-1)
+				i := ((sy-rows.Min.Y)*w + x - rows.Min.X) * 4
+				for c := 0; c < 4; c++ {
+					acc[c] += weight * tmp[i+c]
+				}
+			}
+			i := img.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				img.Pix[i+c] = uint8(clampFloat(acc[c]+0.5, 0, 255))
+			}
+		}
+	}
+}
+
+// blurBackdrop blurs the part r of the canvas for -backdrop-blur, before a watermark is drawn
+// over it. A canvas with 16 bits per channel is blurred at 8 bits, as blurRect works on an
+// *image.RGBA, the precision lost is blurred away anyway.
+func blurBackdrop(canvas draw.RGBA64Image, r image.Rectangle, sigma float64) {
+	if rgba, ok := canvas.(*image.RGBA); ok {
+		blurRect(rgba, r, sigma)
+		return
+	}
+	// The pixels around r are copied too, as blurRect reads them near its edges
+	area := r.Inset(-int(math.Ceil(3 * sigma))).Intersect(canvas.Bounds())
+	region := image.NewRGBA(area)
+	draw.Draw(region, area, canvas, area.Min, draw.Src)
+	blurRect(region, r, sigma)
+	r = r.Intersect(area)
+	draw.Draw(canvas, r, region, r.Min, draw.Src)
+}
+
+// backdropPanel returns the panel of -backdrop-color for a backdrop of the given size: a
+// rectangle in the color with fully rounded ends, like a pill
+func backdropPanel(size image.Point, c color.RGBA) *image.RGBA {
+	panel := image.NewRGBA(image.Rectangle{Max: size})
+	draw.Draw(panel, panel.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+	cutShape(panel, "rounded", 50)
+	return panel
+}
+
+// backdropRect returns the part of the canvas behind a watermark at r for -backdrop-blur and
+// -backdrop-color: r with padding, a fraction of the height of the watermark, on every side
+func backdropRect(r image.Rectangle, padding float64) image.Rectangle {
+	return r.Inset(-int(math.Round(padding * float64(r.Dy()))))
+}
+
+// sharpen applies an unsharp mask: the difference between the photo and a blurred copy
+// of it, multiplied by amount, is added to the photo to increase the contrast of its edges
+func sharpen(photo image.Image, amount, radius float64) *image.RGBA {
+	src := toRGBA(photo)
+	blurred := image.NewRGBA(src.Rect)
+	copy(blurred.Pix, src.Pix)
+	blurRect(blurred, blurred.Rect, radius)
+
+	out := image.NewRGBA(src.Rect)
+	for i := 0; i < len(src.Pix); i += 4 {
+		alpha := float64(src.Pix[i+3])
+		for c := 0; c < 3; c++ {
+			v := float64(src.Pix[i+c])
+			v += amount * (v - float64(blurred.Pix[i+c]))
+			// Keep the premultiplied color within the alpha of the pixel
+			out.Pix[i+c] = uint8(clampFloat(v+0.5, 0, alpha))
+		}
+		out.Pix[i+3] = src.Pix[i+3]
+	}
+	return out
+}
+
+// vignette darkens the photo towards its corners. The darkening starts at radius, a fraction
+// of the distance from the center to the corners, and grows smoothly to strength at the corners.
+// Photos with 16 bits per channel are returned as an *image.RGBA64, all others as an *image.RGBA.
+func vignette(photo image.Image, strength, radius float64) image.Image {
+	var out draw.RGBA64Image
+	if isDeepColor(photo) {
+		out = image.NewRGBA64(image.Rectangle{Max: photo.Bounds().Size()})
+	} else {
+		out = image.NewRGBA(image.Rectangle{Max: photo.Bounds().Size()})
+	}
+	draw.Draw(out, out.Bounds(), photo, photo.Bounds().Min, draw.Src)
+	b := out.Bounds()
+	cx, cy := float64(b.Min.X+b.Max.X)/2, float64(b.Min.Y+b.Max.Y)/2
+	corner := math.Hypot(float64(b.Dx())/2, float64(b.Dy())/2)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) / corner
+			t := clampFloat((d-radius)/(1-radius), 0, 1)
+			factor := 1 - strength*t*t*(3-2*t)
+			// Scaling the premultiplied color keeps it within the alpha of the pixel
+			if rgba, ok := out.(*image.RGBA); ok {
+				px := rgba.Pix[rgba.PixOffset(x, y):]
+				for c := 0; c < 3; c++ {
+					px[c] = uint8(float64(px[c])*factor + 0.5)
+				}
+				continue
+			}
+			px := out.RGBA64At(x, y)
+			px.R = uint16(float64(px.R)*factor + 0.5)
+			px.G = uint16(float64(px.G)*factor + 0.5)
+			px.B = uint16(float64(px.B)*factor + 0.5)
+			out.SetRGBA64(x, y, px)
+		}
+	}
+	return out
+}
+
+// cutShape makes the image transparent outside a shape: with "circle" the largest circle in
+// the middle of the image, with "rounded" the image with its corners rounded to radius, a
+// percentage of its shorter side. The edge of the shape is anti-aliased. A radius of less than
+// half a pixel keeps the corners square.
+func cutShape(img draw.RGBA64Image, shape string, radius int) {
+	b := img.Bounds()
+	cx, cy := float64(b.Min.X+b.Max.X)/2, float64(b.Min.Y+b.Max.Y)/2
+	short := float64(minInt(b.Dx(), b.Dy()))
+	r := short / 2
+	if shape == "rounded" {
+		r = short * float64(radius) / 100
+	}
+	// The center of the circle nearest to a pixel: the middle for a circle, or for a rounded
+	// rectangle the center of the rounded corner it is in
+	innerX, innerY := float64(b.Dx())/2-r, float64(b.Dy())/2-r
+	if shape == "circle" {
+		innerX, innerY = 0, 0
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dx := math.Max(math.Abs(float64(x)+0.5-cx)-innerX, 0)
+			dy := math.Max(math.Abs(float64(y)+0.5-cy)-innerY, 0)
+			if dx == 0 && dy == 0 {
+				// Not in a corner, which the coverage below would get wrong for a tiny radius
+				continue
+			}
+			coverage := clampFloat(r-math.Hypot(dx, dy)+0.5, 0, 1)
+			if coverage == 1 {
+				continue
+			}
+			// Scaling the premultiplied color with the alpha keeps the pixel valid
+			c := img.RGBA64At(x, y)
+			img.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(float64(c.R)*coverage + 0.5),
+				G: uint16(float64(c.G)*coverage + 0.5),
+				B: uint16(float64(c.B)*coverage + 0.5),
+				A: uint16(float64(c.A)*coverage + 0.5),
+			})
+		}
+	}
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func clampFloat(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
+
+// unpremultiply converts a watermark whose colors were stored premultiplied by alpha,
+// as some tools export them, back into the straight alpha colors PNG is meant to hold.
+// Without it the edges of the watermark are blended too dark, leaving a dark halo. The colors
+// are rounded to the nearest value, truncating would keep the edges slightly dark.
+func unpremultiply(img image.Image) *image.NRGBA {
+	out := toNRGBA(img)
+	for i := 0; i < len(out.Pix); i += 4 {
+		a := uint32(out.Pix[i+3])
+		if a == 0 || a == 0xff {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			out.Pix[i+c] = uint8(min32((uint32(out.Pix[i+c])*0xff+a/2)/a, 0xff))
+		}
+	}
+	return out
+}
+
+// looksPremultiplied reports whether the semi-transparent pixels of a straight alpha image
+// never have a color channel brighter than their alpha, which is always the case for
+// premultiplied data and rarely otherwise
+func looksPremultiplied(img image.Image) bool {
+	nrgba := toNRGBA(img)
+	colored := false
+	for i := 0; i < len(nrgba.Pix); i += 4 {
+		a := nrgba.Pix[i+3]
+		if a == 0 || a == 0xff {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			if nrgba.Pix[i+c] > a {
+				return false
+			}
+			if nrgba.Pix[i+c] > 0 {
+				colored = true
+			}
+		}
+	}
+	return colored
+}
+
+// rotate returns a copy of img turned clockwise by a multiple of 90 degrees. The pixels are
+// moved as whole 4 byte values, or 8 byte values for photos with 16 bits per channel, which
+// are returned as an *image.RGBA64, so no resampling takes place.
+func rotate(img image.Image, angle int) image.Image {
+	if angle == 0 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	size := image.Point{h, w}
+	if angle == 180 {
+		size = image.Point{w, h}
+	}
+	if isDeepColor(img) {
+		src, dst := toRGBA64(img), image.NewRGBA64(image.Rectangle{Max: size})
+		rotatePixels(src.Pix, src.Stride, dst.Pix, dst.Stride, w, h, angle, 8)
+		return dst
+	}
+	src, dst := toRGBA(img), image.NewRGBA(image.Rectangle{Max: size})
+	rotatePixels(src.Pix, src.Stride, dst.Pix, dst.Stride, w, h, angle, 4)
+	return dst
+}
+
+// rotatePixels moves the pixels of n bytes of a w x h image in src to their place in dst for rotate
+func rotatePixels(src []uint8, srcStride int, dst []uint8, dstStride int, w, h, angle, n int) {
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch angle {
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			}
+			si := y*srcStride + x*n
+			di := dy*dstStride + dx*n
+			copy(dst[di:di+n], src[si:si+n])
+		}
+	}
+}
+
+// recolor returns a copy of the straight alpha image img in which every pixel whose color is
+// within tolerance of the from color of a mapping, on each channel, gets the to color of the
+// first such mapping. The alpha of all pixels, and the color of pixels that match no mapping,
+// are kept.
+func recolor(img image.Image, mappings []colorMapping, tolerance int) *image.NRGBA {
+	nrgba := toNRGBA(img)
+	near := func(a, b uint8) bool {
+		d := int(a) - int(b)
+		return d <= tolerance && d >= -tolerance
+	}
+	for i := 0; i < len(nrgba.Pix); i += 4 {
+		px := nrgba.Pix[i : i+4 : i+4]
+		if px[3] == 0 {
+			continue
+		}
+		for _, m := range mappings {
+			if near(px[0], m.from.R) && near(px[1], m.from.G) && near(px[2], m.from.B) {
+				px[0], px[1], px[2] = m.to.R, m.to.G, m.to.B
+				break
+			}
+		}
+	}
+	return nrgba
+}
+
+// recolorPremultiplied is recolor for the premultiplied image img, such as a rendered SVG, and
+// changes it in place. The colors are matched without unpremultiplying them first: the faint
+// pixels of anti-aliased edges only have a few levels per channel, so their straight colors
+// can be far off the from color and those edges would keep the old color. A channel matches
+// when the from color premultiplied by the alpha of the pixel is within the tolerance, scaled
+// by the alpha, plus the level the rendering may have rounded it by. For opaque pixels that is
+// the same as recolor.
+func recolorPremultiplied(img *image.RGBA, mappings []colorMapping, tolerance int) {
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(img.Rect.Min.X, y):]
+		for i := 0; i < 4*img.Rect.Dx(); i += 4 {
+			px := row[i : i+4 : i+4]
+			a := int(px[3])
+			if a == 0 {
+				continue
+			}
+			near := func(c, from uint8) bool {
+				d := int(c)*0xff - int(from)*a
+				return d < tolerance*a+0xff && d > -tolerance*a-0xff
+			}
+			for _, m := range mappings {
+				if near(px[0], m.from.R) && near(px[1], m.from.G) && near(px[2], m.from.B) {
+					px[0] = uint8((int(m.to.R)*a + 0x7f) / 0xff)
+					px[1] = uint8((int(m.to.G)*a + 0x7f) / 0xff)
+					px[2] = uint8((int(m.to.B)*a + 0x7f) / 0xff)
+					break
+				}
+			}
+		}
+	}
+}
+
+// toNRGBA returns a copy of img as an *image.NRGBA with its origin at (0, 0)
+func toNRGBA(img image.Image) *image.NRGBA {
+	nrgba := image.NewNRGBA(image.Rectangle{Max: img.Bounds().Size()})
+	if src, ok := img.(*image.NRGBA); ok && src.Rect.Min == (image.Point{}) && src.Stride == nrgba.Stride {
+		copy(nrgba.Pix, src.Pix)
+		return nrgba
+	}
+	draw.Draw(nrgba, nrgba.Rect, img, img.Bounds().Min, draw.Src)
+	return nrgba
+}
+
+func min32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
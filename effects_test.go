@@ -0,0 +1,193 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// deepTestPhoto returns a 3x2 photo with 16 bits per channel whose values don't fit in 8 bits
+func deepTestPhoto() *image.RGBA64 {
+	img := image.NewRGBA64(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			v := uint16(0x1001 + 0x1111*(y*3+x))
+			img.SetRGBA64(x, y, color.RGBA64{v, v + 1, v + 2, 0xffff})
+		}
+	}
+	return img
+}
+
+func TestRotateKeepsDeepColor(t *testing.T) {
+	src := deepTestPhoto()
+	tests := []struct {
+		angle int
+		size  image.Point
+		// where the top left pixel of the photo ends up
+		topLeft image.Point
+	}{
+		{90, image.Point{2, 3}, image.Point{1, 0}},
+		{180, image.Point{3, 2}, image.Point{2, 1}},
+		{270, image.Point{2, 3}, image.Point{0, 2}},
+	}
+	for _, test := range tests {
+		rotated, ok := rotate(src, test.angle).(*image.RGBA64)
+		if !ok {
+			t.Fatalf("rotate %d: got a %T, want an *image.RGBA64", test.angle, rotate(src, test.angle))
+		}
+		if rotated.Rect.Size() != test.size {
+			t.Errorf("rotate %d: got size %v, want %v", test.angle, rotated.Rect.Size(), test.size)
+		}
+		if got, want := rotated.RGBA64At(test.topLeft.X, test.topLeft.Y), src.RGBA64At(0, 0); got != want {
+			t.Errorf("rotate %d: top left pixel is %v, want %v", test.angle, got, want)
+		}
+	}
+	if _, ok := rotate(image.NewNRGBA(image.Rect(0, 0, 2, 2)), 90).(*image.RGBA); !ok {
+		t.Error("an 8-bit photo is not rotated to an *image.RGBA")
+	}
+}
+
+func TestVignetteKeepsDeepColor(t *testing.T) {
+	src := deepTestPhoto()
+	out, ok := vignette(src, 0.5, 0).(*image.RGBA64)
+	if !ok {
+		t.Fatalf("got a %T, want an *image.RGBA64", vignette(src, 0.5, 0))
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			before, after := src.RGBA64At(x, y), out.RGBA64At(x, y)
+			if after.R >= before.R || after.A != before.A {
+				t.Errorf("pixel %d,%d went from %v to %v, want it darker with the same alpha", x, y, before, after)
+			}
+			if after.R&0xff == 0 && after.G&0xff == 0 && after.B&0xff == 0 {
+				t.Errorf("pixel %d,%d is %v, which lost its low bits", x, y, after)
+			}
+		}
+	}
+	if _, ok := vignette(image.NewNRGBA(image.Rect(0, 0, 2, 2)), 0.5, 0).(*image.RGBA); !ok {
+		t.Error("an 8-bit photo is not returned as an *image.RGBA")
+	}
+}
+
+func TestUnpremultiply(t *testing.T) {
+	tests := []struct {
+		name string
+		in   color.NRGBA
+		want color.NRGBA
+	}{
+		{"rounded", color.NRGBA{100, 50, 0, 200}, color.NRGBA{128, 64, 0, 200}},
+		{"clipped", color.NRGBA{200, 10, 0, 100}, color.NRGBA{0xff, 26, 0, 100}},
+		{"faint", color.NRGBA{1, 2, 0, 3}, color.NRGBA{85, 170, 0, 3}},
+		{"opaque", color.NRGBA{100, 50, 0, 0xff}, color.NRGBA{100, 50, 0, 0xff}},
+		{"transparent", color.NRGBA{100, 50, 0, 0}, color.NRGBA{100, 50, 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+			img.SetNRGBA(0, 0, test.in)
+			if got := unpremultiply(img).NRGBAAt(0, 0); got != test.want {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestRecolorPremultipliedEdges recolors the anti-aliased edge of a rendered SVG, whose faint
+// pixels have colors far off the from color once unpremultiplied
+func TestRecolorPremultipliedEdges(t *testing.T) {
+	from, to, other := color.NRGBA{200, 100, 50, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}, color.NRGBA{20, 200, 20, 0xff}
+	mappings := []colorMapping{{from: color.RGBA(from), to: color.RGBA(to)}}
+	for _, tolerance := range []int{0, 8} {
+		for _, alpha := range []uint8{1, 3, 5, 10, 40, 128, 0xff} {
+			img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+			premultiply := func(c color.NRGBA) color.RGBA {
+				return color.RGBAModel.Convert(color.NRGBA{c.R, c.G, c.B, alpha}).(color.RGBA)
+			}
+			img.SetRGBA(0, 0, premultiply(from))
+			img.SetRGBA(1, 0, premultiply(other))
+			recolorPremultiplied(img, mappings, tolerance)
+			if got, want := img.RGBAAt(0, 0), premultiply(to); !nearColor(got, want, 1) {
+				t.Errorf("Tolerance %d, alpha %d: got %v, want %v", tolerance, alpha, got, want)
+			}
+			// At the lowest alpha both colors can have the same premultiplied value
+			if got, want := img.RGBAAt(1, 0), premultiply(other); got != want && want != premultiply(from) {
+				t.Errorf("Tolerance %d, alpha %d: the other color changed to %v, want %v", tolerance, alpha, got, want)
+			}
+		}
+	}
+}
+
+func TestCutShape(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   image.Point
+		shape  string
+		radius int
+		// The alpha of the corner pixel, the middle of the top edge and the center, give or take
+		// the anti-aliasing of the edge
+		corner, edge, center uint8
+	}{
+		{"circle", image.Pt(40, 40), "circle", 0, 0, 0xff, 0xff},
+		{"wide circle", image.Pt(80, 40), "circle", 0, 0, 0xff, 0xff},
+		{"rounded", image.Pt(60, 40), "rounded", 30, 0, 0xff, 0xff},
+		{"rounded to an ellipse", image.Pt(40, 40), "rounded", 50, 0, 0xff, 0xff},
+		{"radius 0", image.Pt(60, 40), "rounded", 0, 0xff, 0xff, 0xff},
+		{"tiny radius", image.Pt(20, 20), "rounded", 1, 0xff, 0xff, 0xff},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := image.NewRGBA(image.Rectangle{Max: test.size})
+			for i := range img.Pix {
+				img.Pix[i] = 0xff
+			}
+			cutShape(img, test.shape, test.radius)
+			points := []struct {
+				name string
+				x, y int
+				want uint8
+			}{
+				{"corner", 0, 0, test.corner},
+				{"edge", test.size.X / 2, 0, test.edge},
+				{"center", test.size.X / 2, test.size.Y / 2, test.center},
+			}
+			for _, p := range points {
+				if got := img.RGBAAt(p.x, p.y); int(got.A)-int(p.want) > 2 || int(p.want)-int(got.A) > 2 || got.R > got.A {
+					t.Errorf("Got %v at the %s, want alpha %d", got, p.name, p.want)
+				}
+			}
+		})
+	}
+}
+
+func TestToNRGBA(t *testing.T) {
+	full := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			full.SetNRGBA(x, y, color.NRGBA{uint8(x * 60), uint8(y * 60), 0x80, 0xff})
+		}
+	}
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"whole image", full},
+		{"cut out at the origin", full.SubImage(image.Rect(0, 0, 2, 2)).(*image.NRGBA)},
+		{"cut out elsewhere", full.SubImage(image.Rect(1, 2, 4, 4)).(*image.NRGBA)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := toNRGBA(test.img)
+			b := test.img.Bounds()
+			if got.Rect != (image.Rectangle{Max: b.Size()}) {
+				t.Fatalf("Got bounds %v, want %v", got.Rect, image.Rectangle{Max: b.Size()})
+			}
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if c, want := got.NRGBAAt(x-b.Min.X, y-b.Min.Y), test.img.NRGBAAt(x, y); c != want {
+						t.Errorf("Got %v at %d,%d, want %v", c, x-b.Min.X, y-b.Min.Y, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sourceFile is a file found in the source directory
+type sourceFile struct {
+	os.FileInfo
+	relPath string // path relative to the source directory
+	index   int    // position among the photos of the batch, in the order they are listed
+}
+
+// osFS is an fs.FS for files on disk. Unlike os.DirFS it accepts any path the os package
+// does, relative to the working directory or absolute.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// getFiles lists the files in dirname of fsys, descending into subdirectories up to depth levels
+// deep. A depth of 0 only lists dirname itself, and a negative depth has no limit. The directory
+// skip is never descended into, so a target directory inside the source is not processed again.
+// Hidden files and directories, whose name starts with a dot such as .DS_Store, are left out
+// unless includeHidden is set.
+func getFiles(fsys fs.FS, dirname string, depth int, skip string, includeHidden bool) ([]sourceFile, error) {
+	var files []sourceFile
+	var walk func(rel string, level int) error
+	walk = func(rel string, level int) error {
+		entries, err := fs.ReadDir(fsys, path.Join(dirname, rel))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !includeHidden && strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			relPath := path.Join(rel, entry.Name())
+			if entry.IsDir() {
+				if (depth < 0 || level < depth) && (skip == "" || !sameDir(path.Join(dirname, relPath), skip)) {
+					if err := walk(relPath, level+1); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			files = append(files, sourceFile{FileInfo: info, relPath: relPath})
+		}
+		return nil
+	}
+	return files, walk("", 0)
+}
+
+// readFileList reads the photos listed for -files-from, in the file fname or on stdin for -,
+// instead of listing the source directory dirname. Every line is a path relative to the working
+// directory or absolute, taken as is so names may contain spaces, and empty lines are skipped.
+// The photos must be in the source directory, as their path in it is kept for the output.
+func readFileList(fname string, dirname string) ([]sourceFile, error) {
+	var list io.Reader = os.Stdin
+	if fname != "-" {
+		listfile, err := os.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+		defer listfile.Close()
+		list = listfile
+	}
+	root, err := filepath.Abs(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []sourceFile
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		name := strings.TrimSuffix(scanner.Text(), "\r")
+		if name == "" {
+			continue
+		}
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("'%s' is not in the source folder '%s'", name, dirname)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("'%s' is a folder, list the photos in it instead", name)
+		}
+		relPath := filepath.ToSlash(rel)
+		if !seen[relPath] {
+			seen[relPath] = true
+			files = append(files, sourceFile{FileInfo: info, relPath: relPath})
+		}
+	}
+	return files, scanner.Err()
+}
+
+// sameDir reports whether two paths refer to the same directory
+func sameDir(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// sortOrders lists the supported values for the -sort flag
+var sortOrders = []string{"name", "name-desc", "mtime", "mtime-desc", "size"}
+
+// sortFiles orders the files for the features that depend on the order of the photos, such as
+// -alternate and -opacity-ramp. The name order sorts the files by path, whatever order they were
+// listed in by the walk or -files-from. The other orders fall back to the path for files that
+// are the same, so the order is always the same.
+func sortFiles(files []sourceFile, order string) {
+	sort.SliceStable(files, func(i, j int) bool { return files[i].relPath < files[j].relPath })
+	switch order {
+	case "name-desc":
+		sort.SliceStable(files, func(i, j int) bool { return files[i].relPath > files[j].relPath })
+	case "mtime":
+		sort.SliceStable(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	case "mtime-desc":
+		sort.SliceStable(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	case "size":
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Size() < files[j].Size() })
+	}
+}
+
+// filterSubjectMasks returns the files that are not the subject masks of -subject-masks
+func filterSubjectMasks(files []sourceFile) []sourceFile {
+	var photos []sourceFile
+	for _, file := range files {
+		if !isSubjectMask(file.Name()) {
+			photos = append(photos, file)
+		}
+	}
+	return photos
+}
+
+// filterMatch returns the files whose name matches re, or with exclude the files whose name doesn't
+func filterMatch(files []sourceFile, re *regexp.Regexp, exclude bool) []sourceFile {
+	var matched []sourceFile
+	for _, file := range files {
+		if re.MatchString(file.Name()) != exclude {
+			matched = append(matched, file)
+		}
+	}
+	return matched
+}
+
+// filterSince returns the files modified after the cutoff
+func filterSince(files []sourceFile, cutoff time.Time) []sourceFile {
+	var recent []sourceFile
+	for _, file := range files {
+		if file.ModTime().After(cutoff) {
+			recent = append(recent, file)
+		}
+	}
+	return recent
+}
+
+// numberImages sets the index of the photos among the files, in order, skipping other files
+func numberImages(files []sourceFile) {
+	index := 0
+	for i := range files {
+		if sourceType(files[i].Name()) != "" {
+			files[i].index = index
+			index++
+		}
+	}
+}
+
+// countImages returns the number of files that are supported photos
+func countImages(files []sourceFile) int {
+	count := 0
+	for _, file := range files {
+		if sourceType(file.Name()) != "" {
+			count++
+		}
+	}
+	return count
+}
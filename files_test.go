@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testFileInfo is the file information of a file that doesn't exist on disk
+type testFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (f testFileInfo) Name() string       { return f.name }
+func (f testFileInfo) Size() int64        { return f.size }
+func (f testFileInfo) Mode() os.FileMode  { return 0644 }
+func (f testFileInfo) ModTime() time.Time { return f.modTime }
+func (f testFileInfo) IsDir() bool        { return false }
+func (f testFileInfo) Sys() interface{}   { return nil }
+
+func TestSortFiles(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	// Listed as a walk lists them, with the folder a before the file a.jpg
+	listed := []struct {
+		relPath string
+		size    int64
+		modTime time.Time
+	}{
+		{"a/x.jpg", 300, day},
+		{"a.jpg", 100, day.Add(time.Hour)},
+		{"c.jpg", 200, day},
+		{"b.jpg", 100, day.Add(-time.Hour)},
+	}
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{"name", []string{"a.jpg", "a/x.jpg", "b.jpg", "c.jpg"}},
+		{"name-desc", []string{"c.jpg", "b.jpg", "a/x.jpg", "a.jpg"}},
+		{"mtime", []string{"b.jpg", "a/x.jpg", "c.jpg", "a.jpg"}},
+		{"mtime-desc", []string{"a.jpg", "a/x.jpg", "c.jpg", "b.jpg"}},
+		{"size", []string{"a.jpg", "b.jpg", "c.jpg", "a/x.jpg"}},
+	}
+	for _, test := range tests {
+		t.Run(test.order, func(t *testing.T) {
+			var files []sourceFile
+			for _, f := range listed {
+				files = append(files, sourceFile{FileInfo: testFileInfo{path.Base(f.relPath), f.size, f.modTime}, relPath: f.relPath})
+			}
+			sortFiles(files, test.order)
+			var got []string
+			for _, file := range files {
+				got = append(got, file.relPath)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// colorFlag is a flag.Value for colors given as hex strings, such as "#ffffff" or "fff". The
+// colors are opaque, so a flag without a default is not set while its alpha is 0.
+type colorFlag struct {
+	color.RGBA
+}
+
+func (c *colorFlag) String() string {
+	if !c.isSet() {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (c *colorFlag) isSet() bool {
+	return c.A > 0
+}
+
+func (c *colorFlag) Set(value string) error {
+	col, err := parseHexColor(value)
+	if err != nil {
+		return err
+	}
+	c.RGBA = col
+	return nil
+}
+
+// parseHexColor parses an opaque color in #RGB or #RRGGBB notation, the # is optional
+func parseHexColor(value string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color '%s', expected #RRGGBB", value)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color '%s', expected #RRGGBB", value)
+	}
+	return color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 0xff}, nil
+}
+
+// scaleFlag is a flag.Value for a fraction between 0 (exclusive) and 1, which may
+// also be given as a percentage such as "20%"
+type scaleFlag float64
+
+func (s *scaleFlag) String() string {
+	return strconv.FormatFloat(float64(*s), 'g', -1, 64)
+}
+
+func (s *scaleFlag) Set(value string) error {
+	scale, err := parseScale(value)
+	if err != nil {
+		return err
+	}
+	*s = scaleFlag(scale)
+	return nil
+}
+
+// parseScale parses a fraction ("0.2") or percentage ("20%") into a value in (0, 1]
+func parseScale(value string) (float64, error) {
+	number := strings.TrimSpace(value)
+	percent := strings.HasSuffix(number, "%")
+	number = strings.TrimSuffix(number, "%")
+
+	scale, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid scale '%s', expected a fraction like 0.2 or a percentage like 20%%", value)
+	}
+	if percent {
+		scale /= 100
+	}
+	if !(scale > 0 && scale <= 1) {
+		return 0, fmt.Errorf("scale '%s' must be greater than 0 and at most 1 (100%%)", value)
+	}
+	return scale, nil
+}
+
+// aspectFlag is a flag.Value for an aspect ratio given as "W:H", such as "16:9"
+type aspectFlag struct {
+	w, h int
+}
+
+func (a *aspectFlag) String() string {
+	if !a.isSet() {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", a.w, a.h)
+}
+
+func (a *aspectFlag) Set(value string) error {
+	w, h, found := strings.Cut(value, ":")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if !found || errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid aspect ratio '%s', expected W:H such as 1:1", value)
+	}
+	a.w, a.h = width, height
+	return nil
+}
+
+func (a *aspectFlag) isSet() bool {
+	return a.w > 0 && a.h > 0
+}
+
+// boxFlag is a flag.Value for a size in pixels given as "WxH", such as "200x100" or "6000x4000"
+type boxFlag struct {
+	image.Point
+}
+
+func (b *boxFlag) String() string {
+	if !b.isSet() {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", b.X, b.Y)
+}
+
+func (b *boxFlag) Set(value string) error {
+	w, h, found := strings.Cut(strings.ToLower(value), "x")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if !found || errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid size '%s', expected WxH in pixels such as 200x100", value)
+	}
+	b.X, b.Y = width, height
+	return nil
+}
+
+func (b *boxFlag) isSet() bool {
+	return b.X > 0 && b.Y > 0
+}
+
+// anchorFlag is a flag.Value for a cell of the anchor grid, optionally followed by two nudges
+// along x and y, each in pixels or in percent of the photo size, such as "br", "bl+24+16" or
+// "tc+0+5%". Nudges move the watermark in from the edges of its cell, as the -offset flags do.
+type anchorFlag struct {
+	value            string
+	cell             string
+	nudge            image.Point // in pixels
+	offsetX, offsetY float64     // fractions of the photo size
+}
+
+var anchorPattern = regexp.MustCompile(`^([a-z]{2})(?:([+-][0-9.]+%?)([+-][0-9.]+%?))?$`)
+
+func (a *anchorFlag) String() string {
+	return a.value
+}
+
+func (a *anchorFlag) Set(value string) error {
+	match := anchorPattern.FindStringSubmatch(strings.ToLower(value))
+	if match == nil || !contains(anchors, match[1]) {
+		return fmt.Errorf("invalid anchor '%s', expected one of [%s] and optional nudges such as bl+24+16 or tc+0+5%%", value, strings.Join(anchors, ", "))
+	}
+	var nudge image.Point
+	var offsets [2]float64
+	for i, n := range match[2:] {
+		if n == "" {
+			continue
+		}
+		var err error
+		if strings.HasSuffix(n, "%") {
+			offsets[i], err = strconv.ParseFloat(strings.TrimSuffix(n, "%"), 64)
+			if err == nil && math.Abs(offsets[i]) >= 100 {
+				err = fmt.Errorf("nudge '%s' is not below 100%%", n)
+			}
+			offsets[i] /= 100
+		} else {
+			var pixels int
+			pixels, err = strconv.Atoi(n)
+			if i == 0 {
+				nudge.X = pixels
+			} else {
+				nudge.Y = pixels
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid anchor '%s': nudges are whole pixels or percentages below 100, such as +24 or -5%%", value)
+		}
+	}
+	a.value, a.cell, a.nudge = value, match[1], nudge
+	a.offsetX, a.offsetY = offsets[0], offsets[1]
+	return nil
+}
+
+func (a *anchorFlag) isSet() bool {
+	return a.cell != ""
+}
+
+// printSizeFlag is a flag.Value for a print size in inches given as "WxH", such as "8x10" or "3.5x5"
+type printSizeFlag struct {
+	width, height float64
+}
+
+func (p *printSizeFlag) String() string {
+	if !p.isSet() {
+		return ""
+	}
+	return fmt.Sprintf("%gx%g", p.width, p.height)
+}
+
+func (p *printSizeFlag) Set(value string) error {
+	w, h, found := strings.Cut(strings.ToLower(value), "x")
+	width, errW := strconv.ParseFloat(w, 64)
+	height, errH := strconv.ParseFloat(h, 64)
+	if !found || errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid print size '%s', expected WxH in inches such as 8x10", value)
+	}
+	p.width, p.height = width, height
+	return nil
+}
+
+func (p *printSizeFlag) isSet() bool {
+	return p.width > 0 && p.height > 0
+}
+
+// byteSizeFlag is a flag.Value for an amount of memory, such as "512MB", "1.5GB" or "1048576"
+type byteSizeFlag int64
+
+var byteUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+func (b *byteSizeFlag) String() string {
+	for _, unit := range byteUnits[:4] {
+		if float64(*b) >= unit.size {
+			return strconv.FormatFloat(float64(*b)/unit.size, 'g', 4, 64) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(*b), 10) + "B"
+}
+
+func (b *byteSizeFlag) Set(value string) error {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := 1.0
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid size '%s', expected a value like 512MB or 2GB", value)
+	}
+	*b = byteSizeFlag(size * multiplier)
+	return nil
+}
+
+// sizesFlag is a flag.Value for a comma separated list of pixel sizes, such as "2000,1000,500"
+type sizesFlag []int
+
+func (s *sizesFlag) String() string {
+	sizes := make([]string, len(*s))
+	for i, size := range *s {
+		sizes[i] = strconv.Itoa(size)
+	}
+	return strings.Join(sizes, ",")
+}
+
+func (s *sizesFlag) Set(value string) error {
+	var sizes sizesFlag
+	for _, field := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(field), "px")))
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid size '%s' in '%s', expected positive pixel sizes like 2000,1000,500", field, value)
+		}
+		sizes = append(sizes, size)
+	}
+	*s = sizes
+	return nil
+}
+
+// recolorFlag is a flag.Value for a comma separated list of color replacements in the
+// form old:new, such as "#000000:#ffffff,#333:#ccc"
+type recolorFlag []colorMapping
+
+// colorMapping replaces the color from with the color to
+type colorMapping struct {
+	from, to color.RGBA
+}
+
+func (r *recolorFlag) String() string {
+	mappings := make([]string, len(*r))
+	for i, m := range *r {
+		mappings[i] = fmt.Sprintf("#%02x%02x%02x:#%02x%02x%02x", m.from.R, m.from.G, m.from.B, m.to.R, m.to.G, m.to.B)
+	}
+	return strings.Join(mappings, ",")
+}
+
+func (r *recolorFlag) Set(value string) error {
+	var mappings recolorFlag
+	for _, field := range strings.Split(value, ",") {
+		from, to, found := strings.Cut(strings.TrimSpace(field), ":")
+		if !found {
+			return fmt.Errorf("invalid color replacement '%s' in '%s', expected old:new such as #000000:#ffffff", field, value)
+		}
+		fromColor, err := parseHexColor(from)
+		if err != nil {
+			return err
+		}
+		toColor, err := parseHexColor(to)
+		if err != nil {
+			return err
+		}
+		mappings = append(mappings, colorMapping{fromColor, toColor})
+	}
+	*r = mappings
+	return nil
+}
+
+// sinceFlag is a flag.Value for a point in time, given either as a duration before now
+// ("36h", "7d") or as a date or timestamp ("2024-05-01", "2024-05-01 18:00" or RFC 3339)
+type sinceFlag struct {
+	time.Time
+}
+
+var sinceLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func (s *sinceFlag) String() string {
+	if s.IsZero() {
+		return ""
+	}
+	return s.Format("2006-01-02 15:04:05")
+}
+
+func (s *sinceFlag) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "d") {
+		if n, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64); err == nil {
+			s.Time = time.Now().Add(-time.Duration(n * 24 * float64(time.Hour)))
+			return nil
+		}
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		s.Time = time.Now().Add(-duration)
+		return nil
+	}
+	for _, layout := range sinceLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			s.Time = t
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time '%s', expected a duration like 24h or 7d, or a date like 2024-05-01", value)
+}
+
+// regexpFlag is a flag.Value for a regular expression, compiled when the flag is parsed so an
+// invalid expression is reported right away
+type regexpFlag struct {
+	*regexp.Regexp
+}
+
+func (r *regexpFlag) String() string {
+	if r.Regexp == nil {
+		return ""
+	}
+	return r.Regexp.String()
+}
+
+func (r *regexpFlag) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return fmt.Errorf("invalid regular expression: %w", err)
+	}
+	r.Regexp = re
+	return nil
+}
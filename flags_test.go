@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestScaleFlag(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64 // 0 for a value that is rejected
+	}{
+		{"0.2", 0.2},
+		{"20%", 0.2},
+		{" 20 % ", 0.2},
+		{"1", 1},
+		{"100%", 1},
+		{"0.5%", 0.005},
+		{"200%", 0},
+		{"1.5", 0},
+		{"0", 0},
+		{"0%", 0},
+		{"-0.2", 0},
+		{"NaN", 0},
+		{"%", 0},
+		{"20%%", 0},
+		{"twenty", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			var scale scaleFlag
+			err := scale.Set(test.value)
+			if test.want == 0 {
+				if err == nil {
+					t.Errorf("Got scale %s, want an error", scale.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Got error %s, want %g", err, test.want)
+			}
+			if float64(scale) < test.want-1e-12 || float64(scale) > test.want+1e-12 {
+				t.Errorf("Got scale %s, want %g", scale.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestAnchorFlag(t *testing.T) {
+	tests := []struct {
+		value            string
+		cell             string // "" for a value that is rejected
+		nudge            image.Point
+		offsetX, offsetY float64
+	}{
+		{"tl", "tl", image.Point{}, 0, 0},
+		{"mc", "mc", image.Point{}, 0, 0},
+		{"bl+24+16", "bl", image.Point{24, 16}, 0, 0},
+		{"tc+0+5%", "tc", image.Point{}, 0, 0.05},
+		{"BR-10-2.5%", "br", image.Point{-10, 0}, 0, -0.025},
+		{"mr+10%-3", "mr", image.Point{0, -3}, 0.1, 0},
+		{"xx", "", image.Point{}, 0, 0},
+		{"left", "", image.Point{}, 0, 0},
+		{"tl+24", "", image.Point{}, 0, 0},
+		{"tl+1.5+0", "", image.Point{}, 0, 0},
+		{"tl+100%+0", "", image.Point{}, 0, 0},
+		{"tl 24 16", "", image.Point{}, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			var anchor anchorFlag
+			err := anchor.Set(test.value)
+			if test.cell == "" {
+				if err == nil {
+					t.Errorf("Got anchor %s, want an error", anchor.cell)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if anchor.cell != test.cell || anchor.nudge != test.nudge || math.Abs(anchor.offsetX-test.offsetX) > 1e-12 || math.Abs(anchor.offsetY-test.offsetY) > 1e-12 {
+				t.Errorf("Got %s nudged by %v and %g, %g, want %s nudged by %v and %g, %g",
+					anchor.cell, anchor.nudge, anchor.offsetX, anchor.offsetY, test.cell, test.nudge, test.offsetX, test.offsetY)
+			}
+			if anchor.String() != test.value {
+				t.Errorf("Got string %s, want %s", anchor.String(), test.value)
+			}
+		})
+	}
+}
@@ -3,3 +3,15 @@ module testingapp
 go 1.19
 
 require github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+
+require (
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20210519020934-456a8d69b780
+	golang.org/x/image v0.18.0
+	golang.org/x/time v0.5.0
+)
+
+require (
+	golang.org/x/net v0.0.0-20211118161319-6a13c67c3ce4 // indirect
+	golang.org/x/text v0.16.0 // indirect
+)
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sync"
+
+	"github.com/nfnt/resize"
+)
+
+// heatmapName is the file name of the heatmap in the target directory
+const heatmapName = "heatmap.jpg"
+
+// heatmapSize is the longest side in pixels of the heatmap
+const heatmapSize = 800
+
+// heatmap collects where the watermark landed on every photo of a run, and draws all those
+// places over the first photo, to review the placement of a batch. Positions are stored as
+// fractions of the photo size, so photos of any resolution can be combined. It is safe for
+// concurrent use.
+type heatmap struct {
+	mu         sync.Mutex
+	size       int
+	placements map[string][][4]float64 // left, top, right and bottom of the watermarks, by photo
+	firstName  string
+	first      image.Image // thumbnail of the photo with the first name, drawn under the heatmap
+}
+
+func newHeatmap(size int) *heatmap {
+	return &heatmap{size: size, placements: map[string][][4]float64{}}
+}
+
+// add records where the watermarks were drawn on the watermarked photo img. Renditions of
+// the same photo replace each other, so every photo is counted once.
+func (h *heatmap) add(name string, img image.Image, wmRects []image.Rectangle) {
+	bounds := img.Bounds()
+	w, hgt := float64(bounds.Dx()), float64(bounds.Dy())
+	placements := make([][4]float64, len(wmRects))
+	for i, wmRect := range wmRects {
+		placements[i] = [4]float64{
+			float64(wmRect.Min.X-bounds.Min.X) / w, float64(wmRect.Min.Y-bounds.Min.Y) / hgt,
+			float64(wmRect.Max.X-bounds.Min.X) / w, float64(wmRect.Max.Y-bounds.Min.Y) / hgt,
+		}
+	}
+
+	h.mu.Lock()
+	first := h.first == nil || name < h.firstName
+	h.placements[name] = placements
+	h.mu.Unlock()
+	if !first {
+		return
+	}
+
+	thumb := resize.Thumbnail(uint(h.size), uint(h.size), img, resize.Bilinear)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.first == nil || name <= h.firstName {
+		h.first, h.firstName = thumb, name
+	}
+}
+
+// render draws the first photo darkened, with every pixel colored from transparent through
+// red to yellow by how many watermarks covered it
+func (h *heatmap) render() *image.RGBA {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	size := image.Point{h.size, h.size}
+	if h.first != nil {
+		size = h.first.Bounds().Size()
+	}
+	img := image.NewRGBA(image.Rectangle{Max: size})
+	if h.first != nil {
+		draw.Draw(img, img.Rect, h.first, h.first.Bounds().Min, draw.Src)
+	}
+	draw.Draw(img, img.Rect, image.NewUniform(color.NRGBA{0, 0, 0, 0x99}), image.Point{}, draw.Over)
+
+	counts := make([]int, size.X*size.Y)
+	most := 0
+	for _, photo := range h.placements {
+		for _, p := range photo {
+			r := image.Rect(
+				int(math.Floor(p[0]*float64(size.X))), int(math.Floor(p[1]*float64(size.Y))),
+				int(math.Ceil(p[2]*float64(size.X))), int(math.Ceil(p[3]*float64(size.Y))),
+			).Intersect(img.Rect)
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					counts[y*size.X+x]++
+					most = maxInt(most, counts[y*size.X+x])
+				}
+			}
+		}
+	}
+
+	// The photo is opaque, so the heat color is blended over it with straight alpha
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		t := float64(count) / float64(most)
+		heat := [3]float64{0xff, 0xff * t, 0}
+		alpha := 0.25 + 0.6*t
+		px := img.Pix[4*i : 4*i+3]
+		for c := range px {
+			px[c] = uint8(heat[c]*alpha + float64(px[c])*(1-alpha) + 0.5)
+		}
+	}
+	return img
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestHeatmap(t *testing.T) {
+	h := newHeatmap(100)
+	// The watermark of b covers the top half, and that of a the top left quarter. a is added
+	// twice, like the renditions of a photo, and must only count once. a comes first by name,
+	// so the heatmap is drawn over it although b was added first.
+	h.add("b.jpg", solidPhoto(400, 200, color.RGBA{0xff, 0xff, 0xff, 0xff}), []image.Rectangle{image.Rect(0, 0, 400, 100)})
+	h.add("a.jpg", solidPhoto(200, 100, color.RGBA{200, 200, 200, 0xff}), []image.Rectangle{image.Rect(0, 0, 100, 50)})
+	h.add("a.jpg", solidPhoto(100, 50, color.RGBA{200, 200, 200, 0xff}), []image.Rectangle{image.Rect(0, 0, 50, 25)})
+	img := h.render()
+	if want := image.Rect(0, 0, 100, 50); img.Rect != want {
+		t.Fatalf("Got heatmap bounds %v, want %v", img.Rect, want)
+	}
+
+	tests := []struct {
+		name string
+		x, y int
+		want color.RGBA
+	}{
+		{"both watermarks", 10, 10, color.RGBA{229, 229, 12, 0xff}},
+		{"one watermark", 75, 10, color.RGBA{176, 106, 36, 0xff}},
+		{"no watermark", 10, 40, color.RGBA{80, 80, 80, 0xff}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := img.RGBAAt(test.x, test.y); !nearColor(got, test.want, 2) {
+				t.Errorf("Got %v at %d,%d, want %v", got, test.x, test.y, test.want)
+			}
+		})
+	}
+}
+
+func TestHeatmapEmpty(t *testing.T) {
+	img := newHeatmap(50).render()
+	if want := image.Rect(0, 0, 50, 50); img.Rect != want {
+		t.Fatalf("Got heatmap bounds %v, want %v", img.Rect, want)
+	}
+	if got, want := img.RGBAAt(25, 25), (color.RGBA{0, 0, 0, 0x99}); got != want {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"sync"
+)
+
+// errUnsupportedProfile is returned for ICC profiles that are not described by primaries and
+// tone curves, such as the lookup table profiles of printers
+var errUnsupportedProfile = errors.New("unsupported color profile")
+
+// matrix3 is a 3x3 matrix that converts RGB or XYZ colors, by rows
+type matrix3 [3][3]float64
+
+func (m matrix3) mul(n matrix3) matrix3 {
+	var out matrix3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				out[i][j] += m[i][k] * n[k][j]
+			}
+		}
+	}
+	return out
+}
+
+func (m matrix3) inverse() matrix3 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var out matrix3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// The cofactor of the transposed position, with the rows and columns wrapping around
+			a, b := m[(j+1)%3], m[(j+2)%3]
+			out[i][j] = (a[(i+1)%3]*b[(i+2)%3] - a[(i+2)%3]*b[(i+1)%3]) / det
+		}
+	}
+	return out
+}
+
+// srgbToXYZ converts linear sRGB to the D50 XYZ of ICC profiles, its columns are the colorants
+// of the sRGB profile
+var srgbToXYZ = matrix3{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// iccProfile is an RGB color profile described by the XYZ of its primaries and a tone curve per channel
+type iccProfile struct {
+	toXYZ  matrix3
+	curves [3]func(float64) float64 // from encoded to linear values, both between 0 and 1
+}
+
+// parseICCProfile reads the primaries and tone curves of an RGB ICC profile. Profiles of other
+// color spaces, or that describe the colors with lookup tables only, are not supported.
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("%w: not an ICC profile", errUnsupportedProfile)
+	}
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, fmt.Errorf("%w: not an RGB profile", errUnsupportedProfile)
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count && 132+12*i+12 <= len(data); i++ {
+		entry := data[132+12*i:]
+		offset, size := binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:])
+		if uint64(offset)+uint64(size) <= uint64(len(data)) {
+			tags[string(entry[:4])] = data[offset : offset+size]
+		}
+	}
+
+	p := &iccProfile{}
+	for i, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, err := parseXYZTag(tags[name])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", errUnsupportedProfile, name, err)
+		}
+		for row := 0; row < 3; row++ {
+			p.toXYZ[row][i] = xyz[row]
+		}
+	}
+	for i, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseCurveTag(tags[name])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", errUnsupportedProfile, name, err)
+		}
+		p.curves[i] = curve
+	}
+	return p, nil
+}
+
+// s15Fixed16 decodes the signed fixed point numbers of ICC profiles
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parseXYZTag(tag []byte) ([3]float64, error) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, errors.New("missing or malformed")
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, nil
+}
+
+// parseCurveTag reads a tone curve, given as a gamma, a table or a parametric function
+func parseCurveTag(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("missing or malformed")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*n {
+			return nil, errors.New("malformed curve")
+		}
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(v float64) float64 {
+			pos := v * float64(n-1)
+			i := clampInt(int(pos), 0, n-2)
+			t := pos - float64(i)
+			return table[i]*(1-t) + table[i+1]*t
+		}, nil
+	case "para":
+		// The number of parameters of each of the 5 function types, see the ICC specification
+		counts := []int{1, 3, 4, 5, 7}
+		function := int(binary.BigEndian.Uint16(tag[8:]))
+		if function >= len(counts) || len(tag) < 12+4*counts[function] {
+			return nil, errors.New("malformed parametric curve")
+		}
+		var g [7]float64
+		for i := 0; i < counts[function]; i++ {
+			g[i] = s15Fixed16(tag[12+4*i:])
+		}
+		gamma, a, b, c, d, e, f := g[0], g[1], g[2], g[3], g[4], g[5], g[6]
+		switch function {
+		case 0:
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		case 1:
+			return func(v float64) float64 {
+				if v >= -b/a {
+					return math.Pow(a*v+b, gamma)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(v float64) float64 {
+				if v >= -b/a {
+					return math.Pow(a*v+b, gamma) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(v float64) float64 {
+				if v >= d {
+					return math.Pow(a*v+b, gamma)
+				}
+				return c * v
+			}, nil
+		}
+		return func(v float64) float64 {
+			if v >= d {
+				return math.Pow(a*v+b, gamma) + e
+			}
+			return c*v + f
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported curve type '%s'", tag[:4])
+}
+
+// srgbEncode converts a linear value between 0 and 1 to the sRGB tone curve
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// srgbDecode converts a value between 0 and 1 on the sRGB tone curve to linear light, the
+// inverse of srgbEncode
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// srgbEncodeTable maps linear 16-bit values to sRGB encoded 16-bit values, built on first use
+var (
+	srgbEncodeOnce  sync.Once
+	srgbEncodeTable []uint16
+)
+
+// convertToSRGB converts a photo from the colors of profile to sRGB. Photos with 16 bits per
+// channel are returned as an *image.RGBA64, all others as an *image.RGBA.
+func convertToSRGB(photo image.Image, profile *iccProfile) image.Image {
+	srgbEncodeOnce.Do(func() {
+		srgbEncodeTable = make([]uint16, 1<<16)
+		for i := range srgbEncodeTable {
+			srgbEncodeTable[i] = uint16(srgbEncode(float64(i)/65535)*65535 + 0.5)
+		}
+	})
+	var decode [3][]float64
+	for c := range decode {
+		decode[c] = make([]float64, 1<<16)
+		for i := range decode[c] {
+			decode[c][i] = profile.curves[c](float64(i) / 65535)
+		}
+	}
+	m := srgbToXYZ.inverse().mul(profile.toXYZ)
+
+	// Pixels are converted from their straight alpha colors, then premultiplied again
+	convert := func(px [4]uint32) [3]uint32 {
+		a := px[3]
+		var linear [3]float64
+		for c := 0; c < 3; c++ {
+			linear[c] = decode[c][min32(px[c]*0xffff/a, 0xffff)]
+		}
+		var out [3]uint32
+		for c := 0; c < 3; c++ {
+			v := m[c][0]*linear[0] + m[c][1]*linear[1] + m[c][2]*linear[2]
+			encoded := uint32(srgbEncodeTable[int(clampFloat(v, 0, 1)*65535+0.5)])
+			out[c] = encoded * a / 0xffff
+		}
+		return out
+	}
+
+	bounds := photo.Bounds()
+	switch photo.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		out := image.NewRGBA64(image.Rectangle{Max: bounds.Size()})
+		draw.Draw(out, out.Rect, photo, bounds.Min, draw.Src)
+		for i := 0; i < len(out.Pix); i += 8 {
+			pix := out.Pix[i : i+8]
+			px := [4]uint32{}
+			for c := range px {
+				px[c] = uint32(pix[2*c])<<8 | uint32(pix[2*c+1])
+			}
+			if px[3] == 0 {
+				continue
+			}
+			rgb := convert(px)
+			for c := 0; c < 3; c++ {
+				pix[2*c], pix[2*c+1] = uint8(rgb[c]>>8), uint8(rgb[c])
+			}
+		}
+		return out
+	}
+	out := image.NewRGBA(image.Rectangle{Max: bounds.Size()})
+	draw.Draw(out, out.Rect, photo, bounds.Min, draw.Src)
+	for i := 0; i < len(out.Pix); i += 4 {
+		pix := out.Pix[i : i+4]
+		if pix[3] == 0 {
+			continue
+		}
+		px := [4]uint32{uint32(pix[0]) * 0x101, uint32(pix[1]) * 0x101, uint32(pix[2]) * 0x101, uint32(pix[3]) * 0x101}
+		rgb := convert(px)
+		for c := 0; c < 3; c++ {
+			pix[c] = uint8((rgb[c] + 0x80) / 0x101)
+		}
+	}
+	return out
+}
+
+// srgbICC is the ICC profile embedded in JPEG output with -srgb
+var srgbICC = srgbProfile()
+
+// tagSRGB marks encoded JPEG or PNG data as sRGB, with an embedded sRGB profile for JPEG or an
+// sRGB chunk for PNG
+func tagSRGB(data []byte, format string) []byte {
+	if format == "png" {
+		return insertPNGChunk(data, "sRGB", []byte{0}) // perceptual rendering intent
+	}
+	payload := append([]byte(iccMarker+"\x01\x01"), srgbICC...) // the first of one segment
+	return insertJPEGSegment(data, 0xe2, payload)
+}
+
+// srgbProfile returns an ICC profile for sRGB, embedded in JPEG output to tag it as sRGB
+func srgbProfile() []byte {
+	ascii := func(sig string, text string) []byte {
+		tag := append([]byte(sig+"\x00\x00\x00\x00"), text...)
+		return append(tag, 0)
+	}
+	xyz := func(x, y, z float64) []byte {
+		tag := []byte("XYZ \x00\x00\x00\x00")
+		for _, v := range []float64{x, y, z} {
+			tag = binary.BigEndian.AppendUint32(tag, uint32(int32(math.Round(v*65536))))
+		}
+		return tag
+	}
+	// A version 2 description holds the text in ASCII, followed by empty Unicode and ScriptCode versions
+	desc := []byte("desc\x00\x00\x00\x00")
+	desc = binary.BigEndian.AppendUint32(desc, uint32(len("sRGB")+1))
+	desc = append(desc, "sRGB\x00"...)
+	desc = append(desc, make([]byte, 4+4+2+1+67)...)
+	curve := []byte("curv\x00\x00\x00\x00")
+	const curvePoints = 1024
+	curve = binary.BigEndian.AppendUint32(curve, curvePoints)
+	for i := 0; i < curvePoints; i++ {
+		v := float64(i) / (curvePoints - 1)
+		// The curve decodes, so it is the inverse of srgbEncode
+		curve = binary.BigEndian.AppendUint16(curve, uint16(math.Round(srgbDecode(v)*65535)))
+	}
+
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"desc", desc},
+		{"cprt", ascii("text", "No copyright, use freely")},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"rXYZ", xyz(srgbToXYZ[0][0], srgbToXYZ[1][0], srgbToXYZ[2][0])},
+		{"gXYZ", xyz(srgbToXYZ[0][1], srgbToXYZ[1][1], srgbToXYZ[2][1])},
+		{"bXYZ", xyz(srgbToXYZ[0][2], srgbToXYZ[1][2], srgbToXYZ[2][2])},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	}
+
+	// The tag data follows the header and the tag table, every tag aligned to 4 bytes. The
+	// three tone curves are the same, so they share their data.
+	var body bytes.Buffer
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	start := 128 + 4 + 12*len(tags)
+	offsets := map[*byte]int{}
+	for _, tag := range tags {
+		offset, ok := offsets[&tag.data[0]]
+		if !ok {
+			offset = start + body.Len()
+			offsets[&tag.data[0]] = offset
+			body.Write(tag.data)
+			for body.Len()%4 != 0 {
+				body.WriteByte(0)
+			}
+		}
+		table = append(table, tag.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(tag.data)))
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(start+body.Len()))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000) // version 2.1
+	copy(header[12:], "mntrRGB XYZ ")
+	// A fixed creation date keeps the output reproducible
+	for i, v := range []uint16{2024, 1, 1, 0, 0, 0} {
+		binary.BigEndian.PutUint16(header[24+2*i:], v)
+	}
+	copy(header[36:], "acsp")
+	copy(header[68:], xyz(0.9642, 1, 0.8249)[8:]) // the D50 illuminant of the PCS
+
+	profile := append(header, table...)
+	return append(profile, body.Bytes()...)
+}
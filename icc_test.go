@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+	"testing/fstest"
+)
+
+// displayP3Profile returns the sRGB profile with the primaries of Display P3, adapted to D50
+// like those of the Display P3 profile of Apple. Both share the sRGB tone curve.
+func displayP3Profile() []byte {
+	profile := append([]byte(nil), srgbICC...)
+	primaries := map[string][3]float64{
+		"rXYZ": {0.5151, 0.2412, -0.0011},
+		"gXYZ": {0.2920, 0.6922, 0.0419},
+		"bXYZ": {0.1571, 0.0666, 0.7841},
+	}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count; i++ {
+		entry := profile[132+12*i:]
+		xyz, ok := primaries[string(entry[:4])]
+		if !ok {
+			continue
+		}
+		offset := binary.BigEndian.Uint32(entry[4:])
+		for j, v := range xyz {
+			binary.BigEndian.PutUint32(profile[offset+8+4*uint32(j):], uint32(int32(math.Round(v*65536))))
+		}
+	}
+	return profile
+}
+
+// pngWithProfile encodes img as a PNG file with an iCCP chunk of the given length holding the
+// compressed profile, or of its real length when length is negative
+func pngWithProfile(t *testing.T, img image.Image, profile []byte, length int64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(profile)
+	zw.Close()
+	chunkData := append([]byte("Display P3\x00\x00"), compressed.Bytes()...)
+	data := insertPNGChunk(buf.Bytes(), "iCCP", chunkData)
+	if length >= 0 {
+		binary.BigEndian.PutUint32(data[33:], uint32(length)) // the chunk follows IHDR
+	}
+	return data
+}
+
+func TestConvertDisplayP3(t *testing.T) {
+	tests := []struct {
+		p3, srgb color.RGBA
+	}{
+		{color.RGBA{204, 102, 77, 255}, color.RGBA{219, 95, 69, 255}},
+		{color.RGBA{100, 180, 60, 255}, color.RGBA{65, 182, 27, 255}},
+		{color.RGBA{128, 128, 128, 255}, color.RGBA{128, 128, 128, 255}}, // gray keeps its value
+		{color.RGBA{255, 255, 255, 255}, color.RGBA{255, 255, 255, 255}},
+	}
+	photo := image.NewRGBA(image.Rect(0, 0, len(tests), 1))
+	for i, test := range tests {
+		photo.SetRGBA(i, 0, test.p3)
+	}
+	fsys := fstest.MapFS{"photo.png": {Data: pngWithProfile(t, photo, displayP3Profile(), -1)}}
+
+	data, err := readICCProfile(fsys, "photo.png", "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := parseICCProfile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted := convertToSRGB(photo, profile).(*image.RGBA)
+	near := func(a, b uint8) bool { return math.Abs(float64(a)-float64(b)) <= 2 }
+	for i, test := range tests {
+		got := converted.RGBAAt(i, 0)
+		if !near(got.R, test.srgb.R) || !near(got.G, test.srgb.G) || !near(got.B, test.srgb.B) || got.A != 255 {
+			t.Errorf("Display P3 %v converted to %v, want %v", test.p3, got, test.srgb)
+		}
+	}
+}
+
+func TestReadPNGProfileLimits(t *testing.T) {
+	photo := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	tests := []struct {
+		name    string
+		data    []byte
+		profile bool
+		err     error
+	}{
+		{"valid", pngWithProfile(t, photo, srgbICC, -1), true, nil},
+		{"length of 4 GB", pngWithProfile(t, photo, srgbICC, math.MaxUint32), false, errBadMetadata},
+		{"length over the limit", pngWithProfile(t, photo, srgbICC, maxICCProfile+1), false, errBadMetadata},
+		{"profile over the limit", pngWithProfile(t, photo, make([]byte, maxICCProfile+1), -1), false, errBadMetadata},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"photo.png": {Data: test.data}}
+			profile, err := readICCProfile(fsys, "photo.png", "png")
+			if (profile != nil) != test.profile {
+				t.Errorf("got a profile of %d bytes, want one: %v", len(profile), test.profile)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
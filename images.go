@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/tiff"
+)
+
+var (
+	// errUnsupportedType is returned for files that do not have a supported image extension
+	errUnsupportedType = errors.New("not a .jpg, .jpeg, .png, .tif or .tiff")
+
+	// errNotAnImage is returned when a file's contents are not image data at all,
+	// for example a zero-byte file or a text file renamed to .jpg
+	errNotAnImage = errors.New("not an image")
+
+	// errTooSmall is returned with -min-dimension for photos that are too small to watermark
+	errTooSmall = errors.New("photo too small")
+
+	// errOutputExists is returned with -no-clobber when the output file already exists
+	errOutputExists = errors.New("output already exists")
+
+	// errVerifyFailed is returned with -verify-output when a written output can't be read back
+	errVerifyFailed = errors.New("output failed verification")
+)
+
+// jpegOptions are the encoder settings for every output. They are fixed, so that running
+// twice on the same photos produces byte-identical files which can be compared by hash
+// or stored content-addressed. Any randomised feature must take an explicit seed.
+var jpegOptions = jpeg.Options{Quality: 95}
+
+// jpegEncoders lists the supported values for the -encoder flag. The turbo encoder uses
+// libjpeg-turbo through cgo and needs the jpegturbo build tag.
+var jpegEncoders = []string{"std", "turbo"}
+
+// dctMethods lists the DCT methods of the turbo encoder for the -dct flag. islow is the
+// accurate integer DCT, ifast is faster but less accurate, and float may differ between CPUs.
+var dctMethods = []string{"islow", "ifast", "float"}
+
+// chromaSubsamplings lists the chroma subsampling of the turbo encoder for the -subsampling
+// flag: 444 keeps the colors at full resolution, 420 halves them both ways like the std encoder
+var chromaSubsamplings = []string{"444", "422", "420"}
+
+// avifQuality is the fixed quality (0-100) of AVIF output. The encoder runs single threaded,
+// so the output is reproducible like that of the JPEG encoder.
+const avifQuality = 60
+
+// decodeError is returned when a file looks like an image but could not be decoded
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string { return "failed to decode: " + e.err.Error() }
+func (e *decodeError) Unwrap() error { return e.err }
+
+// sniffFormat returns the image format ("jpeg", "png" or "tiff") identified by the magic bytes
+// at the start of a file, or an empty string if the header is not recognised
+func sniffFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return "tiff"
+	}
+	return ""
+}
+
+// sourceType returns the image format of a photo based on its extension,
+// or an empty string if it is not a supported photo
+func sourceType(fname string) string {
+	switch strings.ToLower(path.Ext(fname)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".png":
+		return "png"
+	case ".tif", ".tiff":
+		return "tiff"
+	}
+	return ""
+}
+
+// outputFormats lists the supported values for the -output-format flag
+var outputFormats = []string{"jpeg", "png", "avif", "tiff"}
+
+// outputName returns the file name of the watermarked version of a photo in the given format.
+// JPEG and TIFF photos keep their name when the output is in their format.
+func outputName(fname string, format string) string {
+	if format == "png" || format == "avif" {
+		return strings.TrimSuffix(fname, path.Ext(fname)) + "." + format
+	}
+	if format == "tiff" {
+		if sourceType(fname) == "tiff" {
+			return fname
+		}
+		return strings.TrimSuffix(fname, path.Ext(fname)) + ".tif"
+	}
+	if sourceType(fname) == "jpeg" {
+		return fname
+	}
+	return strings.TrimSuffix(fname, path.Ext(fname)) + ".jpg"
+}
+
+// saveOptions control how output files are written
+type saveOptions struct {
+	noClobber bool   // fail instead of overwriting an existing file
+	format    string // "jpeg" (the default), "png", "avif" or "tiff"
+	tmpDir    string // directory of the temporary files outputs are written to, empty for the output directory
+	fsync     bool   // flush outputs and their directory entry to disk before moving on
+	srgb      bool   // tag the output as sRGB
+	dpi       int    // print density stored in the output, 0 for none
+	copyright string // stored in JPEG and PNG output, empty for none
+	comment   string // stored in JPEG and PNG output, empty for none
+
+	pngCompression png.CompressionLevel
+	encoder        string     // JPEG encoder, "std" (the default) or "turbo"
+	dct            string     // DCT method of the turbo encoder
+	subsampling    string     // chroma subsampling of the turbo encoder
+	smartQuality   float64    // with -smart-quality, the SSIM JPEG output must reach, 0 for the fixed quality
+	temps          *tempFiles // records the temporary files being written, nil to not record them
+}
+
+// pngCompressionLevels maps the values of the -png-compression flag to encoder settings
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// pngCompressionName returns the -png-compression value of a compression level
+func pngCompressionName(level png.CompressionLevel) string {
+	for name, l := range pngCompressionLevels {
+		if l == level {
+			return name
+		}
+	}
+	return "default"
+}
+
+// savedFile describes a file written by saveImage
+type savedFile struct {
+	size    int64  // in bytes
+	quality string // the encoder setting used, see encodeImage
+}
+
+// saveImage writes img to fname in the directory pname. It is written to a temporary file
+// first and then moved into place, so the output is either complete or not there at all.
+func saveImage(ctx context.Context, img image.Image, pname, fname string, opts saveOptions) (savedFile, error) {
+	return saveFile(ctx, pname, fname, opts, func(w io.Writer) (string, error) {
+		return encodeImage(w, img, opts)
+	})
+}
+
+// saveFile writes the output of encode to fname in the directory pname the way saveImage does,
+// and returns what encode returns as its quality. When ctx is done before the output is moved
+// into place, such as for a photo that took longer than -file-timeout, the temporary file is
+// removed instead and the output never appears.
+func saveFile(ctx context.Context, pname, fname string, opts saveOptions, encode func(w io.Writer) (string, error)) (savedFile, error) {
+	fpath := path.Join(pname, fname)
+	if opts.noClobber {
+		// Checked before encoding to save the work, commitTemp checks again
+		if _, err := os.Lstat(fpath); err == nil {
+			return savedFile{}, fmt.Errorf("%w: '%s'", errOutputExists, fpath)
+		}
+	}
+	outputFile, err := createTemp(fpath, opts.tmpDir)
+	if err != nil {
+		return savedFile{}, fmt.Errorf("failed to create: %w", err)
+	}
+	opts.temps.add(outputFile.Name())
+	defer opts.temps.remove(outputFile.Name())
+
+	quality, err := encode(outputFile)
+	var size int64
+	if err == nil {
+		size, err = outputFile.Seek(0, io.SeekCurrent)
+	}
+	if err == nil && opts.fsync {
+		err = outputFile.Sync()
+	}
+	if closeErr := outputFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		os.Remove(outputFile.Name())
+		return savedFile{}, err
+	}
+	if err := commitTemp(outputFile.Name(), fpath, opts.noClobber); err != nil {
+		return savedFile{}, err
+	}
+	if opts.fsync {
+		if err := syncDir(pname); err != nil {
+			return savedFile{}, fmt.Errorf("failed to sync folder: %w", err)
+		}
+	}
+	return savedFile{size, quality}, nil
+}
+
+// verifyOutput decodes the output file fname in the directory pname again, and returns an
+// error when it isn't a complete image of the same size, and for TIFF output with the same
+// pages, as img
+func verifyOutput(img image.Image, pname, fname string, format string) error {
+	fsys := os.DirFS(pname)
+	pages := []image.Image{img}
+	if stack, ok := img.(*multiPage); ok {
+		pages = stack.pages
+	}
+	var read []image.Image
+	var err error
+	if format == "tiff" {
+		read, err = readTIFFPages(fsys, fname)
+	} else {
+		var decoded image.Image
+		decoded, err = openImage(fsys, fname, format)
+		read = []image.Image{decoded}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", errVerifyFailed, err)
+	}
+	if len(read) != len(pages) {
+		return fmt.Errorf("%w: it has %d pages instead of %d", errVerifyFailed, len(read), len(pages))
+	}
+	for i, page := range pages {
+		want, got := page.Bounds().Size(), read[i].Bounds().Size()
+		if got != want {
+			return fmt.Errorf("%w: it is %dx%d instead of %dx%d", errVerifyFailed, got.X, got.Y, want.X, want.Y)
+		}
+	}
+	return nil
+}
+
+// encodeImage writes img to w in the output format of opts. It returns the encoder setting
+// that was used: the quality for JPEG and AVIF, or the compression for PNG and TIFF. All
+// pages of a multi-page TIFF photo are written to TIFF output, other formats only have one.
+func encodeImage(w io.Writer, img image.Image, opts saveOptions) (string, error) {
+	if opts.format == "tiff" {
+		pages := []image.Image{img}
+		if stack, ok := img.(*multiPage); ok {
+			pages = stack.pages
+		}
+		if err := encodeTIFF(w, pages, opts.dpi, opts.srgb); err != nil {
+			return "", fmt.Errorf("failed to encode: %w", err)
+		}
+		return "deflate", nil
+	}
+	if (opts.srgb || opts.dpi > 0 || opts.copyright != "" || opts.comment != "") && opts.format != "avif" {
+		// The metadata is added to the encoded data. AVIF output is sRGB without a tag, and
+		// has no density.
+		var buf bytes.Buffer
+		plain := opts
+		plain.srgb, plain.dpi, plain.copyright, plain.comment = false, 0, "", ""
+		quality, err := encodeImage(&buf, img, plain)
+		if err != nil {
+			return "", err
+		}
+		data := addTextMetadata(buf.Bytes(), opts.format, opts.copyright, opts.comment)
+		if opts.srgb {
+			data = tagSRGB(data, opts.format)
+		}
+		if opts.dpi > 0 {
+			data = setDensity(data, opts.format, opts.dpi)
+		}
+		_, err = w.Write(data)
+		return quality, err
+	}
+	var err error
+	quality := strconv.Itoa(jpegOptions.Quality)
+	if opts.format == "png" {
+		encoder := png.Encoder{CompressionLevel: opts.pngCompression}
+		err = encoder.Encode(w, img)
+		quality = pngCompressionName(opts.pngCompression)
+	} else if opts.format == "avif" {
+		err = encodeAVIF(w, img)
+		quality = strconv.Itoa(avifQuality)
+	} else if opts.encoder == "turbo" {
+		err = encodeTurboJPEG(w, img, jpegOptions.Quality, opts.dct, opts.subsampling)
+	} else if opts.smartQuality > 0 {
+		var q int
+		q, err = encodeSmartJPEG(w, img, opts.smartQuality)
+		quality = strconv.Itoa(q)
+	} else {
+		err = jpeg.Encode(w, img, &jpegOptions)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encode: %w", err)
+	}
+	return quality, nil
+}
+
+// mimeTypes maps the output formats to their MIME type
+var mimeTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"avif": "image/avif",
+	"tiff": "image/tiff",
+}
+
+// openSource opens a photo in fsys for reading, after checking its contents really are ftype image data
+func openSource(fsys fs.FS, fname string, ftype string) (fs.File, *bufio.Reader, error) {
+	inputfile, err := fsys.Open(fname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open: %w", err)
+	}
+
+	reader := bufio.NewReader(inputfile)
+	header, _ := reader.Peek(8)
+	if len(header) == 0 {
+		inputfile.Close()
+		return nil, nil, fmt.Errorf("%w: file is empty", errNotAnImage)
+	}
+	if format := sniffFormat(header); format != ftype {
+		inputfile.Close()
+		return nil, nil, fmt.Errorf("%w: contents are not %s data", errNotAnImage, ftype)
+	}
+	return inputfile, reader, nil
+}
+
+// imageConfig reads the dimensions of a photo from its header, without decoding the pixels
+func imageConfig(fsys fs.FS, fname string, ftype string) (image.Config, error) {
+	inputfile, reader, err := openSource(fsys, fname, ftype)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer inputfile.Close()
+
+	var config image.Config
+	if ftype == "jpeg" {
+		config, err = jpeg.DecodeConfig(reader)
+	} else if ftype == "png" {
+		config, err = png.DecodeConfig(reader)
+	} else if ftype == "tiff" {
+		config, err = tiff.DecodeConfig(reader)
+	}
+	if err != nil {
+		return image.Config{}, &decodeError{err}
+	}
+	return config, nil
+}
+
+func openImage(fsys fs.FS, fname string, ftype string) (image.Image, error) {
+	inputfile, reader, err := openSource(fsys, fname, ftype)
+	if err != nil {
+		return nil, err
+	}
+	defer inputfile.Close()
+
+	var srcimage image.Image
+	if ftype == "jpeg" {
+		srcimage, err = jpeg.Decode(reader)
+	} else if ftype == "png" {
+		srcimage, err = png.Decode(reader)
+	} else if ftype == "tiff" {
+		srcimage, err = tiff.Decode(reader)
+	}
+	if err != nil {
+		return nil, &decodeError{err}
+	}
+	return srcimage, nil
+}
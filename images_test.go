@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"testing/fstest"
+)
+
+// TestBrokenSources checks that files that are not images are skipped with a reason of their
+// own, instead of failing the run
+func TestBrokenSources(t *testing.T) {
+	var jpegData, pngData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, testPhoto(32, 24), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngData, testPhoto(32, 24)); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"photo.jpg":     {Data: jpegData.Bytes()},
+		"empty.jpg":     {Data: nil},
+		"notes.jpg":     {Data: []byte("shopping list: milk, eggs")},
+		"png.jpg":       {Data: pngData.Bytes()},
+		"truncated.jpg": {Data: jpegData.Bytes()[:len(jpegData.Bytes())/2]},
+		"truncated.png": {Data: pngData.Bytes()[:40]},
+		"notes.txt":     {Data: []byte("shopping list: milk, eggs")},
+	}
+	tests := []struct {
+		fname  string
+		reason string // skipReason of the error, "" for a photo that can be read
+	}{
+		{"photo.jpg", ""},
+		{"empty.jpg", "not an image"},
+		{"notes.jpg", "not an image"},
+		{"png.jpg", "not an image"},
+		{"truncated.jpg", "decode error"},
+		{"truncated.png", "decode error"},
+		{"notes.txt", "unsupported type"},
+	}
+	for _, test := range tests {
+		t.Run(test.fname, func(t *testing.T) {
+			// Like processFile, other file types are not opened at all
+			ftype := sourceType(test.fname)
+			err := errUnsupportedType
+			if ftype != "" {
+				_, err = imageConfig(fsys, test.fname, ftype)
+			}
+			if err == nil {
+				_, err = openImage(fsys, test.fname, ftype)
+			}
+			if test.reason == "" {
+				if err != nil {
+					t.Errorf("Got error %s, want none", err)
+				}
+			} else if err == nil {
+				t.Errorf("Got no error, want %s", test.reason)
+			} else if reason := skipReason(err); reason != test.reason {
+				t.Errorf("Got reason %s for %s, want %s", reason, err, test.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// previewWidth is the width of the -interactive preview in terminal columns. Every character
+// shows two pixels above each other, with the upper half block in their two colors.
+const previewWidth = 64
+
+// tune runs the -interactive mode before a batch: it shows the first photo watermarked with the
+// current settings in the terminal, and lets the user change the opacity, scale and location
+// until they start the batch with them. It returns false when the user quits instead. The
+// commands are read a line at a time, the terminal is not switched to single key presses.
+func (b *batch) tune(file sourceFile) bool {
+	fname := path.Join(b.sourceRoot, file.relPath)
+	photo, err := openImage(b.source, fname, sourceType(file.Name()))
+	if err != nil {
+		console.Printf("ERROR: Could not read photo '%s' for the preview: %s\n", file.relPath, err)
+		return false
+	}
+	photo = rotate(photo, b.params.rotateSource)
+	// The watermark is sized relative to the photo, so the preview can be rendered small
+	photo = resizeToFit(photo, previewWidth*4)
+
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		b.preview(file, photo)
+		console.Screen("Type 'opacity 50', 'scale 0.3' or 'location left' and press Enter to change, 'go' to start or 'quit': ")
+		if !input.Scan() {
+			console.Screen("\n")
+			return false
+		}
+		command, value, _ := strings.Cut(strings.TrimSpace(input.Text()), " ")
+		value = strings.TrimSpace(value)
+		switch command {
+		case "go":
+			console.Printf("Starting with opacity %s, scale %s and location %s\n", b.tunedOpacity(), b.params.scale.String(), b.params.location)
+			return true
+		case "quit":
+			return false
+		case "opacity":
+			if fixed := b.fixedOpacity(); fixed != "" {
+				console.Screen(fmt.Sprintf("The opacity can not be changed here, it is set by %s\n", fixed))
+				continue
+			}
+			opacity, err := strconv.Atoi(value)
+			if err != nil || opacity < 0 || opacity > 100 {
+				console.Screen("The opacity must be a number between 0 and 100\n")
+				continue
+			}
+			if b.params.location == "tile" {
+				b.params.tileOpacity = opacity
+			} else {
+				b.params.opacity = opacity
+			}
+		case "scale":
+			scale, err := parseScale(value)
+			if err != nil {
+				console.Screen(err.Error() + "\n")
+				continue
+			}
+			b.params.scale = scaleFlag(scale)
+		case "location":
+			if !contains(locations, value) {
+				console.Screen(fmt.Sprintf("Unknown location '%s', use one of [%s]\n", value, strings.Join(locations, ", ")))
+				continue
+			}
+			if value == "tile" && (b.params.alternate || b.params.bar) {
+				console.Screen("The tile location can not be used with -alternate or -bar\n")
+				continue
+			}
+			b.params.location = value
+		default:
+			console.Screen(fmt.Sprintf("Unknown command '%s'\n", command))
+		}
+	}
+}
+
+// fixedOpacity returns the options that set the opacity of the preview instead of -opacity, so
+// the opacity command would change nothing, or "" when there are none
+func (b *batch) fixedOpacity() string {
+	switch {
+	case b.renditions[0].opacity >= 0:
+		return "-proof-opacity and -final-opacity"
+	case b.params.opacityRamp:
+		return "-ramp-start and -ramp-end of -opacity-ramp"
+	case b.params.adaptiveOpacity != "off":
+		return "-adaptive-min and -adaptive-max of -adaptive-opacity"
+	}
+	return ""
+}
+
+// tunedOpacity describes the opacity of the preview for tune
+func (b *batch) tunedOpacity() string {
+	switch {
+	case b.renditions[0].opacity >= 0:
+		return strconv.Itoa(b.renditions[0].opacity)
+	case b.params.opacityRamp:
+		return fmt.Sprintf("ramping from %d to %d", b.params.rampStart, b.params.rampEnd)
+	case b.params.adaptiveOpacity != "off":
+		return fmt.Sprintf("%d-%d adapted to %s areas", b.params.adaptiveMin, b.params.adaptiveMax, b.params.adaptiveOpacity)
+	case b.params.location == "tile":
+		return strconv.Itoa(b.params.tileOpacity)
+	}
+	return strconv.Itoa(b.params.opacity)
+}
+
+// preview prints the photo watermarked with the current settings to the terminal, in 24-bit
+// colors
+func (b *batch) preview(file sourceFile, photo image.Image) {
+	output, _ := b.render(photo, b.renditions[0], b.photoSettings(file))
+	thumb := toRGBA(resizeToFit(output, previewWidth))
+	var sb strings.Builder
+	sb.WriteString("\n")
+	bounds := thumb.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 2 {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			top := thumb.RGBAAt(x, y)
+			bottom := top
+			if y+1 < bounds.Max.Y {
+				bottom = thumb.RGBAAt(x, y+1)
+			}
+			fmt.Fprintf(&sb, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+		}
+		sb.WriteString("\x1b[0m\n")
+	}
+	fmt.Fprintf(&sb, "Photo '%s' with opacity %s, scale %s and location %s\n", file.relPath, b.tunedOpacity(), b.params.scale.String(), b.params.location)
+	console.Screen(sb.String())
+}
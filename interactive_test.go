@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestTunedOpacity(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    parameters
+		rendition rendition
+		wantFixed bool
+		wantTuned string
+	}{
+		{"opacity", parameters{opacity: 70, tileOpacity: 20, location: "br", adaptiveOpacity: "off"}, rendition{opacity: -1}, false, "70"},
+		{"tile", parameters{opacity: 70, tileOpacity: 20, location: "tile", adaptiveOpacity: "off"}, rendition{opacity: -1}, false, "20"},
+		{"ramp", parameters{opacity: 70, opacityRamp: true, rampStart: 40, rampEnd: 90, adaptiveOpacity: "off"}, rendition{opacity: -1}, true, "ramping from 40 to 90"},
+		{"adaptive", parameters{opacity: 70, adaptiveOpacity: "bright", adaptiveMin: 30, adaptiveMax: 90}, rendition{opacity: -1}, true, "30-90 adapted to bright areas"},
+		{"proof", parameters{opacity: 70, adaptiveOpacity: "off"}, rendition{opacity: 35, proof: true}, true, "35"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &batch{params: test.params, renditions: []rendition{test.rendition}}
+			if fixed := b.fixedOpacity(); (fixed != "") != test.wantFixed {
+				t.Errorf("Got fixed opacity %q, want fixed %v", fixed, test.wantFixed)
+			}
+			if tuned := b.tunedOpacity(); tuned != test.wantTuned {
+				t.Errorf("Got opacity %q, want %q", tuned, test.wantTuned)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+//go:build jpegturbo
+
+package main
+
+/*
+#cgo pkg-config: libjpeg
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <setjmp.h>
+#include <jpeglib.h>
+
+// error_mgr makes libjpeg return from encode_jpeg on errors, instead of exiting the process
+struct error_mgr {
+	struct jpeg_error_mgr pub;
+	jmp_buf jump;
+};
+
+static void error_exit(j_common_ptr cinfo) {
+	longjmp(((struct error_mgr *)cinfo->err)->jump, 1);
+}
+
+// encode_jpeg encodes 8 bit RGBA pixels, ignoring alpha, as JPEG into out, which the caller
+// frees. It returns 0 and the error in message on failure.
+static int encode_jpeg(unsigned char *pixels, int width, int height, int stride, int quality,
+		int dct, int h_samp, int v_samp, unsigned char **out, unsigned long *size, char *message) {
+	struct jpeg_compress_struct cinfo;
+	struct error_mgr err;
+	cinfo.err = jpeg_std_error(&err.pub);
+	err.pub.error_exit = error_exit;
+	if (setjmp(err.jump)) {
+		(*cinfo.err->format_message)((j_common_ptr)&cinfo, message);
+		jpeg_destroy_compress(&cinfo);
+		return 0;
+	}
+	jpeg_create_compress(&cinfo);
+	jpeg_mem_dest(&cinfo, out, size);
+	cinfo.image_width = width;
+	cinfo.image_height = height;
+	cinfo.input_components = 4;
+	cinfo.in_color_space = JCS_EXT_RGBX;
+	jpeg_set_defaults(&cinfo);
+	jpeg_set_quality(&cinfo, quality, TRUE);
+	cinfo.dct_method = dct;
+	cinfo.comp_info[0].h_samp_factor = h_samp;
+	cinfo.comp_info[0].v_samp_factor = v_samp;
+	jpeg_start_compress(&cinfo, TRUE);
+	while (cinfo.next_scanline < cinfo.image_height) {
+		JSAMPROW row = pixels + (size_t)cinfo.next_scanline * stride;
+		jpeg_write_scanlines(&cinfo, &row, 1);
+	}
+	jpeg_finish_compress(&cinfo);
+	jpeg_destroy_compress(&cinfo);
+	return 1;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"unsafe"
+)
+
+// turboSupported reports whether this build has the libjpeg-turbo encoder, which needs cgo
+const turboSupported = true
+
+// dctMethodValues maps the -dct values to the libjpeg DCT methods
+var dctMethodValues = map[string]C.int{
+	"islow": C.JDCT_ISLOW,
+	"ifast": C.JDCT_IFAST,
+	"float": C.JDCT_FLOAT,
+}
+
+// subsamplingFactors maps the -subsampling values to the sampling factors of the luminance,
+// relative to the colors
+var subsamplingFactors = map[string][2]C.int{
+	"444": {1, 1},
+	"422": {2, 1},
+	"420": {2, 2},
+}
+
+// encodeTurboJPEG writes img to w as JPEG using libjpeg-turbo, with the given DCT method and
+// chroma subsampling
+func encodeTurboJPEG(w io.Writer, img image.Image, quality int, dct, subsampling string) error {
+	rgba := toRGBA(img)
+	if rgba.Rect.Empty() {
+		return fmt.Errorf("can not encode an empty image as JPEG")
+	}
+	factors := subsamplingFactors[subsampling]
+	var out *C.uchar
+	var size C.ulong
+	var message [C.JMSG_LENGTH_MAX]C.char
+	ok := C.encode_jpeg((*C.uchar)(unsafe.Pointer(&rgba.Pix[0])), C.int(rgba.Rect.Dx()), C.int(rgba.Rect.Dy()),
+		C.int(rgba.Stride), C.int(quality), dctMethodValues[dct], factors[0], factors[1], &out, &size, &message[0])
+	if out != nil {
+		defer C.free(unsafe.Pointer(out))
+	}
+	if ok == 0 {
+		return fmt.Errorf("libjpeg: %s", C.GoString(&message[0]))
+	}
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out), C.int(size)))
+	return err
+}
@@ -0,0 +1,17 @@
+//go:build !jpegturbo
+
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// turboSupported reports whether this build has the libjpeg-turbo encoder, which needs cgo
+const turboSupported = false
+
+// encodeTurboJPEG is not available without the jpegturbo build tag
+func encodeTurboJPEG(w io.Writer, img image.Image, quality int, dct, subsampling string) error {
+	return errors.New("the turbo JPEG encoder is not supported by this build, rebuild with -tags jpegturbo")
+}
@@ -0,0 +1,23 @@
+//go:build !jpegturbo
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestTurboJPEGUnsupported checks that a build without the jpegturbo tag rejects the turbo
+// encoder before processing anything
+func TestTurboJPEGUnsupported(t *testing.T) {
+	if err := encodeTurboJPEG(&bytes.Buffer{}, testPhoto(8, 8), 95, "islow", "420"); err == nil || !strings.Contains(err.Error(), "-tags jpegturbo") {
+		t.Errorf("Got error %v, want an error naming the build tag", err)
+	}
+
+	dir := t.TempDir()
+	newTestSource(t, dir)
+	if code, out := runTool(t, dir, nil, "-source", "photos", "-target", "target", "-encoder", "turbo"); code != exitUsage {
+		t.Errorf("Got exit code %d, want %d:\n%s", code, exitUsage, out)
+	}
+}
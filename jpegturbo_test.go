@@ -0,0 +1,60 @@
+//go:build jpegturbo
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeTurboJPEG(t *testing.T) {
+	subsamplings := map[string]image.YCbCrSubsampleRatio{
+		"444": image.YCbCrSubsampleRatio444,
+		"422": image.YCbCrSubsampleRatio422,
+		"420": image.YCbCrSubsampleRatio420,
+	}
+	photo := testPhoto(64, 48)
+	for _, dct := range dctMethods {
+		for _, subsampling := range chromaSubsamplings {
+			t.Run(dct+" "+subsampling, func(t *testing.T) {
+				var out bytes.Buffer
+				if err := encodeTurboJPEG(&out, photo, 95, dct, subsampling); err != nil {
+					t.Fatal(err)
+				}
+				img, err := jpeg.Decode(&out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ycbcr, ok := img.(*image.YCbCr)
+				if !ok {
+					t.Fatalf("Decoded a %T, want an *image.YCbCr", img)
+				}
+				if ycbcr.Rect.Size() != photo.Rect.Size() {
+					t.Errorf("Got size %v, want %v", ycbcr.Rect.Size(), photo.Rect.Size())
+				}
+				if ycbcr.SubsampleRatio != subsamplings[subsampling] {
+					t.Errorf("Got subsampling %v, want %v", ycbcr.SubsampleRatio, subsamplings[subsampling])
+				}
+				// At quality 95 the colors stay close to the photo
+				got := toRGBA(img).RGBAAt(32, 24)
+				if want := photo.RGBAAt(32, 24); !nearColor(got, want, 12) {
+					t.Errorf("Got color %v, want about %v", got, want)
+				}
+			})
+		}
+	}
+	// libjpeg writes a JFIF segment of its own, which -dpi replaces
+	var out bytes.Buffer
+	if _, err := encodeImage(&out, photo, saveOptions{encoder: "turbo", dct: "islow", subsampling: "420", dpi: 300}); err != nil {
+		t.Fatal(err)
+	}
+	if got := jfifDensities(t, out.Bytes()); !reflect.DeepEqual(got, []int{300}) {
+		t.Errorf("Got JFIF densities %v with -dpi 300, want [300]", got)
+	}
+	if err := encodeTurboJPEG(&bytes.Buffer{}, image.NewRGBA(image.Rectangle{}), 95, "islow", "420"); err == nil {
+		t.Error("An empty image was encoded")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// anchors are the cells of the anchor grid the watermark can be placed in, named by their row
+// (top, middle, bottom) and column (left, center, right)
+var anchors = []string{"tl", "tc", "tr", "ml", "mc", "mr", "bl", "bc", "br"}
+
+// anchorAliases are the older names of the corners of the anchor grid
+var anchorAliases = map[string]string{"left": "bl", "right": "br", "top-left": "tl", "top-right": "tr"}
+
+// locations lists the supported values for the -location flag
+var locations = append([]string{"left", "right", "top-left", "top-right", "smart", "auto-corner", "tile"}, anchors...)
+
+// corners are the candidate locations considered by the smart location
+var corners = []string{"left", "right", "top-left", "top-right"}
+
+// bottomCorners are the candidate locations considered by the auto-corner location, which
+// only picks between the two traditional corners and measures half as much of the photo
+var bottomCorners = []string{"left", "right"}
+
+// placement fine-tunes where the watermark goes in its corner. All values are fractions of the
+// canvas size, so the watermark keeps the same relative position on photos of any resolution.
+// Only the nudge of -anchor is in pixels.
+type placement struct {
+	offsetX, offsetY float64     // distance the watermark is moved in from its corner
+	nudge            image.Point // further distance in pixels
+	safeZone         float64     // margin along every edge the watermark never enters
+}
+
+// alternateLocation returns the left version of location, or with right the right version,
+// so -alternate mirrors the chosen corner. Cells of the anchor grid keep their row.
+func alternateLocation(location string, right bool) string {
+	if contains(anchors, location) {
+		if right {
+			return location[:1] + "r"
+		}
+		return location[:1] + "l"
+	}
+	top := strings.HasPrefix(location, "top-")
+	switch {
+	case top && right:
+		return "top-right"
+	case top:
+		return "top-left"
+	case right:
+		return "right"
+	}
+	return "left"
+}
+
+// computeOffset returns the position of the top left corner of the watermark on the canvas,
+// in a cell of the anchor grid or one of its aliases, where left and right are the bottom
+// corners. Other locations get the bottom right corner. The watermark is moved in from the
+// edges of its cell by the offsets and nudge of p, and right and down in the center row and
+// column, and then kept out of the safe zone along the edges.
+func computeOffset(canvas image.Rectangle, watermark image.Rectangle, location string, p placement) image.Point {
+	wmSize := watermark.Size()
+	inset := image.Point{
+		int(math.Round(p.offsetX * float64(canvas.Dx()))),
+		int(math.Round(p.offsetY * float64(canvas.Dy()))),
+	}.Add(p.nudge)
+	if alias, ok := anchorAliases[location]; ok {
+		location = alias
+	}
+	if !contains(anchors, location) {
+		location = "br"
+	}
+	row, column := strings.IndexByte("tmb", location[0]), strings.IndexByte("lcr", location[1])
+	// The room left around the watermark, which the cell splits as 0, a half or all of it
+	room := canvas.Size().Sub(wmSize)
+	direction := func(i int) int {
+		if i == 2 {
+			return -1
+		}
+		return 1
+	}
+	offset := image.Point{
+		canvas.Min.X + column*room.X/2 + direction(column)*inset.X,
+		canvas.Min.Y + row*room.Y/2 + direction(row)*inset.Y,
+	}
+	if p.safeZone <= 0 {
+		return offset
+	}
+
+	// A watermark larger than the safe rectangle is kept at its top left corner
+	margin := image.Point{
+		int(math.Ceil(p.safeZone * float64(canvas.Dx()))),
+		int(math.Ceil(p.safeZone * float64(canvas.Dy()))),
+	}
+	safe := image.Rectangle{Min: canvas.Min.Add(margin), Max: canvas.Max.Sub(margin)}
+	return image.Point{
+		clampInt(offset.X, safe.Min.X, maxInt(safe.Min.X, safe.Max.X-wmSize.X)),
+		clampInt(offset.Y, safe.Min.Y, maxInt(safe.Min.Y, safe.Max.Y-wmSize.Y)),
+	}
+}
+
+// tileOffsets returns the positions of the top left corners of copies of the watermark that
+// repeat over the whole canvas, with half the watermark size between them. The pattern is
+// centered, so it is cut off evenly along the edges.
+func tileOffsets(canvas image.Rectangle, watermark image.Rectangle) []image.Point {
+	wmSize := watermark.Size()
+	if wmSize.X <= 0 || wmSize.Y <= 0 {
+		return nil
+	}
+	gap := wmSize.Div(2)
+	step := wmSize.Add(gap)
+	count := image.Point{canvas.Dx()/step.X + 2, canvas.Dy()/step.Y + 2}
+	start := canvas.Min.Add(canvas.Size().Sub(image.Point{count.X*step.X - gap.X, count.Y*step.Y - gap.Y}).Div(2))
+	offsets := make([]image.Point, 0, count.X*count.Y)
+	for y := 0; y < count.Y; y++ {
+		for x := 0; x < count.X; x++ {
+			offsets = append(offsets, start.Add(image.Point{x * step.X, y * step.Y}))
+		}
+	}
+	return offsets
+}
+
+// smartOffset places the watermark in the one of the candidate corners of the canvas with the
+// least detail, so it is less likely to cover the subject of the photo. Detail is scored as
+// the variance of the luminance under the watermark.
+func smartOffset(canvas *image.RGBA, watermark image.Rectangle, p placement, candidates []string) image.Point {
+	best := image.Point{}
+	bestScore := math.Inf(1)
+	for _, corner := range candidates {
+		offset := computeOffset(canvas.Rect, watermark, corner, p)
+		score := luminanceVariance(canvas, image.Rectangle{Max: watermark.Size()}.Add(offset))
+		if score < bestScore {
+			best, bestScore = offset, score
+		}
+	}
+	return best
+}
+
+// luminanceVariance returns the variance of the luminance of the pixels of img within r
+func luminanceVariance(img *image.RGBA, r image.Rectangle) float64 {
+	r = r.Intersect(img.Rect)
+	if r.Empty() {
+		return math.Inf(1)
+	}
+	var sum, sumSquares float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			l := luminance(img.Pix[img.PixOffset(x, y):])
+			sum += l
+			sumSquares += l * l
+		}
+	}
+	n := float64(r.Dx() * r.Dy())
+	mean := sum / n
+	return sumSquares/n - mean*mean
+}
+
+// meanLuminance returns the average luminance (0-255) of the pixels of img within r
+func meanLuminance(img *image.RGBA, r image.Rectangle) float64 {
+	r = r.Intersect(img.Rect)
+	if r.Empty() {
+		return 0
+	}
+	var sum float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sum += luminance(img.Pix[img.PixOffset(x, y):])
+		}
+	}
+	return sum / float64(r.Dx()*r.Dy())
+}
+
+// luminance returns the Rec. 709 luma (0-255) of the RGBA pixel at the start of pix
+func luminance(pix []uint8) float64 {
+	return 0.2126*float64(pix[0]) + 0.7152*float64(pix[1]) + 0.0722*float64(pix[2])
+}
+
+// padToAspect returns the smallest size that contains size and has the given aspect ratio
+func padToAspect(size image.Point, aspect aspectFlag) image.Point {
+	if size.X*aspect.h > size.Y*aspect.w {
+		// Too wide: add bars above and below
+		return image.Point{size.X, (size.X*aspect.h + aspect.w - 1) / aspect.w}
+	}
+	// Too tall: add bars left and right
+	return image.Point{(size.Y*aspect.w + aspect.h - 1) / aspect.h, size.Y}
+}
+
+// scaleModes lists the supported values for the -scale-mode flag
+var scaleModes = []string{"height", "width", "longest", "shortest", "area", "megapixels"}
+
+// watermarkSize returns the size of the watermark on a canvas, keeping the aspect ratio of
+// the watermark. The scale is a fraction of the canvas dimension selected by mode:
+//   - height, width: the watermark's height (or width) is that fraction of the canvas' height (width)
+//   - longest, shortest: as height or width, for whichever is the canvas' longest (shortest) side
+//   - area: the watermark covers that fraction of the canvas' area
+//   - megapixels: the watermark's height is that fraction of the square root of the canvas' area,
+//     so it looks the same size on photos of any resolution and aspect ratio
+func watermarkSize(canvas image.Point, watermark image.Point, scale float64, mode string) image.Point {
+	if watermark.X <= 0 || watermark.Y <= 0 {
+		return image.Point{}
+	}
+	aspect := float64(watermark.X) / float64(watermark.Y)
+	landscape := canvas.X >= canvas.Y
+	if mode == "longest" && landscape || mode == "shortest" && !landscape {
+		mode = "width"
+	} else if mode == "longest" || mode == "shortest" {
+		mode = "height"
+	}
+
+	var height float64
+	switch mode {
+	case "width":
+		height = scale * float64(canvas.X) / aspect
+	case "area":
+		height = math.Sqrt(scale * float64(canvas.X) * float64(canvas.Y) / aspect)
+	case "megapixels":
+		height = scale * math.Sqrt(float64(canvas.X)*float64(canvas.Y))
+	default:
+		height = scale * float64(canvas.Y)
+	}
+	return image.Point{int(math.Round(height * aspect)), int(height)}
+}
+
+// referenceWatermarkSize returns the size of the watermark on a canvas with -reference-resolution:
+// it is sized by watermarkSize on a canvas of the reference resolution, which is then scaled to
+// fit the canvas. Every photo gets a watermark of the same size relative to that scaled
+// reference, so the watermark keeps its proportions on photos cropped to another aspect ratio
+// with every scale mode, where per photo scaling would size it from the cropped dimensions.
+func referenceWatermarkSize(canvas, reference, watermark image.Point, scale float64, mode string) image.Point {
+	size := watermarkSize(reference, watermark, scale, mode)
+	factor := math.Min(float64(canvas.X)/float64(reference.X), float64(canvas.Y)/float64(reference.Y))
+	return image.Point{int(math.Round(factor * float64(size.X))), int(math.Round(factor * float64(size.Y)))}
+}
+
+// fitToBox returns the largest size of the watermark, keeping its aspect ratio, that fits
+// within box. The result does not depend on the photo, so logos are the same size on all photos.
+func fitToBox(watermark image.Point, box image.Point) image.Point {
+	if watermark.X <= 0 || watermark.Y <= 0 {
+		return image.Point{}
+	}
+	factor := math.Min(float64(box.X)/float64(watermark.X), float64(box.Y)/float64(watermark.Y))
+	return image.Point{int(math.Round(factor * float64(watermark.X))), int(math.Round(factor * float64(watermark.Y)))}
+}
+
+// scaleWatermark resizes the watermark to the given size, an SVG watermark is rendered at that
+// size instead. With noUpscale a watermark that is already small enough is returned untouched.
+// Nearest neighbor scaling copies whole pixels, so an *image.NRGBA watermark stays one with
+// the straight alpha of the file and no colors are mixed across its transparent edges.
+func scaleWatermark(watermark image.Image, size image.Point, noUpscale bool) image.Image {
+	if noUpscale && size.Y >= watermark.Bounds().Dy() {
+		return watermark
+	}
+	if svg, ok := watermark.(*svgWatermark); ok {
+		return svg.render(size)
+	}
+	return resize.Resize(uint(size.X), uint(size.Y), watermark, resize.NearestNeighbor)
+}
+
+// resizeForPrint scales a photo to fit a print of the given size in inches at dpi dots per
+// inch, e.g. 2400x3000 pixels for 8x10 inches at 300 DPI. The print is turned to the orientation
+// of the photo, and the photo keeps its aspect ratio, so it only fills the whole print when the
+// ratios match. Unlike resizeToFit, photos are enlarged when needed.
+func resizeForPrint(photo image.Image, print printSizeFlag, dpi int) image.Image {
+	size := photo.Bounds().Size()
+	long, short := math.Max(print.width, print.height), math.Min(print.width, print.height)
+	box := image.Point{int(math.Round(long * float64(dpi))), int(math.Round(short * float64(dpi)))}
+	if size.X < size.Y {
+		box.X, box.Y = box.Y, box.X
+	}
+	target := fitToBox(size, box)
+	if target == size {
+		return photo
+	}
+	return resize.Resize(uint(target.X), uint(target.Y), photo, resize.Lanczos3)
+}
+
+// resizeToFit scales a photo down so its longest side is at most maxSize pixels.
+// Photos that already fit are returned as they are, they are never enlarged.
+func resizeToFit(photo image.Image, maxSize int) image.Image {
+	size := photo.Bounds().Size()
+	if size.X <= maxSize && size.Y <= maxSize {
+		return photo
+	}
+	if size.X >= size.Y {
+		return resize.Resize(uint(maxSize), 0, photo, resize.Lanczos3)
+	}
+	return resize.Resize(0, uint(maxSize), photo, resize.Lanczos3)
+}
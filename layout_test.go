@@ -0,0 +1,110 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestWatermarkSize(t *testing.T) {
+	landscape, portrait := image.Point{1000, 500}, image.Point{500, 1000}
+	watermark := image.Point{200, 100}
+	tests := []struct {
+		mode                string
+		landscape, portrait image.Point
+	}{
+		{"height", image.Point{200, 100}, image.Point{400, 200}},
+		{"width", image.Point{200, 100}, image.Point{100, 50}},
+		{"longest", image.Point{200, 100}, image.Point{400, 200}},
+		{"shortest", image.Point{200, 100}, image.Point{100, 50}},
+		{"area", image.Point{447, 223}, image.Point{447, 223}},
+		{"megapixels", image.Point{283, 141}, image.Point{283, 141}},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			if got := watermarkSize(landscape, watermark, 0.2, test.mode); got != test.landscape {
+				t.Errorf("Landscape: got %v, want %v", got, test.landscape)
+			}
+			if got := watermarkSize(portrait, watermark, 0.2, test.mode); got != test.portrait {
+				t.Errorf("Portrait: got %v, want %v", got, test.portrait)
+			}
+		})
+	}
+	if got := watermarkSize(landscape, image.Point{}, 0.2, "height"); got != (image.Point{}) {
+		t.Errorf("Empty watermark: got %v, want no size", got)
+	}
+}
+
+func TestComputeOffsetAnchors(t *testing.T) {
+	canvas := image.Rect(0, 0, 1000, 500)
+	watermark := image.Rect(0, 0, 100, 50)
+	nudged := placement{nudge: image.Point{10, 20}}
+	// 1% and 4% of the canvas are the same 10 and 20 pixels as the nudge
+	moved := placement{offsetX: 0.01, offsetY: 0.04}
+	tests := []struct {
+		location string
+		plain    image.Point // without offsets
+		nudged   image.Point // moved in from the edges of the cell, or right and down in the center
+	}{
+		{"tl", image.Point{0, 0}, image.Point{10, 20}},
+		{"tc", image.Point{450, 0}, image.Point{460, 20}},
+		{"tr", image.Point{900, 0}, image.Point{890, 20}},
+		{"ml", image.Point{0, 225}, image.Point{10, 245}},
+		{"mc", image.Point{450, 225}, image.Point{460, 245}},
+		{"mr", image.Point{900, 225}, image.Point{890, 245}},
+		{"bl", image.Point{0, 450}, image.Point{10, 430}},
+		{"bc", image.Point{450, 450}, image.Point{460, 430}},
+		{"br", image.Point{900, 450}, image.Point{890, 430}},
+		{"left", image.Point{0, 450}, image.Point{10, 430}},
+		{"right", image.Point{900, 450}, image.Point{890, 430}},
+		{"top-left", image.Point{0, 0}, image.Point{10, 20}},
+		{"top-right", image.Point{900, 0}, image.Point{890, 20}},
+		{"unknown", image.Point{900, 450}, image.Point{890, 430}},
+	}
+	for _, test := range tests {
+		t.Run(test.location, func(t *testing.T) {
+			if got := computeOffset(canvas, watermark, test.location, placement{}); got != test.plain {
+				t.Errorf("Got %v, want %v", got, test.plain)
+			}
+			if got := computeOffset(canvas, watermark, test.location, nudged); got != test.nudged {
+				t.Errorf("Nudged: got %v, want %v", got, test.nudged)
+			}
+			if got := computeOffset(canvas, watermark, test.location, moved); got != test.nudged {
+				t.Errorf("Moved by fractions: got %v, want %v", got, test.nudged)
+			}
+			// A canvas that doesn't start at the origin, such as the photo on a -border
+			shifted := canvas.Add(image.Point{30, 40})
+			if got, want := computeOffset(shifted, watermark, test.location, nudged), test.nudged.Add(shifted.Min); got != want {
+				t.Errorf("Shifted canvas: got %v, want %v", got, want)
+			}
+		})
+	}
+
+	// The safe zone keeps the watermark out of the margin, whatever the nudge
+	safe := placement{nudge: image.Point{-30, 5}, safeZone: 0.05}
+	for location, want := range map[string]image.Point{"tl": {50, 25}, "br": {850, 425}, "mc": {420, 230}} {
+		if got := computeOffset(canvas, watermark, location, safe); got != want {
+			t.Errorf("%s in the safe zone: got %v, want %v", location, got, want)
+		}
+	}
+}
+
+func TestAlternateLocation(t *testing.T) {
+	tests := []struct {
+		location    string
+		left, right string
+	}{
+		{"right", "left", "right"},
+		{"top-left", "top-left", "top-right"},
+		{"tc", "tl", "tr"},
+		{"mc", "ml", "mr"},
+		{"br", "bl", "br"},
+	}
+	for _, test := range tests {
+		if got := alternateLocation(test.location, false); got != test.left {
+			t.Errorf("%s on the left: got %s, want %s", test.location, got, test.left)
+		}
+		if got := alternateLocation(test.location, true); got != test.right {
+			t.Errorf("%s on the right: got %s, want %s", test.location, got, test.right)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"image"
+	"sync"
+)
+
+// memoryLimiter is a semaphore weighted in bytes. Workers acquire the estimated memory
+// of a photo before decoding it, so large photos admit fewer concurrent workers than small ones.
+type memoryLimiter struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+func newMemoryLimiter(limit int64) *memoryLimiter {
+	m := &memoryLimiter{limit: limit}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// acquire blocks until n bytes fit under the limit. A photo larger than the whole limit
+// is still admitted once nothing else is in flight, so it cannot block forever.
+func (m *memoryLimiter) acquire(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.used > 0 && m.used+n > m.limit {
+		m.cond.Wait()
+	}
+	m.used += n
+}
+
+func (m *memoryLimiter) release(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.used -= n
+	m.cond.Broadcast()
+}
+
+// estimateMemory approximates the bytes needed to process a photo: 4 bytes per pixel
+// for the decoded photo, and again for the canvas it is drawn on
+func estimateMemory(config image.Config, aspect aspectFlag) int64 {
+	size := image.Point{config.Width, config.Height}
+	canvas := size
+	if aspect.isSet() {
+		canvas = padToAspect(size, aspect)
+	}
+	return int64(size.X)*int64(size.Y)*4 + int64(canvas.X)*int64(canvas.Y)*4
+}
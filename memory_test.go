@@ -0,0 +1,71 @@
+package main
+
+import (
+	"image"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	m := newMemoryLimiter(100)
+	var mu sync.Mutex
+	used, peak := int64(0), int64(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.acquire(40)
+			mu.Lock()
+			used += 40
+			if used > peak {
+				peak = used
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			used -= 40
+			mu.Unlock()
+			m.release(40)
+		}()
+	}
+	wg.Wait()
+	if peak > 80 {
+		t.Errorf("Up to %d bytes were in use, more than the limit allows", peak)
+	}
+
+	// A photo larger than the limit is admitted on its own, instead of waiting forever
+	done := make(chan struct{})
+	go func() {
+		m.acquire(500)
+		m.release(500)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A photo larger than the limit was never admitted")
+	}
+}
+
+func TestEstimateMemory(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   image.Point
+		aspect aspectFlag
+		want   int64
+	}{
+		{"photo and canvas", image.Point{100, 50}, aspectFlag{}, 40000},
+		{"padded to a square", image.Point{100, 50}, aspectFlag{1, 1}, 20000 + 40000},
+		{"no padding needed", image.Point{160, 90}, aspectFlag{16, 9}, 2 * 160 * 90 * 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := image.Config{Width: test.size.X, Height: test.size.Y}
+			if got := estimateMemory(config, test.aspect); got != test.want {
+				t.Errorf("Got %d bytes, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"html"
+	"io"
+	"io/fs"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// iccMarker starts the APP2 segments of a JPEG file that hold its ICC color profile
+const iccMarker = "ICC_PROFILE\x00"
+
+// errBadMetadata is returned when the segments or chunks of a photo around its pixels are malformed
+var errBadMetadata = errors.New("malformed metadata")
+
+// readICCProfile returns the ICC color profile embedded in a JPEG or PNG photo, or nil when
+// it has none. Only the headers are read, up to the start of the pixel data.
+func readICCProfile(fsys fs.FS, fname string, ftype string) ([]byte, error) {
+	inputfile, reader, err := openSource(fsys, fname, ftype)
+	if err != nil {
+		return nil, err
+	}
+	defer inputfile.Close()
+	if ftype == "png" {
+		return readPNGProfile(reader)
+	}
+	return readJPEGProfile(reader)
+}
+
+// readJPEGProfile reads the ICC profile from the APP2 segments of a JPEG file. A profile larger
+// than a segment is split over several of them, which are numbered.
+func readJPEGProfile(r *bufio.Reader) ([]byte, error) {
+	chunks := map[int][]byte{}
+	err := walkJPEGSegments(r, func(marker byte, payload []byte) bool {
+		if marker == 0xe2 && len(payload) > len(iccMarker)+2 && string(payload[:len(iccMarker)]) == iccMarker {
+			chunks[int(payload[len(iccMarker)])] = payload[len(iccMarker)+2:]
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	seqs := make([]int, 0, len(chunks))
+	for seq := range chunks {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	var profile []byte
+	for _, seq := range seqs {
+		profile = append(profile, chunks[seq]...)
+	}
+	return profile, nil
+}
+
+// walkJPEGSegments calls visit with the marker and payload of every segment of a JPEG file
+// before its pixel data, until visit returns false
+func walkJPEGSegments(r *bufio.Reader, visit func(marker byte, payload []byte) bool) error {
+	if _, err := r.Discard(2); err != nil { // SOI
+		return err
+	}
+	for {
+		marker, err := nextJPEGMarker(r)
+		if err != nil {
+			return err
+		}
+		if marker == 0xda || marker == 0xd9 { // start of scan or end of image
+			return nil
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if length < 2 {
+			return errBadMetadata
+		}
+		payload := make([]byte, length-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		if !visit(marker, payload) {
+			return nil
+		}
+	}
+}
+
+// nextJPEGMarker reads the next marker of a JPEG file, skipping the fill bytes before it
+func nextJPEGMarker(r *bufio.Reader) (byte, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if c != 0xff {
+		return 0, errBadMetadata
+	}
+	for c == 0xff {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return c, nil
+}
+
+// maxICCProfile limits the size of the ICC profile read from a PNG file, compressed and not,
+// so a corrupt chunk length can't make it allocate gigabytes. Real profiles are far smaller.
+const maxICCProfile = 16 << 20
+
+// readPNGProfile reads the ICC profile from the compressed iCCP chunk of a PNG file
+func readPNGProfile(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.Discard(8); err != nil { // signature
+		return nil, err
+	}
+	for {
+		var header struct {
+			Length uint32
+			Type   [4]byte
+		}
+		if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+			return nil, err
+		}
+		switch string(header.Type[:]) {
+		case "IDAT", "IEND":
+			return nil, nil
+		case "iCCP":
+			if header.Length > maxICCProfile {
+				return nil, errBadMetadata
+			}
+			data := make([]byte, header.Length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			// The profile name, a null byte and the compression method come first
+			end := bytes.IndexByte(data, 0)
+			if end < 0 || end+2 > len(data) {
+				return nil, errBadMetadata
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(data[end+2:]))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			profile, err := io.ReadAll(io.LimitReader(zr, maxICCProfile+1))
+			if err == nil && len(profile) > maxICCProfile {
+				return nil, errBadMetadata
+			}
+			return profile, err
+		}
+		if _, err := r.Discard(int(header.Length) + 4); err != nil { // data and CRC
+			return nil, err
+		}
+	}
+}
+
+// exifMarker starts the APP1 segment of a JPEG file that holds its EXIF data
+const exifMarker = "Exif\x00\x00"
+
+// EXIF tags read by exifDate and exifTexts
+const (
+	tagImageDescription = 0x010e
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+	tagUserComment      = 0x9286
+	tagXPComment        = 0x9c9c
+	tagXPKeywords       = 0x9c9e
+)
+
+// readDateTaken returns the date a JPEG or TIFF photo was taken according to its EXIF data,
+// or the zero time when it has none
+func readDateTaken(fsys fs.FS, fname string, ftype string) (time.Time, error) {
+	inputfile, reader, err := openSource(fsys, fname, ftype)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer inputfile.Close()
+	if ftype == "tiff" {
+		// TIFF files are EXIF data themselves, with the pages described in the same directories
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return exifDate(data), nil
+	} else if ftype != "jpeg" {
+		return time.Time{}, nil
+	}
+	var taken time.Time
+	err = walkJPEGSegments(reader, func(marker byte, payload []byte) bool {
+		if marker == 0xe1 && len(payload) > len(exifMarker) && string(payload[:len(exifMarker)]) == exifMarker {
+			taken = exifDate(payload[len(exifMarker):])
+			return false
+		}
+		return true
+	})
+	return taken, err
+}
+
+// exifFields calls visit with the tag and the value of every field in the main directory of
+// EXIF data, which has the layout of a TIFF file, and then of every field in its EXIF
+// directory. Values are given as bytes in the byte order of the data, which is passed along.
+// Fields whose value is not within the data are left out.
+func exifFields(data []byte, visit func(order binary.ByteOrder, tag uint16, value []byte)) {
+	if len(data) < 8 || (data[0] != 'I' && data[0] != 'M') {
+		return
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+	// The size in bytes of the field types
+	sizes := map[uint16]int64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+	entries := func(offset uint32) uint32 {
+		var exifIFD uint32
+		if int64(offset)+2 > int64(len(data)) {
+			return 0
+		}
+		count := int(order.Uint16(data[offset:]))
+		for i := 0; i < count; i++ {
+			start := int64(offset) + 2 + 12*int64(i)
+			if start+12 > int64(len(data)) {
+				break
+			}
+			entry := data[start : start+12]
+			tag := order.Uint16(entry)
+			if tag == tagExifIFD {
+				exifIFD = order.Uint32(entry[8:])
+				continue
+			}
+			// Values of up to 4 bytes are stored in the entry, others at an offset
+			size := sizes[order.Uint16(entry[2:])] * int64(order.Uint32(entry[4:]))
+			if size <= 4 {
+				visit(order, tag, entry[8:8+size])
+			} else if offset := int64(order.Uint32(entry[8:])); offset+size <= int64(len(data)) {
+				visit(order, tag, data[offset:offset+size])
+			}
+		}
+		return exifIFD
+	}
+	if exifIFD := entries(order.Uint32(data[4:])); exifIFD != 0 {
+		entries(exifIFD)
+	}
+}
+
+// exifDate returns the date in EXIF data: the original date of the photo from the EXIF
+// directory, or else the date of the main directory. It returns the zero time when there is
+// no valid date. EXIF dates have no time zone, they are returned as UTC.
+func exifDate(data []byte) time.Time {
+	parse := func(value []byte) time.Time {
+		// An ASCII value of "2006:01:02 15:04:05" and a null byte
+		const layout = "2006:01:02 15:04:05"
+		if len(value) < len(layout) {
+			return time.Time{}
+		}
+		taken, err := time.Parse(layout, string(value[:len(layout)]))
+		if err != nil {
+			return time.Time{}
+		}
+		return taken
+	}
+
+	var dateTime, original time.Time
+	exifFields(data, func(order binary.ByteOrder, tag uint16, value []byte) {
+		switch tag {
+		case tagDateTime:
+			dateTime = parse(value)
+		case tagDateTimeOriginal:
+			original = parse(value)
+		}
+	})
+	if !original.IsZero() {
+		return original
+	}
+	return dateTime
+}
+
+// exifTexts returns the description, comments and keywords in EXIF data that photo software
+// lets photographers write: the ASCII image description, the user comment in ASCII or
+// Unicode, and the Windows comment and keywords in UTF-16
+func exifTexts(data []byte) []string {
+	var texts []string
+	utf16Text := func(order binary.ByteOrder, value []byte) string {
+		units := make([]uint16, len(value)/2)
+		for i := range units {
+			units[i] = order.Uint16(value[2*i:])
+		}
+		return string(utf16.Decode(units))
+	}
+	exifFields(data, func(order binary.ByteOrder, tag uint16, value []byte) {
+		switch tag {
+		case tagImageDescription:
+			texts = append(texts, string(value))
+		case tagUserComment:
+			// The comment starts with 8 bytes naming its character code
+			if len(value) < 8 {
+				return
+			}
+			if string(value[:7]) == "UNICODE" {
+				texts = append(texts, utf16Text(order, value[8:]))
+			} else {
+				texts = append(texts, string(value[8:]))
+			}
+		case tagXPComment, tagXPKeywords:
+			// Windows always writes these little endian
+			texts = append(texts, utf16Text(binary.LittleEndian, value))
+		}
+	})
+	for i, text := range texts {
+		texts[i] = strings.TrimRight(text, "\x00 ")
+	}
+	return texts
+}
+
+// readPhotoTexts returns the texts photo software can write to a JPEG or TIFF photo: those of
+// exifTexts, and of a JPEG photo also its comments and its XMP packet as is. Other photos
+// have none.
+func readPhotoTexts(fsys fs.FS, fname string, ftype string) ([]string, error) {
+	if ftype != "jpeg" && ftype != "tiff" {
+		return nil, nil
+	}
+	inputfile, reader, err := openSource(fsys, fname, ftype)
+	if err != nil {
+		return nil, err
+	}
+	defer inputfile.Close()
+	if ftype == "tiff" {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		return exifTexts(data), nil
+	}
+	var texts []string
+	err = walkJPEGSegments(reader, func(marker byte, payload []byte) bool {
+		if marker == 0xe1 && bytes.HasPrefix(payload, []byte(exifMarker)) {
+			texts = append(texts, exifTexts(payload[len(exifMarker):])...)
+		} else if marker == 0xe1 && bytes.HasPrefix(payload, []byte(xmpMarker)) {
+			texts = append(texts, string(payload[len(xmpMarker):]))
+		} else if marker == 0xfe {
+			texts = append(texts, string(payload))
+		}
+		return true
+	})
+	return texts, err
+}
+
+// insertJPEGSegment adds a segment with the given marker and payload to an encoded JPEG file,
+// right after its start of image marker, or after its JFIF and Exif segments which have to
+// come first
+func insertJPEGSegment(data []byte, marker byte, payload []byte) []byte {
+	segment := make([]byte, 4, 4+len(payload))
+	segment[0], segment[1] = 0xff, marker
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	at := 2
+	for marker != 0xe0 && at+4 <= len(data) && data[at] == 0xff {
+		length := int(binary.BigEndian.Uint16(data[at+2:]))
+		if data[at+1] != 0xe0 && !(data[at+1] == 0xe1 && bytes.HasPrefix(data[at+4:], []byte(exifMarker))) {
+			break
+		}
+		at = minInt(len(data), at+2+length)
+	}
+	out := make([]byte, 0, len(data)+len(segment))
+	out = append(out, data[:at]...)
+	out = append(out, segment...)
+	return append(out, data[at:]...)
+}
+
+// findJPEGSegment returns where the first segment with the given marker whose payload starts
+// with prefix begins and ends in an encoded JPEG file, or -1 when it has none before its
+// pixel data
+func findJPEGSegment(data []byte, marker byte, prefix string) (int, int) {
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff {
+		if data[pos+1] == 0xff { // fill byte
+			pos++
+			continue
+		}
+		if data[pos+1] == 0xda || data[pos+1] == 0xd9 { // start of scan or end of image
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		if data[pos+1] == marker && bytes.HasPrefix(data[pos+4:end], []byte(prefix)) {
+			return pos, end
+		}
+		pos = end
+	}
+	return -1, -1
+}
+
+// xmpMarker starts the APP1 segment of a JPEG file that holds its XMP packet
+const xmpMarker = "http://ns.adobe.com/xap/1.0/\x00"
+
+// maxTextMetadata is the longest -copyright or -comment in bytes, so it fits in a JPEG segment
+// together with the XMP packet around it
+const maxTextMetadata = 60000
+
+// addTextMetadata stores the -copyright and -comment in encoded JPEG or PNG data. JPEG gets the
+// copyright as the rights in its XMP packet, where photo tools look for it, and the comment in
+// a comment segment. PNG gets both as text chunks with the standard keywords.
+func addTextMetadata(data []byte, format string, copyright, comment string) []byte {
+	if format == "png" {
+		// International text chunks hold UTF-8, uncompressed and without a language
+		text := func(keyword, value string) []byte {
+			return append([]byte(keyword+"\x00\x00\x00\x00\x00"), value...)
+		}
+		if comment != "" {
+			data = insertPNGChunk(data, "iTXt", text("Comment", comment))
+		}
+		if copyright != "" {
+			data = insertPNGChunk(data, "iTXt", text("Copyright", copyright))
+		}
+		return data
+	}
+	if comment != "" {
+		data = insertJPEGSegment(data, 0xfe, []byte(comment))
+	}
+	if copyright != "" {
+		data = setJPEGCopyright(data, copyright)
+	}
+	return data
+}
+
+// setJPEGCopyright adds the copyright to the XMP packet of encoded JPEG data. A JPEG photo
+// copied with -no-recompress may have a packet already, which gets the copyright as another
+// description of the photo as XMP allows. Otherwise a new packet is added.
+func setJPEGCopyright(data []byte, copyright string) []byte {
+	rights := `<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:rights><rdf:Alt>` +
+		`<rdf:li xml:lang="x-default">` + html.EscapeString(copyright) + `</rdf:li></rdf:Alt></dc:rights></rdf:Description>`
+	if start, end := findJPEGSegment(data, 0xe1, xmpMarker); start >= 0 {
+		payload := data[start+4 : end]
+		if i := bytes.LastIndex(payload, []byte("</rdf:RDF>")); i >= 0 && len(payload)+len(rights) <= math.MaxUint16-2 {
+			merged := make([]byte, 0, len(payload)+len(rights))
+			merged = append(merged, payload[:i]...)
+			merged = append(merged, rights...)
+			merged = append(merged, payload[i:]...)
+			out := make([]byte, 0, len(data)+len(rights))
+			out = append(out, data[:start]...)
+			out = append(out, 0xff, 0xe1)
+			out = binary.BigEndian.AppendUint16(out, uint16(len(merged)+2))
+			out = append(out, merged...)
+			return append(out, data[end:]...)
+		}
+	}
+	packet := xmpMarker + "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>" +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		rights + `</rdf:RDF></x:xmpmeta><?xpacket end="w"?>`
+	return insertJPEGSegment(data, 0xe1, []byte(packet))
+}
+
+// insertPNGChunk adds a chunk of the given type and data to an encoded PNG file, right after
+// its IHDR chunk as chunks describing the colors must come before the pixel data
+func insertPNGChunk(data []byte, chunkType string, chunkData []byte) []byte {
+	const ihdrEnd = 8 + 8 + 13 + 4 // signature, then the length, type, data and CRC of IHDR
+	chunk := make([]byte, 8, 12+len(chunkData))
+	binary.BigEndian.PutUint32(chunk, uint32(len(chunkData)))
+	copy(chunk[4:], chunkType)
+	chunk = append(chunk, chunkData...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	out := make([]byte, 0, len(data)+len(chunk))
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+// setDensity stores the print density of encoded JPEG or PNG data, in a JFIF segment for JPEG
+// or a pHYs chunk for PNG, so print software prints the photo at the intended size. A JFIF
+// segment the encoder wrote already, as libjpeg does, is replaced.
+func setDensity(data []byte, format string, dpi int) []byte {
+	if format == "png" {
+		// PNG stores the density in pixels per meter
+		ppm := uint32(math.Round(float64(dpi) / 0.0254))
+		chunk := binary.BigEndian.AppendUint32(nil, ppm)
+		chunk = binary.BigEndian.AppendUint32(chunk, ppm)
+		return insertPNGChunk(data, "pHYs", append(chunk, 1))
+	}
+	// The JFIF segment has to come first, right after the start of image marker. Version 1.02,
+	// with the density in dots per inch and no thumbnail.
+	payload := []byte("JFIF\x00\x01\x02\x01")
+	payload = binary.BigEndian.AppendUint16(payload, uint16(dpi))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(dpi))
+	if start, end := findJPEGSegment(data, 0xe0, "JFIF\x00"); start >= 0 {
+		data = append(data[:start:start], data[end:]...)
+	}
+	return insertJPEGSegment(data, 0xe0, append(payload, 0, 0))
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf16"
+)
+
+// exifField is a field of the EXIF data written by buildExif, with its value already encoded
+type exifField struct {
+	tag   uint16
+	typ   uint16 // 1 for bytes, 2 for ASCII or 7 for undefined, which all have 1 byte per value
+	value []byte
+}
+
+// buildExif returns EXIF data in the given byte order with the fields of the main directory,
+// and of an EXIF directory if there are any
+func buildExif(order binary.ByteOrder, main, exif []exifField) []byte {
+	ifdSize := func(n int) int { return 2 + 12*n + 4 }
+	mainCount := len(main)
+	if len(exif) > 0 {
+		mainCount++
+	}
+	exifOffset := 8 + ifdSize(mainCount)
+	out := make([]byte, exifOffset+ifdSize(len(exif)))
+	if order == binary.ByteOrder(binary.BigEndian) {
+		copy(out, "MM\x00*")
+	} else {
+		copy(out, "II*\x00")
+	}
+	order.PutUint32(out[4:], 8)
+
+	writeIFD := func(at int, fields []exifField, count int) {
+		order.PutUint16(out[at:], uint16(count))
+		for i, field := range fields {
+			entry := at + 2 + 12*i
+			order.PutUint16(out[entry:], field.tag)
+			order.PutUint16(out[entry+2:], field.typ)
+			order.PutUint32(out[entry+4:], uint32(len(field.value)))
+			if len(field.value) <= 4 {
+				copy(out[entry+8:], field.value)
+			} else {
+				order.PutUint32(out[entry+8:], uint32(len(out)))
+				out = append(out, field.value...)
+			}
+		}
+	}
+	writeIFD(8, main, mainCount)
+	if len(exif) > 0 {
+		entry := 8 + 2 + 12*len(main)
+		order.PutUint16(out[entry:], tagExifIFD)
+		order.PutUint16(out[entry+2:], 4)
+		order.PutUint32(out[entry+4:], 1)
+		order.PutUint32(out[entry+8:], uint32(exifOffset))
+		writeIFD(exifOffset, exif, len(exif))
+	}
+	return out
+}
+
+// ascii encodes an ASCII EXIF value, which ends with a null byte
+func ascii(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// utf16Bytes encodes s as UTF-16 in the given byte order, as Unicode EXIF values are
+func utf16Bytes(order binary.ByteOrder, s string) []byte {
+	units := utf16.Encode([]rune(s))
+	out := make([]byte, 2*len(units))
+	for i, unit := range units {
+		order.PutUint16(out[2*i:], unit)
+	}
+	return out
+}
+
+func TestExifTexts(t *testing.T) {
+	le, be := binary.ByteOrder(binary.LittleEndian), binary.ByteOrder(binary.BigEndian)
+	description := exifField{tagImageDescription, 2, ascii("Sunset over the bay")}
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"none", buildExif(le, nil, nil), nil},
+		{"not exif", []byte("not exif data at all"), nil},
+		{"description", buildExif(le, []exifField{description}, nil), []string{"Sunset over the bay"}},
+		{"short description", buildExif(be, []exifField{{tagImageDescription, 2, ascii("Hi")}}, nil), []string{"Hi"}},
+		{"windows keywords", buildExif(le, []exifField{{tagXPKeywords, 1, utf16Bytes(le, "beach;Watermark:left\x00")}}, nil), []string{"beach;Watermark:left"}},
+		{"windows comment in big endian data", buildExif(be, []exifField{{tagXPComment, 1, utf16Bytes(le, "Crème brûlée\x00")}}, nil), []string{"Crème brûlée"}},
+		{"ascii user comment", buildExif(le, nil, []exifField{{tagUserComment, 7, []byte("ASCII\x00\x00\x00Watermark:tile  ")}}), []string{"Watermark:tile"}},
+		{"unicode user comment", buildExif(be, nil, []exifField{{tagUserComment, 7, append([]byte("UNICODE\x00"), utf16Bytes(be, "Wässerzeichen")...)}}), []string{"Wässerzeichen"}},
+		{"short user comment", buildExif(le, nil, []exifField{{tagUserComment, 7, []byte("ASCII")}}), nil},
+		{"main and exif directory", buildExif(le, []exifField{description}, []exifField{{tagUserComment, 7, []byte("ASCII\x00\x00\x00op:50")}}), []string{"Sunset over the bay", "op:50"}},
+		{"value outside the data", buildExif(le, []exifField{description}, nil)[:40], nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := exifTexts(test.data); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExifDate(t *testing.T) {
+	le := binary.ByteOrder(binary.LittleEndian)
+	dateTime := exifField{tagDateTime, 2, ascii("2021:06:01 10:00:00")}
+	tests := []struct {
+		name string
+		data []byte
+		want time.Time
+	}{
+		{"none", buildExif(le, nil, nil), time.Time{}},
+		{"date", buildExif(le, []exifField{dateTime}, nil), time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)},
+		{"original date first", buildExif(le, []exifField{dateTime}, []exifField{{tagDateTimeOriginal, 2, ascii("2019:12:31 23:59:58")}}), time.Date(2019, 12, 31, 23, 59, 58, 0, time.UTC)},
+		{"invalid original date", buildExif(le, []exifField{dateTime}, []exifField{{tagDateTimeOriginal, 2, ascii("0000:00:00 00:00:00")}}), time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)},
+		{"short date", buildExif(le, []exifField{{tagDateTime, 2, ascii("2021:06:01")}}, nil), time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := exifDate(test.data); !got.Equal(test.want) {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// jpegWithTexts encodes a test photo as JPEG with an EXIF description, an XMP packet and a comment
+func jpegWithTexts(t *testing.T, description, xmp, comment string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testPhoto(64, 48), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if description != "" {
+		exif := buildExif(binary.LittleEndian, []exifField{{tagImageDescription, 2, ascii(description)}}, nil)
+		data = insertJPEGSegment(data, 0xe1, append([]byte(exifMarker), exif...))
+	}
+	if comment != "" {
+		data = insertJPEGSegment(data, 0xfe, []byte(comment))
+	}
+	if xmp != "" {
+		data = insertJPEGSegment(data, 0xe1, append([]byte(xmpMarker), xmp...))
+	}
+	return data
+}
+
+func TestReadPhotoTexts(t *testing.T) {
+	xmp := `<x:xmpmeta><dc:subject><rdf:Bag><rdf:li>watermark:tile</rdf:li></rdf:Bag></dc:subject></x:xmpmeta>`
+	fsys := fstest.MapFS{
+		"all.jpg":     {Data: jpegWithTexts(t, "Watermark:left", xmp, "a comment")},
+		"comment.jpg": {Data: jpegWithTexts(t, "", "", "Watermark:right;op:20")},
+		"none.jpg":    {Data: jpegWithTexts(t, "", "", "")},
+		"photo.tif":   {Data: buildExif(binary.BigEndian, []exifField{{tagImageDescription, 2, ascii("Watermark:top-left")}}, nil)},
+		"photo.png":   {Data: []byte("\x89PNG\r\n\x1a\n")},
+	}
+	tests := []struct {
+		fname string
+		ftype string
+		want  []string
+	}{
+		{"all.jpg", "jpeg", []string{"Watermark:left", xmp, "a comment"}},
+		{"comment.jpg", "jpeg", []string{"Watermark:right;op:20"}},
+		{"none.jpg", "jpeg", nil},
+		{"photo.tif", "tiff", []string{"Watermark:top-left"}},
+		{"photo.png", "png", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.fname, func(t *testing.T) {
+			texts, err := readPhotoTexts(fsys, test.fname, test.ftype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(texts, test.want) {
+				t.Errorf("Got %q, want %q", texts, test.want)
+			}
+		})
+	}
+}
+
+func TestParamsFromExif(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "watermark.png"), testWatermark(60, 20))
+	photos := map[string][]byte{
+		"a.jpg": jpegWithTexts(t, "Watermark:top-left;op:40", "", ""),
+		"b.jpg": jpegWithTexts(t, "", "", "sunset, watermark:op:150"),
+		"c.jpg": jpegWithTexts(t, "", "", ""),
+	}
+	for name, data := range photos {
+		if err := os.MkdirAll(filepath.Join(dir, "photos"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "photos", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	code, out := runTool(t, dir, nil, "-source", "photos", "-target", "target", "-params-from-exif", "-emit-placement", "placements.json")
+	if code != exitSuccess {
+		t.Fatalf("The run exited with %d:\n%s", code, out)
+	}
+	if want := "ignoring invalid opacity '150' in its metadata"; !strings.Contains(out, want) {
+		t.Errorf("The run didn't warn %q:\n%s", want, out)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "placements.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []placementEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source   string
+		location string
+		opacity  int
+	}{
+		{"a.jpg", "top-left", 40},
+		{"b.jpg", "right", 70},
+		{"c.jpg", "right", 70},
+	}
+	if len(entries) != len(tests) {
+		t.Fatalf("Got %d placements, want %d:\n%s", len(entries), len(tests), data)
+	}
+	for i, test := range tests {
+		entry := entries[i]
+		if filepath.Base(entry.Source) != test.source || entry.Location != test.location || entry.Opacity != test.opacity {
+			t.Errorf("Got %s at %s with opacity %d, want %s at %s with %d", entry.Source, entry.Location, entry.Opacity, test.source, test.location, test.opacity)
+		}
+	}
+}
+
+// jfifDensities returns the horizontal density of every JFIF segment in encoded JPEG data
+func jfifDensities(t *testing.T, data []byte) []int {
+	t.Helper()
+	var densities []int
+	err := walkJPEGSegments(bufio.NewReader(bytes.NewReader(data)), func(marker byte, payload []byte) bool {
+		if marker == 0xe0 && bytes.HasPrefix(payload, []byte("JFIF\x00")) && len(payload) >= 12 {
+			densities = append(densities, int(binary.BigEndian.Uint16(payload[8:])))
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return densities
+}
+
+func TestSetDensityJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testPhoto(64, 48), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"without JFIF segment", plain},
+		{"with JFIF segment", setDensity(plain, "jpeg", 72)},
+		{"with EXIF after the JFIF segment", setDensity(insertJPEGSegment(plain, 0xe1, append([]byte(exifMarker), buildExif(binary.LittleEndian, nil, nil)...)), "jpeg", 72)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := setDensity(append([]byte(nil), test.data...), "jpeg", 300)
+			if got := jfifDensities(t, data); !reflect.DeepEqual(got, []int{300}) {
+				t.Errorf("Got JFIF densities %v, want [300]", got)
+			}
+			if !bytes.HasPrefix(data, []byte("\xff\xd8\xff\xe0")) {
+				t.Error("The JFIF segment doesn't come right after the start of image")
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+				t.Errorf("Could not decode the photo: %s", err)
+			}
+		})
+	}
+}
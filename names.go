@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// nameTokenSeparator separates the settings encoded in a file name from the name and each other
+const nameTokenSeparator = "__"
+
+// metadataOverridesPrefix starts the settings of a photo in its metadata for -params-from-exif
+const metadataOverridesPrefix = "watermark:"
+
+// nameOverrides are the settings of a photo encoded in its file name for -parse-names, such as
+// photo__loc-left__op-50.jpg, or in its metadata for -params-from-exif
+type nameOverrides struct {
+	location string // empty keeps the location of the run
+	opacity  int    // -1 keeps the opacity of the run
+}
+
+// parseNameOverrides parses the settings encoded in a file name. The part before the first
+// separator is the name itself, every following token is a key and a value joined by a dash:
+// loc-<location> with one of the -location values, or op-<opacity> with an opacity between 0
+// and 100. Tokens with other keys are ignored, so names can carry other tags. Known keys with
+// an invalid value are ignored too, and reported in the returned problems.
+func parseNameOverrides(fname string) (nameOverrides, []string) {
+	overrides := nameOverrides{opacity: -1}
+	var problems []string
+	base := strings.TrimSuffix(path.Base(fname), path.Ext(fname))
+	tokens := strings.Split(base, nameTokenSeparator)
+	for _, token := range tokens[1:] {
+		key, value, ok := strings.Cut(token, "-")
+		if !ok {
+			continue
+		}
+		if _, problem := overrides.set(key, value); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	return overrides, problems
+}
+
+// set sets the override of a key to the value: loc to one of the -location values, or op to
+// an opacity between 0 and 100. It returns whether the key is known, and the problem with an
+// invalid value, which is then ignored.
+func (o *nameOverrides) set(key, value string) (bool, string) {
+	switch key {
+	case "loc":
+		if !contains(locations, value) {
+			return true, fmt.Sprintf("unknown location '%s'", value)
+		}
+		o.location = value
+	case "op":
+		opacity, err := strconv.Atoi(value)
+		if err != nil || opacity < 0 || opacity > 100 {
+			return true, fmt.Sprintf("invalid opacity '%s'", value)
+		}
+		o.opacity = opacity
+	default:
+		return false, ""
+	}
+	return true, ""
+}
+
+// parseMetadataOverrides parses the settings of a photo in the texts of its metadata, such as
+// a keyword or comment of "Watermark:left;op:60". The first text with the prefix, in any case,
+// holds them: tokens separated by semicolons, which are a bare location, or a key and a value
+// joined by a colon as for parseNameOverrides. The settings end at a space, quote or tag, or at
+// the first token that isn't one, so the keywords of a list can follow them. It returns
+// whether a text had the prefix.
+func parseMetadataOverrides(texts []string) (nameOverrides, []string, bool) {
+	overrides := nameOverrides{opacity: -1}
+	var problems []string
+	for _, text := range texts {
+		start := strings.Index(strings.ToLower(text), metadataOverridesPrefix)
+		if start < 0 {
+			continue
+		}
+		spec := text[start+len(metadataOverridesPrefix):]
+		if end := strings.IndexAny(spec, " \t\r\n\"'<,"); end >= 0 {
+			spec = spec[:end]
+		}
+		for i, token := range strings.Split(spec, ";") {
+			key, value, ok := strings.Cut(strings.ToLower(token), ":")
+			if !ok {
+				key, value = "loc", key
+				if i > 0 && !contains(locations, value) {
+					break
+				}
+			}
+			known, problem := overrides.set(key, value)
+			if !known {
+				break
+			}
+			if problem != "" {
+				problems = append(problems, problem)
+			}
+		}
+		return overrides, problems, true
+	}
+	return overrides, problems, false
+}
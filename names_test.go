@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNameOverrides(t *testing.T) {
+	tests := []struct {
+		fname    string
+		want     nameOverrides
+		problems []string
+	}{
+		{"photo.jpg", nameOverrides{"", -1}, nil},
+		{"photo__loc-left__op-50.jpg", nameOverrides{"left", 50}, nil},
+		{"photo__loc-top-left.jpg", nameOverrides{"top-left", -1}, nil},
+		{"photo__op-0.png", nameOverrides{"", 0}, nil},
+		{"photo__draft__v-2__loc-tile.jpg", nameOverrides{"tile", -1}, nil},
+		{"trip__loc-left/photo.jpg", nameOverrides{"", -1}, nil},
+		{"photo__op-150.jpg", nameOverrides{"", -1}, []string{"invalid opacity '150'"}},
+		{"photo__loc-nowhere__op-20.jpg", nameOverrides{"", 20}, []string{"unknown location 'nowhere'"}},
+		{"photo__op-half__loc-up.jpg", nameOverrides{"", -1}, []string{"invalid opacity 'half'", "unknown location 'up'"}},
+	}
+	for _, test := range tests {
+		t.Run(test.fname, func(t *testing.T) {
+			got, problems := parseNameOverrides(test.fname)
+			if got != test.want {
+				t.Errorf("Got %+v, want %+v", got, test.want)
+			}
+			if !reflect.DeepEqual(problems, test.problems) {
+				t.Errorf("Got problems %q, want %q", problems, test.problems)
+			}
+		})
+	}
+}
+
+func TestParseMetadataOverrides(t *testing.T) {
+	tests := []struct {
+		name     string
+		texts    []string
+		want     nameOverrides
+		problems []string
+		found    bool
+	}{
+		{"no metadata", nil, nameOverrides{"", -1}, nil, false},
+		{"no prefix", []string{"sunset", "beach"}, nameOverrides{"", -1}, nil, false},
+		{"location and opacity", []string{"Watermark:left;op:60"}, nameOverrides{"left", 60}, nil, true},
+		{"any case", []string{"WATERMARK:Top-Right;OP:40"}, nameOverrides{"top-right", 40}, nil, true},
+		{"location key", []string{"watermark:op:60;loc:tile"}, nameOverrides{"tile", 60}, nil, true},
+		{"bare location later", []string{"watermark:op:60;right"}, nameOverrides{"right", 60}, nil, true},
+		{"in a keyword list", []string{"sunset, watermark:top-left;op:30, beach"}, nameOverrides{"top-left", 30}, nil, true},
+		{"in a tag", []string{"<dc:subject>watermark:tile</dc:subject>"}, nameOverrides{"tile", -1}, nil, true},
+		{"ends at a space", []string{"watermark:left op:60"}, nameOverrides{"left", -1}, nil, true},
+		{"ends at another keyword", []string{"watermark:left;sunset;op:60"}, nameOverrides{"left", -1}, nil, true},
+		{"ends at an unknown key", []string{"watermark:left;size:10;op:60"}, nameOverrides{"left", -1}, nil, true},
+		{"first text wins", []string{"beach", "watermark:left", "watermark:right;op:10"}, nameOverrides{"left", -1}, nil, true},
+		{"invalid opacity", []string{"watermark:left;op:150"}, nameOverrides{"left", -1}, []string{"invalid opacity '150'"}, true},
+		{"unknown location", []string{"watermark:nowhere;op:20"}, nameOverrides{"", 20}, []string{"unknown location 'nowhere'"}, true},
+		{"empty", []string{"watermark:"}, nameOverrides{"", -1}, []string{"unknown location ''"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, problems, found := parseMetadataOverrides(test.texts)
+			if got != test.want {
+				t.Errorf("Got %+v, want %+v", got, test.want)
+			}
+			if !reflect.DeepEqual(problems, test.problems) {
+				t.Errorf("Got problems %q, want %q", problems, test.problems)
+			}
+			if found != test.found {
+				t.Errorf("Got found %v, want %v", found, test.found)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// Range of JPEG qualities tried by -smart-quality, and the most trial encodes per photo
+const (
+	minSmartQuality  = 50
+	maxSmartQuality  = 95
+	maxQualityTrials = 5
+)
+
+// Window size and stabilizing constants of the SSIM metric, for 8 bit values
+const (
+	ssimWindowSize = 8
+	ssimC1         = (0.01 * 255) * (0.01 * 255)
+	ssimC2         = (0.03 * 255) * (0.03 * 255)
+)
+
+// encodeSmartJPEG writes img to w as JPEG at the lowest quality whose SSIM against img is at
+// least target. The quality is found by bisection between minSmartQuality and maxSmartQuality,
+// with at most maxQualityTrials trial encodes. If none of them is good enough the fixed quality
+// of jpegOptions is used. The result only depends on the image, so output stays reproducible.
+// It returns the quality that was used.
+func encodeSmartJPEG(w io.Writer, img image.Image, target float64) (int, error) {
+	reference := toRGBA(img)
+	var best []byte
+	bestQuality := jpegOptions.Quality
+	lo, hi := minSmartQuality, maxSmartQuality
+	for trial := 0; trial < maxQualityTrials && lo <= hi; trial++ {
+		quality := (lo + hi) / 2
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return 0, err
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return 0, err
+		}
+		if ssim(reference, toRGBA(decoded)) >= target {
+			best, bestQuality = buf.Bytes(), quality
+			hi = quality - 1
+		} else {
+			lo = quality + 1
+		}
+	}
+	if best == nil {
+		return bestQuality, jpeg.Encode(w, img, &jpegOptions)
+	}
+	_, err := w.Write(best)
+	return bestQuality, err
+}
+
+// ssim returns the mean structural similarity of the luminance of two images of the same size,
+// over non-overlapping windows of ssimWindowSize pixels. 1 means the images are identical.
+func ssim(a, b *image.RGBA) float64 {
+	bounds := a.Rect.Intersect(b.Rect)
+	var total float64
+	windows := 0
+	for y := bounds.Min.Y; y+ssimWindowSize <= bounds.Max.Y; y += ssimWindowSize {
+		for x := bounds.Min.X; x+ssimWindowSize <= bounds.Max.X; x += ssimWindowSize {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for wy := y; wy < y+ssimWindowSize; wy++ {
+				for wx := x; wx < x+ssimWindowSize; wx++ {
+					la := luminance(a.Pix[a.PixOffset(wx, wy):])
+					lb := luminance(b.Pix[b.PixOffset(wx, wy):])
+					sumA += la
+					sumB += lb
+					sumAA += la * la
+					sumBB += lb * lb
+					sumAB += la * lb
+				}
+			}
+			n := float64(ssimWindowSize * ssimWindowSize)
+			meanA, meanB := sumA/n, sumB/n
+			varA, varB := sumAA/n-meanA*meanA, sumBB/n-meanB*meanB
+			covariance := sumAB/n - meanA*meanB
+			total += (2*meanA*meanB + ssimC1) * (2*covariance + ssimC2) /
+				((meanA*meanA + meanB*meanB + ssimC1) * (varA + varB + ssimC2))
+			windows++
+		}
+	}
+	if windows == 0 {
+		return 1
+	}
+	return total / float64(windows)
+}
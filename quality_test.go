@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestSSIM(t *testing.T) {
+	photo := testPhoto(64, 64)
+	inverted := image.NewRGBA(photo.Rect)
+	noisy := image.NewRGBA(photo.Rect)
+	for i := range photo.Pix {
+		if i%4 == 3 {
+			inverted.Pix[i], noisy.Pix[i] = 0xff, 0xff
+			continue
+		}
+		inverted.Pix[i] = 0xff - photo.Pix[i]
+		noisy.Pix[i] = uint8(clampInt(int(photo.Pix[i])+i*37%9-4, 0, 0xff))
+	}
+	tests := []struct {
+		name     string
+		a, b     *image.RGBA
+		min, max float64
+	}{
+		{"identical", photo, photo, 1, 1},
+		{"slight noise", photo, noisy, 0.9, 0.999},
+		{"inverted", photo, inverted, -1, 0.5},
+		{"smaller than a window", testPhoto(4, 4), image.NewRGBA(image.Rect(0, 0, 4, 4)), 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ssim(test.a, test.b); got < test.min || got > test.max {
+				t.Errorf("Got SSIM %.4f, want between %g and %g", got, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestEncodeSmartJPEG(t *testing.T) {
+	photo := testPhoto(128, 96)
+	tests := []struct {
+		target float64
+		want   int // the quality, 0 for any between minSmartQuality and maxSmartQuality
+	}{
+		{0, minSmartQuality},
+		{0.95, 0},
+		{0.99, 0},
+		// The SSIM is at most 1, so no trial is good enough and the fixed quality is used
+		{1.01, jpegOptions.Quality},
+	}
+	var previous int
+	for _, test := range tests {
+		var out bytes.Buffer
+		quality, err := encodeSmartJPEG(&out, photo, test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.want != 0 && quality != test.want {
+			t.Errorf("Got quality %d for target %g, want %d", quality, test.target, test.want)
+		} else if test.want == 0 && (quality < minSmartQuality || quality > maxSmartQuality) {
+			t.Errorf("Got quality %d for target %g, want between %d and %d", quality, test.target, minSmartQuality, maxSmartQuality)
+		}
+		if quality < previous {
+			t.Errorf("Got quality %d for target %g, lower than %d for a lower target", quality, test.target, previous)
+		}
+		previous = quality
+
+		decoded, err := jpeg.Decode(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if score := ssim(photo, toRGBA(decoded)); test.target <= 1 && score < test.target {
+			t.Errorf("Got SSIM %.4f for target %g", score, test.target)
+		}
+
+		// The same photo must always be encoded the same way
+		var again bytes.Buffer
+		if _, err := encodeSmartJPEG(&again, photo, test.target); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), again.Bytes()) {
+			t.Errorf("Encoding twice for target %g gave different output", test.target)
+		}
+	}
+}
+
+func TestEncodeSmartJPEGSolid(t *testing.T) {
+	// A flat photo looks the same at any quality, so the lowest quality tried is good enough
+	photo := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := 0; i < len(photo.Pix); i += 4 {
+		copy(photo.Pix[i:], []uint8{120, 130, 140, 0xff})
+	}
+	quality, err := encodeSmartJPEG(&bytes.Buffer{}, photo, 0.99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := minSmartQuality; quality != want {
+		t.Errorf("Got quality %d, want %d", quality, want)
+	}
+}
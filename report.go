@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// reportHeader is the first row of the -csv report
+var reportHeader = []string{
+	"source", "output", "source size", "output size", "location", "quality", "bytes", "status", "error",
+}
+
+// csvReport collects a row for every output file and every skipped photo of a run, for -csv.
+// It is safe for concurrent use.
+type csvReport struct {
+	mu   sync.Mutex
+	rows [][]string
+}
+
+// addOutput records a written output file of the photo source
+func (r *csvReport) addOutput(source, output string, sourceSize, outputSize image.Point, location string, saved savedFile) {
+	r.add([]string{
+		source, output, sizeString(sourceSize), sizeString(outputSize), location,
+		saved.quality, strconv.FormatInt(saved.size, 10), "ok", "",
+	})
+}
+
+// addSkipped records a photo that was skipped, with the reason as status
+func (r *csvReport) addSkipped(source string, err error) {
+	r.add([]string{source, "", "", "", "", "", "", skipReason(err), err.Error()})
+}
+
+func (r *csvReport) add(row []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rows = append(r.rows, row)
+}
+
+// write saves the report to fname, sorted by source and output so it doesn't depend on
+// the order in which the photos were processed
+func (r *csvReport) write(fname string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.Slice(r.rows, func(i, j int) bool {
+		if r.rows[i][0] != r.rows[j][0] {
+			return r.rows[i][0] < r.rows[j][0]
+		}
+		return r.rows[i][1] < r.rows[j][1]
+	})
+
+	file, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	writer.Write(reportHeader)
+	writer.WriteAll(r.rows)
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// sizeString formats a size as WxH, like the -max-size and -watermark-box flags
+func sizeString(size image.Point) string {
+	return fmt.Sprintf("%dx%d", size.X, size.Y)
+}
+
+// placementEntry is the watermark of one output file in the -emit-placement report. The
+// rectangle is in pixels of the output, and the scale is the size of the watermark relative to
+// the watermark file.
+type placementEntry struct {
+	Source    string  `json:"source"`
+	Output    string  `json:"output"`
+	Watermark string  `json:"watermark,omitempty"`
+	Location  string  `json:"location"`
+	X         int     `json:"x"`
+	Y         int     `json:"y"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	Scale     float64 `json:"scale,omitempty"`
+	Opacity   int     `json:"opacity"`
+	Blend     string  `json:"blend"`
+
+	outputSize image.Point // for -placement-svg
+}
+
+// placementReport collects where the watermark was drawn on every output file of a run, for
+// -emit-placement and -placement-svg. It is safe for concurrent use.
+type placementReport struct {
+	mu      sync.Mutex
+	entries []placementEntry
+}
+
+func (r *placementReport) add(entry placementEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+}
+
+// write saves the report to fname as a JSON array, sorted by output
+func (r *placementReport) write(fname string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Stable, so the watermarks of an output file stay in the order they were drawn
+	sort.SliceStable(r.entries, func(i, j int) bool { return r.entries[i].Output < r.entries[j].Output })
+	entries := r.entries
+	if entries == nil {
+		entries = []placementEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fname, append(data, '\n'), 0644)
+}
+
+// placementSVGName is the file -placement-svg-combined writes to the target folder
+const placementSVGName = "placements.svg"
+
+// placementSVGGap is the space above every output file in the combined placement SVG, which
+// holds its name
+const placementSVGGap = 32
+
+// writeSVG saves the placements as SVG files for -placement-svg: a file next to every output
+// file and named after it, which shows the output with a rectangle around the watermark. The
+// rectangle is in pixels of the output, so it can be measured and moved in vector tools. With
+// combined all output files are stacked in a single file in targetDir instead, each under its
+// name.
+func (r *placementReport) writeSVG(targetDir string, combined bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.SliceStable(r.entries, func(i, j int) bool { return r.entries[i].Output < r.entries[j].Output })
+	// The entries of an output file, one for every watermark drawn on it
+	var outputs [][]placementEntry
+	for i, entry := range r.entries {
+		if i > 0 && entry.Output == r.entries[i-1].Output {
+			outputs[len(outputs)-1] = append(outputs[len(outputs)-1], entry)
+		} else {
+			outputs = append(outputs, []placementEntry{entry})
+		}
+	}
+
+	if !combined {
+		for _, entries := range outputs {
+			entry := entries[0]
+			svg := svgHeader(entry.outputSize.X, entry.outputSize.Y)
+			svg += svgPlacement(path.Base(entry.Output), entries) + "</svg>\n"
+			fname := strings.TrimSuffix(entry.Output, path.Ext(entry.Output)) + ".svg"
+			if err := os.WriteFile(fname, []byte(svg), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var body strings.Builder
+	width, top := 0, 0
+	for _, entries := range outputs {
+		entry := entries[0]
+		href, err := filepath.Rel(targetDir, entry.Output)
+		if err != nil {
+			return err
+		}
+		href = filepath.ToSlash(href)
+		fmt.Fprintf(&body, "<text x=\"0\" y=\"%d\" font-family=\"sans-serif\" font-size=\"20\">%s</text>\n", top+placementSVGGap-8, html.EscapeString(href))
+		top += placementSVGGap
+		fmt.Fprintf(&body, "<g transform=\"translate(0 %d)\">\n%s</g>\n", top, svgPlacement(href, entries))
+		top += entry.outputSize.Y
+		width = maxInt(width, entry.outputSize.X)
+	}
+	svg := svgHeader(width, top) + body.String() + "</svg>\n"
+	return os.WriteFile(path.Join(targetDir, placementSVGName), []byte(svg), 0644)
+}
+
+// svgHeader starts an SVG file of the given size in pixels
+func svgHeader(width, height int) string {
+	return fmt.Sprintf("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<svg xmlns=\"http://www.w3.org/2000/svg\" xmlns:xlink=\"http://www.w3.org/1999/xlink\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n",
+		width, height, width, height)
+}
+
+// svgPlacement returns the SVG elements for an output file linked as href, and the rectangles
+// of its watermarks. The link is given twice, as older vector tools only read xlink:href.
+func svgPlacement(href string, entries []placementEntry) string {
+	href = html.EscapeString(href)
+	svg := fmt.Sprintf("<image href=\"%s\" xlink:href=\"%s\" x=\"0\" y=\"0\" width=\"%d\" height=\"%d\"/>\n",
+		href, href, entries[0].outputSize.X, entries[0].outputSize.Y)
+	for _, entry := range entries {
+		svg += fmt.Sprintf("<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"none\" stroke=\"#ff00ff\" stroke-width=\"2\" vector-effect=\"non-scaling-stroke\"/>\n",
+			entry.X, entry.Y, entry.Width, entry.Height)
+	}
+	return svg
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCSVReport(t *testing.T) {
+	var report csvReport
+	// Added out of order, as the photos finish in any order
+	report.addOutput("b.jpg", "out/b_100.jpg", image.Pt(400, 300), image.Pt(100, 75), "br", savedFile{5120, "95"})
+	report.addSkipped("c.jpg", fmt.Errorf("failed to open: %w", errNotAnImage))
+	report.addOutput("a.jpg", "out/a_200.jpg", image.Pt(400, 300), image.Pt(200, 150), "tl", savedFile{2048, "png"})
+	report.addOutput("a.jpg", "out/a_100.jpg", image.Pt(400, 300), image.Pt(100, 75), "tl", savedFile{1024, "png"})
+	report.addSkipped("d.jpg", &decodeError{io.ErrUnexpectedEOF})
+
+	fname := filepath.Join(t.TempDir(), "report.csv")
+	if err := report.write(fname); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		reportHeader,
+		{"a.jpg", "out/a_100.jpg", "400x300", "100x75", "tl", "png", "1024", "ok", ""},
+		{"a.jpg", "out/a_200.jpg", "400x300", "200x150", "tl", "png", "2048", "ok", ""},
+		{"b.jpg", "out/b_100.jpg", "400x300", "100x75", "br", "95", "5120", "ok", ""},
+		{"c.jpg", "", "", "", "", "", "", "not an image", "failed to open: not an image"},
+		{"d.jpg", "", "", "", "", "", "", "decode error", "failed to decode: unexpected EOF"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("Got rows\n%v\nwant\n%v", rows, want)
+	}
+}
+
+func TestPlacementReport(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []placementEntry
+		want    []int // the x of the watermarks in the report, in order
+	}{
+		{"empty", nil, []int{}},
+		{"sorted by output", []placementEntry{{Output: "b.jpg", X: 1}, {Output: "a.jpg", X: 2}}, []int{2, 1}},
+		{"watermarks in drawing order", []placementEntry{{Output: "b.jpg", X: 3}, {Output: "a.jpg", X: 2}, {Output: "b.jpg", X: 1}}, []int{2, 3, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var report placementReport
+			for _, entry := range test.entries {
+				report.add(entry)
+			}
+			fname := filepath.Join(t.TempDir(), "placements.json")
+			if err := report.write(fname); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var entries []placementEntry
+			if err := json.Unmarshal(data, &entries); err != nil {
+				t.Fatalf("Could not parse the report: %s\n%s", err, data)
+			}
+			if entries == nil {
+				t.Fatalf("Got %s, want a JSON array", data)
+			}
+			xs := []int{}
+			for _, entry := range entries {
+				xs = append(xs, entry.X)
+			}
+			if !reflect.DeepEqual(xs, test.want) {
+				t.Errorf("Got watermarks at x %v, want %v", xs, test.want)
+			}
+		})
+	}
+}
+
+// svgSummary is the part of a placement SVG file the tests check
+type svgSummary struct {
+	Width  int `xml:"width,attr"`
+	Height int `xml:"height,attr"`
+	Images []struct {
+		Href string `xml:"href,attr"`
+	} `xml:"image"`
+	Rects  []struct{} `xml:"rect"`
+	Texts  []string   `xml:"text"`
+	Groups []struct {
+		Images []struct{} `xml:"image"`
+		Rects  []struct{} `xml:"rect"`
+	} `xml:"g"`
+}
+
+// readSVGSummary parses the SVG file fname, which must be well-formed XML
+func readSVGSummary(t *testing.T, fname string) svgSummary {
+	t.Helper()
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var svg svgSummary
+	if err := xml.Unmarshal(data, &svg); err != nil {
+		t.Fatalf("Could not parse %s: %s\n%s", fname, err, data)
+	}
+	return svg
+}
+
+func TestPlacementSVG(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "trip"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	newReport := func() *placementReport {
+		var report placementReport
+		report.add(placementEntry{Output: filepath.Join(dir, "trip", "b&c.jpg"), X: 10, Y: 10, Width: 50, Height: 20, outputSize: image.Pt(300, 200)})
+		report.add(placementEntry{Output: filepath.Join(dir, "a.jpg"), X: 5, Y: 5, Width: 40, Height: 10, outputSize: image.Pt(400, 100)})
+		report.add(placementEntry{Output: filepath.Join(dir, "trip", "b&c.jpg"), X: 200, Y: 150, Width: 50, Height: 20, outputSize: image.Pt(300, 200)})
+		return &report
+	}
+
+	t.Run("separate", func(t *testing.T) {
+		if err := newReport().writeSVG(dir, false); err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			fname         string
+			width, height int
+			href          string
+			rects         int
+		}{
+			{"a.svg", 400, 100, "a.jpg", 1},
+			{filepath.Join("trip", "b&c.svg"), 300, 200, "b&c.jpg", 2},
+		}
+		for _, test := range tests {
+			svg := readSVGSummary(t, filepath.Join(dir, test.fname))
+			if svg.Width != test.width || svg.Height != test.height {
+				t.Errorf("Got %s of %dx%d, want %dx%d", test.fname, svg.Width, svg.Height, test.width, test.height)
+			}
+			if len(svg.Images) != 1 || svg.Images[0].Href != test.href {
+				t.Errorf("Got images %v in %s, want %s", svg.Images, test.fname, test.href)
+			}
+			if len(svg.Rects) != test.rects {
+				t.Errorf("Got %d rectangles in %s, want %d", len(svg.Rects), test.fname, test.rects)
+			}
+		}
+	})
+
+	t.Run("combined", func(t *testing.T) {
+		if err := newReport().writeSVG(dir, true); err != nil {
+			t.Fatal(err)
+		}
+		svg := readSVGSummary(t, filepath.Join(dir, placementSVGName))
+		if want := 100 + 200 + 2*placementSVGGap; svg.Width != 400 || svg.Height != want {
+			t.Errorf("Got %dx%d, want 400x%d", svg.Width, svg.Height, want)
+		}
+		if want := []string{"a.jpg", "trip/b&c.jpg"}; !reflect.DeepEqual(svg.Texts, want) {
+			t.Errorf("Got names %v, want %v", svg.Texts, want)
+		}
+		if len(svg.Groups) != 2 || len(svg.Groups[0].Rects) != 1 || len(svg.Groups[1].Rects) != 2 {
+			t.Errorf("Got groups %+v, want one for a.jpg with 1 rectangle and one for b&c.jpg with 2", svg.Groups)
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, placementSVGName))
+		if strings.Contains(string(data), dir) {
+			t.Error("The combined SVG links the outputs by absolute path")
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// runState is the -state file of a run, which records the photos that are done so a run that
+// was interrupted can be resumed without processing them again. It has a line with the quoted
+// path of every photo that was written. Lines are appended with a single write as photos
+// finish, so an interrupted run leaves at most an incomplete last line, which is ignored.
+// It is safe for concurrent use.
+type runState struct {
+	mu    sync.Mutex
+	file  *os.File
+	fsync bool
+	done  map[string]bool
+}
+
+// openState reads the state file fname, or starts a new one when it doesn't exist. The photos
+// already done are rewritten to a fresh file first, which drops an incomplete last line and
+// replaces the file atomically.
+func openState(fname string, fsync bool) (*runState, error) {
+	state := &runState{fsync: fsync, done: map[string]bool{}}
+	data, err := os.ReadFile(fname)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	var valid []byte
+	for _, line := range lines[:len(lines)-1] { // the last line is empty or incomplete
+		relPath, err := strconv.Unquote(string(line))
+		if err != nil || state.done[relPath] {
+			continue
+		}
+		state.done[relPath] = true
+		valid = append(append(valid, line...), '\n')
+	}
+
+	tmp, err := createTemp(fname, "")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.Write(valid)
+	if err == nil && fsync {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := commitTemp(tmp.Name(), fname, false); err != nil {
+		return nil, err
+	}
+
+	state.file, err = os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// filter returns the files that are not done yet
+func (s *runState) filter(files []sourceFile) []sourceFile {
+	var todo []sourceFile
+	for _, file := range files {
+		if !s.done[file.relPath] {
+			todo = append(todo, file)
+		}
+	}
+	return todo
+}
+
+// markDone records that the photo relPath was written
+func (s *runState) markDone(relPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.WriteString(strconv.Quote(relPath) + "\n"); err != nil {
+		return err
+	}
+	if s.fsync {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+// Close closes the state file
+func (s *runState) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOpenState(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // of the state file, "" when there is none
+		done    []string
+	}{
+		{"new state", "", nil},
+		{"complete", "\"a.jpg\"\n\"trip/b.jpg\"\n", []string{"a.jpg", "trip/b.jpg"}},
+		{"interrupted write", "\"a.jpg\"\n\"trip/b.j", []string{"a.jpg"}},
+		{"duplicates", "\"a.jpg\"\n\"a.jpg\"\n", []string{"a.jpg"}},
+		{"broken line", "\"a.jpg\"\nnot quoted\n\"c.jpg\"\n", []string{"a.jpg", "c.jpg"}},
+		{"quoted names", "\"new\\nline.jpg\"\n", []string{"new\nline.jpg"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "run.state")
+			if test.content != "" {
+				if err := os.WriteFile(fname, []byte(test.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			state, err := openState(fname, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := state.markDone("z.jpg"); err != nil {
+				t.Fatal(err)
+			}
+			state.Close()
+
+			// The photos done before are kept, the broken lines dropped, and new photos appended
+			var done []string
+			for relPath := range state.done {
+				done = append(done, relPath)
+			}
+			sort.Strings(done)
+			if !reflect.DeepEqual(done, test.done) {
+				t.Errorf("Got done %q, want %q", done, test.done)
+			}
+			reopened, err := openState(fname, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reopened.Close()
+			if want := len(test.done) + 1; len(reopened.done) != want || !reopened.done["z.jpg"] {
+				t.Errorf("Reopened the state with %d photos done, want %d with z.jpg", len(reopened.done), want)
+			}
+		})
+	}
+}
+
+// TestResumeRun resumes a run that was interrupted after its first photo, and checks that only
+// the other photos are written, the same as an uninterrupted run writes them
+func TestResumeRun(t *testing.T) {
+	dir := t.TempDir()
+	newTestSource(t, dir)
+	args := []string{"-source", "photos", "-opacity-ramp", "-alternate"}
+	if code, out := runTool(t, dir, nil, append(args, "-target", "complete")...); code != exitSuccess {
+		t.Fatalf("The run exited with %d:\n%s", code, out)
+	}
+	complete := hashTree(t, filepath.Join(dir, "complete"))
+
+	if err := os.MkdirAll(filepath.Join(dir, "resumed"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "resumed", "a.jpg"), []byte("written before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "run.state"), []byte("\"a.jpg\"\n\"b.j"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, out := runTool(t, dir, nil, append(args, "-target", "resumed", "-state", "run.state")...)
+	if code != exitSuccess {
+		t.Fatalf("The resumed run exited with %d:\n%s", code, out)
+	}
+	if !strings.Contains(out, "Resuming: 1 of 3 files are already done") {
+		t.Errorf("The resumed run didn't report the photo done before:\n%s", out)
+	}
+	resumed := hashTree(t, filepath.Join(dir, "resumed"))
+	if data, _ := os.ReadFile(filepath.Join(dir, "resumed", "a.jpg")); string(data) != "written before" {
+		t.Error("The photo done before was written again")
+	}
+	for name, hash := range complete {
+		if name != "a.jpg" && resumed[name] != hash {
+			t.Errorf("The resumed run wrote %s differently from an uninterrupted run", name)
+		}
+	}
+
+	state, err := os.ReadFile(filepath.Join(dir, "run.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(state)), "\n")
+	sort.Strings(lines)
+	if want := []string{`"a.jpg"`, `"b.jpg"`, `"c.png"`}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("The state file holds %q, want %q", lines, want)
+	}
+}
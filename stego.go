@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+)
+
+// The invisible watermark is stored in the least significant bit of the red, green and blue
+// channels of the fully opaque pixels, in row order from the top left. Transparent pixels,
+// such as the corners of -shape, are skipped, as saving them with straight alpha loses their
+// colors. It is laid out as a magic marker,
+// the length of the text, the text itself and a CRC-32 checksum of the text.
+//
+// Changing the lowest bit of a channel is not visible, but it is also fragile: the text
+// survives lossless formats such as PNG, but not JPEG compression, resizing, cropping or any
+// other edit of the pixels. It proves an untouched copy came from this tool, nothing more.
+var stegoMagic = []byte("WMK1")
+
+var errNoInvisibleText = errors.New("no invisible text found")
+
+// embedText hides text in the pixels of img
+func embedText(img *image.RGBA, text string) error {
+	payload := new(bytes.Buffer)
+	payload.Write(stegoMagic)
+	binary.Write(payload, binary.BigEndian, uint32(len(text)))
+	payload.WriteString(text)
+	binary.Write(payload, binary.BigEndian, crc32.ChecksumIEEE([]byte(text)))
+
+	data := payload.Bytes()
+	if capacity := stegoCapacity(img) / 8; len(data) > capacity {
+		size := img.Rect.Size()
+		return fmt.Errorf("invisible text of %d bytes does not fit in the opaque pixels of a %dx%d photo", len(text), size.X, size.Y)
+	}
+
+	next := stegoChannels(img)
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			offset, _ := next()
+			img.Pix[offset] = img.Pix[offset]&^1 | (b>>uint(i))&1
+		}
+	}
+	return nil
+}
+
+// extractText returns the text hidden in img by embedText
+func extractText(img image.Image) (string, error) {
+	rgba := toRGBA(img)
+	capacity := stegoCapacity(rgba)
+	next := stegoChannels(rgba)
+	readBytes := func(n int) ([]byte, bool) {
+		out := make([]byte, n)
+		for i := range out {
+			for j := 0; j < 8; j++ {
+				offset, ok := next()
+				if !ok {
+					return nil, false
+				}
+				out[i] = out[i]<<1 | rgba.Pix[offset]&1
+			}
+		}
+		return out, true
+	}
+
+	header, ok := readBytes(len(stegoMagic) + 4)
+	if !ok || !bytes.Equal(header[:len(stegoMagic)], stegoMagic) {
+		return "", errNoInvisibleText
+	}
+	length := binary.BigEndian.Uint32(header[len(stegoMagic):])
+	if int64(length) > int64(capacity/8) {
+		return "", errNoInvisibleText
+	}
+	text, ok := readBytes(int(length) + 4)
+	if !ok {
+		return "", errNoInvisibleText
+	}
+	if crc32.ChecksumIEEE(text[:length]) != binary.BigEndian.Uint32(text[length:]) {
+		return "", fmt.Errorf("%w: the image was modified after the text was hidden", errNoInvisibleText)
+	}
+	return string(text[:length]), nil
+}
+
+// stegoChannels returns a function that returns the index in img.Pix of the color channel
+// holding the next bit, or false once all are used. It skips the alpha channels and the pixels
+// that are not fully opaque.
+func stegoChannels(img *image.RGBA) func() (int, bool) {
+	x, y, channel := img.Rect.Min.X, img.Rect.Min.Y, 0
+	return func() (int, bool) {
+		for y < img.Rect.Max.Y {
+			offset := img.PixOffset(x, y)
+			if img.Pix[offset+3] == 0xff && channel < 3 {
+				channel++
+				return offset + channel - 1, true
+			}
+			channel = 0
+			if x++; x == img.Rect.Max.X {
+				x, y = img.Rect.Min.X, y+1
+			}
+		}
+		return 0, false
+	}
+}
+
+// stegoCapacity returns the number of bits img can hold, three for every fully opaque pixel
+func stegoCapacity(img *image.RGBA) int {
+	bits := 0
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			if img.Pix[img.PixOffset(x, y)+3] == 0xff {
+				bits += 3
+			}
+		}
+	}
+	return bits
+}
+
+// readInvisibleText decodes the image at fname and returns the text hidden in it. On failure it
+// prints the problem and returns the exit code to use.
+func readInvisibleText(fname string) (string, int) {
+	file, err := os.Open(fname)
+	if err != nil {
+		console.Printf("ERROR: Could not open '%s': %s\n", fname, err)
+		return "", exitIO
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		console.Printf("ERROR: Could not decode '%s': %s\n", fname, err)
+		return "", exitIO
+	}
+	text, err := extractText(img)
+	if err != nil {
+		console.Printf("'%s': %s\n", fname, err)
+		return "", exitPartial
+	}
+	return text, exitSuccess
+}
+
+// extractMode implements -extract: it prints the invisible text of an image and returns the exit code
+func extractMode(fname string) int {
+	text, code := readInvisibleText(fname)
+	if code == exitSuccess {
+		console.Println(text)
+	}
+	return code
+}
+
+// verifyMode implements -verify: it checks the invisible text of an image is the expected
+// text, to prove where a copy came from, and returns the exit code
+func verifyMode(fname string, expected string) int {
+	text, code := readInvisibleText(fname)
+	if code != exitSuccess {
+		return code
+	}
+	if text != expected {
+		console.Printf("MISMATCH: '%s' carries '%s', not '%s'\n", fname, text, expected)
+		return exitPartial
+	}
+	console.Printf("VERIFIED: '%s' carries '%s'\n", fname, text)
+	return exitSuccess
+}
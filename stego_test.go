@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPhoto returns a photo with a gradient, so the lowest bits vary like in a real photo
+func testPhoto(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 7), uint8(y * 5), uint8(x + y), 0xff})
+		}
+	}
+	return img
+}
+
+func TestInvisibleTextRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		shape string
+		text  string
+	}{
+		{"opaque", "", "© 2024 Jane Doe"},
+		{"circle", "circle", "© 2024 Jane Doe"},
+		{"rounded", "rounded", "order 4711"},
+		{"empty text", "circle", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := testPhoto(64, 48)
+			if test.shape != "" {
+				cutShape(img, test.shape, 30)
+			}
+			if err := embedText(img, test.text); err != nil {
+				t.Fatal(err)
+			}
+			// Saving with straight alpha loses the colors of transparent pixels
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := png.Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, err := extractText(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != test.text {
+				t.Errorf("extracted '%s', want '%s'", text, test.text)
+			}
+		})
+	}
+}
+
+func TestInvisibleTextErrors(t *testing.T) {
+	if _, err := extractText(testPhoto(32, 32)); !errors.Is(err, errNoInvisibleText) {
+		t.Errorf("photo without text: got %v, want %v", err, errNoInvisibleText)
+	}
+
+	img := testPhoto(32, 32)
+	if err := embedText(img, "text"); err != nil {
+		t.Fatal(err)
+	}
+	img.Pix[4*8*3] ^= 1 // a bit of the text
+	if _, err := extractText(img); !errors.Is(err, errNoInvisibleText) {
+		t.Errorf("modified photo: got %v, want %v", err, errNoInvisibleText)
+	}
+
+	// 16 opaque pixels hold 6 bytes, less than the marker, length and checksum
+	small := testPhoto(8, 8)
+	for i := 3; i < len(small.Pix)/4*3; i += 4 {
+		small.Pix[i] = 0
+	}
+	if err := embedText(small, "x"); err == nil {
+		t.Error("text that does not fit in the opaque pixels was hidden")
+	}
+}
+
+// TestExtractAndVerify hides a text in a batch, and reads it back from the output files with
+// -extract and -verify
+func TestExtractAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	newTestSource(t, dir)
+	const text = "© 2024 Jane Doe, order 4711"
+	if code, out := runTool(t, dir, nil, "-source", "photos", "-target", "target", "-output-format", "png", "-invisible", text); code != exitSuccess {
+		t.Fatalf("The run exited with %d:\n%s", code, out)
+	}
+	tests := []struct {
+		name   string
+		args   []string
+		want   int
+		output string
+	}{
+		{"extract", []string{"-extract", "target/a.png"}, exitSuccess, text},
+		{"verify", []string{"-verify", "target/b.png", "-invisible", text}, exitSuccess, "VERIFIED"},
+		{"verify other text", []string{"-verify", "target/b.png", "-invisible", "someone else"}, exitPartial, "MISMATCH"},
+		{"verify without text", []string{"-verify", "target/b.png"}, exitUsage, "-invisible"},
+		{"photo without text", []string{"-extract", "photos/c.png"}, exitPartial, errNoInvisibleText.Error()},
+		{"JPEG photo", []string{"-extract", filepath.Join("photos", "a.jpg")}, exitPartial, errNoInvisibleText.Error()},
+		{"missing file", []string{"-extract", "missing.png"}, exitIO, "Could not open"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, out := runTool(t, dir, nil, test.args...)
+			if code != test.want {
+				t.Errorf("Got exit code %d, want %d:\n%s", code, test.want, out)
+			}
+			if !strings.Contains(out, test.output) {
+				t.Errorf("The output doesn't mention %q:\n%s", test.output, out)
+			}
+		})
+	}
+}
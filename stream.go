@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+
+	"golang.org/x/image/tiff"
+)
+
+// streamMode watermarks a single photo read from stdin and writes it to stdout, for use in
+// pipelines and web services. All messages go to stderr so they don't mix with the image.
+// It returns the exit code.
+func streamMode(params parameters) int {
+	renditions := newRenditions(params)
+	if len(renditions) > 1 || params.contactSheet || params.heatmap || params.csvReport != "" || params.srgb || params.subjectMasks || params.stateFile != "" || params.interactive || params.emitPlacement != "" || params.placementSVG || params.filesFrom != "" || params.textTemplate != "" || params.watermarkDir != "" || params.watermarkRandomDir != "" || params.noRecompress || params.compare != "" {
+		console.Println("ERROR: -source - writes a single photo, it can not be used with -sizes, -web-size, -proof, -final, -contact-sheet, -heatmap, -csv, -srgb, -subject-masks, -state, -interactive, -emit-placement, -placement-svg, -files-from, -text-template, -watermark-dir, -watermark-random-dir, -no-recompress or -compare")
+		return exitUsage
+	}
+	watermark, err := loadWatermark(params)
+	if err != nil {
+		console.Printf("ERROR: Could not read watermark file '%s': %s\n", params.watermark, err)
+		return exitIO
+	}
+	b := newBatch(params, watermark, renditions)
+
+	photo, err := decodeStream(os.Stdin)
+	if err != nil {
+		console.Printf("ERROR: Could not read photo from stdin: %s\n", err)
+		return exitIO
+	}
+	size := photo.Bounds().Size()
+	if err := b.checkConfig(image.Config{Width: size.X, Height: size.Y}); err != nil {
+		console.Skipf("stdin", false, "Skipping photo from stdin: %s\n", err)
+		return exitPartial
+	}
+	output, _, err := b.renderRendition(photoSettings{name: "stdin", location: params.location, opacity: -1, watermark: b.watermark}, rotate(photo, params.rotateSource), renditions[0])
+	if err != nil {
+		console.Printf("ERROR: Could not watermark photo from stdin: %s\n", err)
+		return exitPartial
+	}
+
+	stdout := bufio.NewWriter(os.Stdout)
+	if err := writeStream(stdout, output, b.save, params.base64); err != nil {
+		console.Printf("ERROR: Could not write photo to stdout: %s\n", err)
+		return exitIO
+	}
+	if err := stdout.Flush(); err != nil {
+		console.Printf("ERROR: Could not write photo to stdout: %s\n", err)
+		return exitIO
+	}
+	console.Println("Done! Watermarked photo from stdin")
+	return exitSuccess
+}
+
+// decodeStream decodes a JPEG or PNG photo from r, recognised by its contents as there is no file name
+func decodeStream(r io.Reader) (image.Image, error) {
+	reader := bufio.NewReader(r)
+	header, _ := reader.Peek(8)
+	if len(header) == 0 {
+		return nil, fmt.Errorf("%w: input is empty", errNotAnImage)
+	}
+
+	var photo image.Image
+	var err error
+	switch sniffFormat(header) {
+	case "jpeg":
+		photo, err = jpeg.Decode(reader)
+	case "png":
+		photo, err = png.Decode(reader)
+	case "tiff":
+		photo, err = tiff.Decode(reader)
+	default:
+		return nil, fmt.Errorf("%w: input is not JPEG, PNG or TIFF data", errNotAnImage)
+	}
+	if err != nil {
+		return nil, &decodeError{err}
+	}
+	return photo, nil
+}
+
+// writeStream encodes img to w, or with asBase64 writes it as a data URI such as "data:image/jpeg;base64,..."
+func writeStream(w io.Writer, img image.Image, opts saveOptions, asBase64 bool) error {
+	if !asBase64 {
+		_, err := encodeImage(w, img, opts)
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "data:%s;base64,", mimeTypes[opts.format]); err != nil {
+		return err
+	}
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := encodeImage(encoder, img, opts); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestDecodeStream(t *testing.T) {
+	photo := testPhoto(32, 24)
+	var jpegData, pngData, tiffData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, photo, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngData, photo); err != nil {
+		t.Fatal(err)
+	}
+	if err := tiff.Encode(&tiffData, photo, nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		data        []byte
+		notAnImage  bool
+		decodeError bool
+	}{
+		{"jpeg", jpegData.Bytes(), false, false},
+		{"png", pngData.Bytes(), false, false},
+		{"tiff", tiffData.Bytes(), false, false},
+		{"empty", nil, true, false},
+		{"text", []byte("not a photo at all"), true, false},
+		{"truncated png", pngData.Bytes()[:pngData.Len()/2], false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img, err := decodeStream(bytes.NewReader(test.data))
+			var decodeErr *decodeError
+			switch {
+			case test.notAnImage:
+				if !errors.Is(err, errNotAnImage) {
+					t.Errorf("Got error %v, want %v", err, errNotAnImage)
+				}
+			case test.decodeError:
+				if !errors.As(err, &decodeErr) {
+					t.Errorf("Got error %v, want a decode error", err)
+				}
+			case err != nil:
+				t.Errorf("Got error %v", err)
+			case img.Bounds() != photo.Bounds():
+				t.Errorf("Got bounds %v, want %v", img.Bounds(), photo.Bounds())
+			}
+		})
+	}
+}
+
+func TestWriteStream(t *testing.T) {
+	photo := testPhoto(32, 24)
+	tests := []struct {
+		format   string
+		asBase64 bool
+		prefix   string
+	}{
+		{"jpeg", false, "\xff\xd8\xff"},
+		{"png", false, "\x89PNG"},
+		{"jpeg", true, "data:image/jpeg;base64,"},
+		{"png", true, "data:image/png;base64,"},
+	}
+	for _, test := range tests {
+		name := test.format
+		if test.asBase64 {
+			name += " base64"
+		}
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := writeStream(&out, photo, saveOptions{format: test.format}, test.asBase64); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(out.String(), test.prefix) {
+				t.Fatalf("Got output starting with %q, want %q", out.String()[:minInt(out.Len(), 24)], test.prefix)
+			}
+			data := out.Bytes()
+			if test.asBase64 {
+				if !strings.HasSuffix(out.String(), "\n") {
+					t.Error("The data URI doesn't end with a newline")
+				}
+				var err error
+				if data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(out.String(), test.prefix))); err != nil {
+					t.Fatalf("Could not decode the data URI: %s", err)
+				}
+			}
+			img, err := decodeStream(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Could not decode the output: %s", err)
+			}
+			if img.Bounds() != photo.Bounds() {
+				t.Errorf("Got bounds %v, want %v", img.Bounds(), photo.Bounds())
+			}
+		})
+	}
+}
+
+func TestStreamMode(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "watermark.png"), testWatermark(60, 20))
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, testPhoto(320, 240), nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		args  []string
+		stdin []byte
+		want  int
+	}{
+		{"jpeg", nil, photo.Bytes(), exitSuccess},
+		{"png output", []string{"-output-format", "png"}, photo.Bytes(), exitSuccess},
+		{"not a photo", nil, []byte("not a photo"), exitIO},
+		{"several renditions", []string{"-sizes", "200,100"}, photo.Bytes(), exitUsage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], append([]string{"-no-banner", "-source", "-", "-watermark", "watermark.png"}, test.args...)...)
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), runMainEnv+"=1")
+			cmd.Stdin = bytes.NewReader(test.stdin)
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			code := exitSuccess
+			var exitErr *exec.ExitError
+			if err := cmd.Run(); errors.As(err, &exitErr) {
+				code = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if code != test.want {
+				t.Fatalf("Got exit code %d, want %d:\n%s", code, test.want, stderr.String())
+			}
+			if code != exitSuccess {
+				if stdout.Len() != 0 {
+					t.Errorf("The failed run wrote %d bytes to stdout", stdout.Len())
+				}
+				return
+			}
+			// Messages must go to stderr, so stdout holds nothing but the photo
+			img, err := decodeStream(&stdout)
+			if err != nil {
+				t.Fatalf("Could not decode stdout: %s", err)
+			}
+			if want := image.Rect(0, 0, 320, 240); img.Bounds() != want {
+				t.Errorf("Got bounds %v, want %v", img.Bounds(), want)
+			}
+		})
+	}
+}
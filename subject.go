@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// subjectMaskSuffix replaces the extension of a photo for the name of its subject mask, so the
+// mask of trip/photo.jpg is trip/photo.mask.png
+const subjectMaskSuffix = ".mask.png"
+
+// subjectMaskName returns the name of the subject mask of the photo fname
+func subjectMaskName(fname string) string {
+	return strings.TrimSuffix(fname, path.Ext(fname)) + subjectMaskSuffix
+}
+
+// isSubjectMask reports whether a file is a subject mask, which is not watermarked itself
+func isSubjectMask(fname string) bool {
+	return strings.HasSuffix(strings.ToLower(fname), subjectMaskSuffix)
+}
+
+// loadSubjectMask reads the subject mask of the photo fname in fsys, or returns nil when the
+// photo has none. The subject is where the mask is opaque, or for a mask without transparency
+// where it is white, so both cutouts and black and white masks work.
+func loadSubjectMask(fsys fs.FS, fname string) (*image.Alpha, error) {
+	img, err := openImage(fsys, subjectMaskName(fname), "png")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	mask := image.NewAlpha(image.Rectangle{Max: bounds.Size()})
+	_, gray := img.(*image.Gray)
+	_, gray16 := img.(*image.Gray16)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.At(x, y)
+			var alpha uint8
+			if gray || gray16 {
+				alpha = color.GrayModel.Convert(c).(color.Gray).Y
+			} else {
+				_, _, _, a := c.RGBA()
+				alpha = uint8(a >> 8)
+			}
+			mask.Pix[mask.PixOffset(x-bounds.Min.X, y-bounds.Min.Y)] = alpha
+		}
+	}
+	return mask, nil
+}
+
+// fitSubjectMask scales a subject mask to the size of the photo of a rendition
+func fitSubjectMask(mask image.Image, size image.Point) image.Image {
+	if mask.Bounds().Size() == size {
+		return mask
+	}
+	return resize.Resize(uint(size.X), uint(size.Y), mask, resize.Bilinear)
+}
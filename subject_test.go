@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSubjectMaskName(t *testing.T) {
+	tests := []struct {
+		fname  string
+		want   string
+		isMask bool
+	}{
+		{"photo.jpg", "photo.mask.png", false},
+		{"trip/photo.JPG", "trip/photo.mask.png", false},
+		{"photo.tar.jpg", "photo.tar.mask.png", false},
+		{"photo.mask.png", "photo.mask.mask.png", true},
+		{"trip/PHOTO.MASK.PNG", "trip/PHOTO.MASK.mask.png", true},
+		{"mask.png", "mask.mask.png", false},
+	}
+	for _, test := range tests {
+		t.Run(test.fname, func(t *testing.T) {
+			if got := subjectMaskName(test.fname); got != test.want {
+				t.Errorf("Got mask name %s, want %s", got, test.want)
+			}
+			if got := isSubjectMask(test.fname); got != test.isMask {
+				t.Errorf("Got isSubjectMask %v, want %v", got, test.isMask)
+			}
+		})
+	}
+}
+
+// encodeTestPNG returns img encoded as PNG
+func encodeTestPNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLoadSubjectMask(t *testing.T) {
+	// The subject is the left half of every mask
+	gray := image.NewGray(image.Rect(0, 0, 4, 2))
+	cutout := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			gray.SetGray(x, y, color.Gray{0xff})
+			// A black subject, so only the transparency can tell it apart
+			cutout.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 0xff})
+		}
+		cutout.SetNRGBA(2, y, color.NRGBA{0xff, 0xff, 0xff, 0})
+	}
+	fsys := fstest.MapFS{
+		"gray.mask.png":   {Data: encodeTestPNG(t, gray)},
+		"cutout.mask.png": {Data: encodeTestPNG(t, cutout)},
+		"broken.mask.png": {Data: []byte("not a mask")},
+	}
+	tests := []struct {
+		fname   string
+		want    []uint8 // the mask, nil for none
+		wantErr bool
+	}{
+		{"gray.jpg", []uint8{0xff, 0xff, 0, 0, 0xff, 0xff, 0, 0}, false},
+		{"cutout.jpg", []uint8{0xff, 0xff, 0, 0, 0xff, 0xff, 0, 0}, false},
+		{"none.jpg", nil, false},
+		{"broken.jpg", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.fname, func(t *testing.T) {
+			mask, err := loadSubjectMask(fsys, test.fname)
+			if test.wantErr {
+				if err == nil {
+					t.Error("Loading the broken mask succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.want == nil {
+				if mask != nil {
+					t.Errorf("Got a mask of %v for a photo without one", mask.Rect)
+				}
+				return
+			}
+			if mask == nil {
+				t.Fatal("Got no mask")
+			}
+			if !bytes.Equal(mask.Pix, test.want) {
+				t.Errorf("Got mask %v, want %v", mask.Pix, test.want)
+			}
+		})
+	}
+}
+
+func TestFitSubjectMask(t *testing.T) {
+	mask := image.NewAlpha(image.Rect(0, 0, 40, 20))
+	for i := range mask.Pix {
+		mask.Pix[i] = 0xff
+	}
+	tests := []struct {
+		size image.Point
+		same bool
+	}{
+		{image.Pt(40, 20), true},
+		{image.Pt(20, 10), false},
+		{image.Pt(80, 40), false},
+	}
+	for _, test := range tests {
+		fitted := fitSubjectMask(mask, test.size)
+		if got := fitted.Bounds().Size(); got != test.size {
+			t.Errorf("Got size %v, want %v", got, test.size)
+		}
+		if same := fitted == image.Image(mask); same != test.same {
+			t.Errorf("Got the same mask %v for %v, want %v", same, test.size, test.same)
+		}
+		if _, _, _, a := fitted.At(test.size.X/2, test.size.Y/2).RGBA(); a != 0xffff {
+			t.Errorf("Got alpha %#x in the scaled mask, want %#x", a, 0xffff)
+		}
+	}
+}
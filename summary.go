@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxListedUnfinished is the number of files not processed in a stopped run that are listed
+const maxListedUnfinished = 10
+
+// runSummary counts the outcome of every file in a run. It is safe for concurrent use.
+type runSummary struct {
+	mu         sync.Mutex
+	edited     int
+	skipped    map[string]int
+	failed     int      // skipped files that failed, rather than being skipped on purpose
+	unfinished []string // files not processed because the run was stopped
+	dimensions map[image.Point]int
+	durations  map[string]time.Duration // processing time of every file, for -timings
+	watermarks map[string]int           // photos per watermark of -watermark-random-dir
+}
+
+func (s *runSummary) edit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.edited++
+}
+
+// recordDimensions counts a decoded photo of the given size, for the -stats report
+func (s *runSummary) recordDimensions(size image.Point) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dimensions == nil {
+		s.dimensions = map[image.Point]int{}
+	}
+	s.dimensions[size]++
+}
+
+// recordWatermark counts a photo watermarked with the -watermark-random-dir watermark name
+func (s *runSummary) recordWatermark(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watermarks == nil {
+		s.watermarks = map[string]int{}
+	}
+	s.watermarks[name]++
+}
+
+// recordDuration records how long processing a file took, for the -timings report
+func (s *runSummary) recordDuration(relPath string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.durations == nil {
+		s.durations = map[string]time.Duration{}
+	}
+	s.durations[relPath] = d
+}
+
+// skip records a file that was not watermarked, and returns the reason it is counted under
+func (s *runSummary) skip(err error) string {
+	reason := skipReason(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.skipped == nil {
+		s.skipped = map[string]int{}
+	}
+	s.skipped[reason]++
+	if !skippedOnPurpose(err) {
+		s.failed++
+	}
+	return reason
+}
+
+// abort records a file that was not processed because the run was stopped
+func (s *runSummary) abort(relPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unfinished = append(s.unfinished, relPath)
+}
+
+// skippedCount returns the number of files skipped so far
+func (s *runSummary) skippedCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for _, count := range s.skipped {
+		total += count
+	}
+	return total
+}
+
+func (s *runSummary) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.unfinished) > 0 {
+		// Only the first files are listed, the log file gets all of them
+		sort.Strings(s.unfinished)
+		console.Printf("Stopped early, %d files were not processed:\n", len(s.unfinished))
+		for i, file := range s.unfinished {
+			if i < maxListedUnfinished {
+				console.Printf("- %s\n", file)
+			} else {
+				console.Logf("- %s\n", file)
+			}
+		}
+		if len(s.unfinished) > maxListedUnfinished {
+			console.Printf("  and %d more\n", len(s.unfinished)-maxListedUnfinished)
+		}
+	}
+	if len(s.skipped) == 0 {
+		return
+	}
+	reasons := make([]string, 0, len(s.skipped))
+	total := 0
+	for reason, count := range s.skipped {
+		reasons = append(reasons, reason)
+		total += count
+	}
+	sort.Strings(reasons)
+	console.Printf("Skipped %d files:\n", total)
+	for _, reason := range reasons {
+		console.Printf("- %-20s %d\n", reason+":", s.skipped[reason])
+	}
+}
+
+// printWatermarks reports how many photos got each watermark of -watermark-random-dir, by name
+func (s *runSummary) printWatermarks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.watermarks))
+	for name := range s.watermarks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	console.Println("Watermarks used:")
+	for _, name := range names {
+		console.Printf("- %-20s %d\n", name+":", s.watermarks[name])
+	}
+}
+
+// printDimensions reports how many photos of each resolution were seen, most common first
+func (s *runSummary) printDimensions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sizes := make([]image.Point, 0, len(s.dimensions))
+	for size := range s.dimensions {
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		if s.dimensions[sizes[i]] != s.dimensions[sizes[j]] {
+			return s.dimensions[sizes[i]] > s.dimensions[sizes[j]]
+		}
+		return sizes[i].X*sizes[i].Y > sizes[j].X*sizes[j].Y
+	})
+	console.Printf("Found %d distinct photo resolutions:\n", len(sizes))
+	for _, size := range sizes {
+		console.Printf("- %-20s %d\n", fmt.Sprintf("%dx%d:", size.X, size.Y), s.dimensions[size])
+	}
+}
+
+// printSlowest reports the n files that took the longest to process, slowest first
+func (s *runSummary) printSlowest(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make([]string, 0, len(s.durations))
+	for file := range s.durations {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if s.durations[files[i]] != s.durations[files[j]] {
+			return s.durations[files[i]] > s.durations[files[j]]
+		}
+		return files[i] < files[j]
+	})
+	if len(files) > n {
+		files = files[:n]
+	}
+	console.Printf("Slowest %d files:\n", len(files))
+	for _, file := range files {
+		console.Printf("- %-12s %s\n", s.durations[file].Round(time.Millisecond), file)
+	}
+}
+
+// exitCode returns the process exit code for the outcome of the run. Files skipped on purpose
+// don't make it a partial success, so a folder with a README in it can still succeed.
+func (s *runSummary) exitCode() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.unfinished) > 0 {
+		return exitAborted
+	}
+	if s.failed > 0 {
+		return exitPartial
+	}
+	return exitSuccess
+}
+
+// skippedOnPurpose reports whether a file was skipped because the options of the run leave it
+// out, such as other file types, rather than because it failed. Those don't count towards
+// -max-errors or the exit code.
+func skippedOnPurpose(err error) bool {
+	return errors.Is(err, errUnsupportedType) || errors.Is(err, errTooSmall) || errors.Is(err, errWatermarkTooLarge)
+}
+
+// skipReason maps a processing error to the category it is reported under in the summary
+func skipReason(err error) string {
+	var decodeErr *decodeError
+	switch {
+	case errors.Is(err, errUnsupportedType):
+		return "unsupported type"
+	case errors.Is(err, errNotAnImage):
+		return "not an image"
+	case errors.As(err, &decodeErr):
+		return "decode error"
+	case errors.Is(err, errTooSmall):
+		return "too small"
+	case errors.Is(err, errOutputExists):
+		return "already exists"
+	case errors.Is(err, errVerifyFailed):
+		return "verify failed"
+	case errors.Is(err, errWatermarkTooLarge):
+		return "watermark too large"
+	case errors.Is(err, errTimeout):
+		return "timeout"
+	case errors.Is(err, errPanic):
+		return "crashed"
+	}
+	return "error"
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestSkipReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errUnsupportedType, "unsupported type"},
+		{fmt.Errorf("failed to open: %w", errNotAnImage), "not an image"},
+		{&decodeError{io.ErrUnexpectedEOF}, "decode error"},
+		{fmt.Errorf("photo: %w", &decodeError{errors.New("bad huffman code")}), "decode error"},
+		{fmt.Errorf("%w: 10x10", errTooSmall), "too small"},
+		{errOutputExists, "already exists"},
+		{errVerifyFailed, "verify failed"},
+		{errWatermarkTooLarge, "watermark too large"},
+		{fmt.Errorf("after 5s: %w", errTimeout), "timeout"},
+		{errPanic, "crashed"},
+		{errors.New("disk full"), "error"},
+	}
+	for _, test := range tests {
+		t.Run(test.err.Error(), func(t *testing.T) {
+			if got := skipReason(test.err); got != test.want {
+				t.Errorf("Got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunSummaryExitCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		skipped []error
+		aborted []string
+		want    int
+	}{
+		{"all edited", nil, nil, exitSuccess},
+		{"some failed", []error{errNotAnImage, errTooSmall, errNotAnImage}, nil, exitPartial},
+		{"skipped on purpose", []error{errUnsupportedType, fmt.Errorf("%w: 10x10", errTooSmall)}, nil, exitSuccess},
+		{"stopped", nil, []string{"b.jpg"}, exitAborted},
+		{"stopped after skipping", []error{errNotAnImage}, []string{"b.jpg", "c.jpg"}, exitAborted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var summary runSummary
+			summary.edit()
+			for _, err := range test.skipped {
+				summary.skip(err)
+			}
+			for _, relPath := range test.aborted {
+				summary.abort(relPath)
+			}
+			if got := summary.skippedCount(); got != len(test.skipped) {
+				t.Errorf("Got %d skipped, want %d", got, len(test.skipped))
+			}
+			if got := summary.exitCode(); got != test.want {
+				t.Errorf("Got exit code %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// svgWatermark is a watermark read from an SVG file. It is an image of the SVG at the size of its
+// view box, which the size of the watermark is computed from like that of a PNG watermark, but
+// scaleWatermark renders the SVG again at every size so vector logos stay sharp.
+type svgWatermark struct {
+	*image.RGBA
+	mu        sync.Mutex // rendering changes the target of the icon
+	icon      *oksvg.SvgIcon
+	recolor   []colorMapping
+	tolerance int
+}
+
+// loadSVGWatermark reads an SVG watermark. The -recolor mappings are applied to every render.
+func loadSVGWatermark(fname string, mappings []colorMapping, tolerance int) (*svgWatermark, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	icon, err := oksvg.ReadIconStream(file)
+	if err != nil {
+		return nil, &decodeError{err}
+	}
+	size := image.Point{int(math.Round(icon.ViewBox.W)), int(math.Round(icon.ViewBox.H))}
+	if size.X <= 0 || size.Y <= 0 {
+		return nil, &decodeError{errors.New("the SVG has no size, give it a viewBox")}
+	}
+	svg := &svgWatermark{icon: icon, recolor: mappings, tolerance: tolerance}
+	svg.RGBA = svg.render(size)
+	return svg, nil
+}
+
+// render draws the SVG scaled to size
+func (s *svgWatermark) render(size image.Point) *image.RGBA {
+	img := image.NewRGBA(image.Rectangle{Max: size})
+	s.mu.Lock()
+	s.icon.SetTarget(0, 0, float64(size.X), float64(size.Y))
+	scanner := rasterx.NewScannerGV(size.X, size.Y, img, img.Rect)
+	s.icon.Draw(rasterx.NewDasher(size.X, size.Y, scanner), 1)
+	s.mu.Unlock()
+	if len(s.recolor) > 0 {
+		recolorPremultiplied(img, s.recolor, s.tolerance)
+	}
+	return img
+}
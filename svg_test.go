@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLoadSVGWatermark(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name        string
+		content     string
+		want        image.Point
+		decodeError bool
+	}{
+		{"view box", testSVG, image.Pt(200, 100), false},
+		{"fractional view box", `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 99.6 20.4"><rect width="99.6" height="20.4"/></svg>`, image.Pt(100, 20), false},
+		{"no size", `<svg xmlns="http://www.w3.org/2000/svg"><rect width="10" height="10"/></svg>`, image.Point{}, true},
+		{"not an svg", "not a watermark <", image.Point{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fname := filepath.Join(dir, test.name+".svg")
+			if err := os.WriteFile(fname, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			svg, err := loadSVGWatermark(fname, nil, 0)
+			var decodeErr *decodeError
+			if test.decodeError {
+				if !errors.As(err, &decodeErr) {
+					t.Errorf("Got error %v, want a decode error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := svg.Bounds().Size(); got != test.want {
+				t.Errorf("Got size %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := loadSVGWatermark(filepath.Join(dir, "missing.svg"), nil, 0); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Got error %v, want %v", err, fs.ErrNotExist)
+		}
+	})
+}
+
+func TestSVGRender(t *testing.T) {
+	red, blue := color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff}
+	tests := []struct {
+		name     string
+		mappings []colorMapping
+		size     image.Point
+		// The colors at the center and on the black frame, the corners are transparent
+		center, frame color.RGBA
+	}{
+		{"view box size", nil, image.Pt(200, 100), red, color.RGBA{0, 0, 0, 0xff}},
+		{"upscaled", nil, image.Pt(800, 400), red, color.RGBA{0, 0, 0, 0xff}},
+		{"downscaled", nil, image.Pt(100, 50), red, color.RGBA{0, 0, 0, 0xff}},
+		{"recolored", []colorMapping{{red, blue}}, image.Pt(400, 200), blue, color.RGBA{0, 0, 0, 0xff}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svg := loadTestSVG(t, test.mappings)
+			scaled, ok := scaleWatermark(svg, test.size, false).(*image.RGBA)
+			if !ok {
+				t.Fatalf("Got a %T, want the SVG rendered again", scaled)
+			}
+			if scaled.Rect.Size() != test.size {
+				t.Fatalf("Got size %v, want %v", scaled.Rect.Size(), test.size)
+			}
+			at := func(fx, fy float64) color.RGBA {
+				return scaled.RGBAAt(int(fx*float64(test.size.X)), int(fy*float64(test.size.Y)))
+			}
+			if got := at(0.5, 0.5); got != test.center {
+				t.Errorf("Got %v at the center, want %v", got, test.center)
+			}
+			if got := at(0.2, 0.5); got != test.frame {
+				t.Errorf("Got %v on the frame, want %v", got, test.frame)
+			}
+			if got := at(0.01, 0.01); got.A != 0 {
+				t.Errorf("Got %v in the corner, want transparent", got)
+			}
+		})
+	}
+}
+
+// TestSVGRenderConcurrent renders the SVG at several sizes at the same time, as the workers
+// of a run do with photos of different sizes
+func TestSVGRenderConcurrent(t *testing.T) {
+	svg := loadTestSVG(t, nil)
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(size image.Point) {
+			defer wg.Done()
+			img := svg.render(size)
+			if got := img.RGBAAt(size.X/2, size.Y/2); got != (color.RGBA{0xff, 0, 0, 0xff}) {
+				t.Errorf("Got %v at the center of %v, want red", got, size)
+			}
+		}(image.Pt(100*i, 50*i))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// textFace is the font used for all text. It is a small bitmap font which is rendered
+// at its native size and then scaled, so no font files are needed.
+var textFace = basicfont.Face7x13
+
+// renderText draws text in the given color on a transparent image of the given height. Scaling
+// premultiplies the straight alpha text once, so the result is a premultiplied *image.RGBA.
+func renderText(text string, height int, c color.Color) image.Image {
+	native := nativeText(text, c)
+	if native.Rect.Empty() || height <= 0 {
+		return image.NewNRGBA(image.Rectangle{})
+	}
+	return resize.Resize(0, uint(height), native, resize.Bilinear)
+}
+
+// nativeText draws text in the given color on a transparent image, at the size of the font
+func nativeText(text string, c color.Color) *image.NRGBA {
+	metrics := textFace.Metrics()
+	lineHeight := (metrics.Ascent + metrics.Descent).Ceil()
+	drawer := font.Drawer{Face: textFace, Src: image.NewUniform(c)}
+	width := drawer.MeasureString(text).Ceil()
+	if width == 0 {
+		return image.NewNRGBA(image.Rectangle{})
+	}
+
+	native := image.NewNRGBA(image.Rect(0, 0, width, lineHeight))
+	drawer.Dst = native
+	drawer.Dot = fixed.P(0, metrics.Ascent.Ceil())
+	drawer.DrawString(text)
+	return native
+}
+
+// textTokens lists the tokens of a -text-template, which are replaced for every photo:
+// its file name without and with the extension, and the date and year it was taken
+var textTokens = []string{"{name}", "{file}", "{date}", "{year}"}
+
+// checkTextTemplate returns an error when a -text-template has no text or an unknown token
+func checkTextTemplate(template string) error {
+	if strings.TrimSpace(template) == "" {
+		return errors.New("the text template is empty")
+	}
+	rest := template
+	for {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			return nil
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return fmt.Errorf("unclosed token in text template '%s'", template)
+		}
+		if token := rest[start : start+end+1]; !contains(textTokens, token) {
+			return fmt.Errorf("unknown token %s in text template '%s', use one of [%s]", token, template, strings.Join(textTokens, ", "))
+		}
+		rest = rest[start+end+1:]
+	}
+}
+
+// expandTextTemplate returns the text of a -text-template for the photo fname, taken at taken
+func expandTextTemplate(template string, fname string, taken time.Time) string {
+	base := path.Base(fname)
+	return strings.NewReplacer(
+		"{name}", strings.TrimSuffix(base, path.Ext(base)),
+		"{file}", base,
+		"{date}", taken.Format("2006-01-02"),
+		"{year}", taken.Format("2006"),
+	).Replace(template)
+}
+
+// makeBar returns a solid bar of the given size, with optional text aligned to the left
+// or right side with a margin of half the text height
+func makeBar(width, height int, barColor color.Color, text string, textColor color.Color, align string) image.Image {
+	bar := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(bar, bar.Bounds(), image.NewUniform(barColor), image.Point{0, 0}, draw.Src)
+	if text == "" {
+		return bar
+	}
+
+	textHeight := height * 6 / 10
+	rendered := renderText(text, textHeight, textColor)
+	margin := textHeight / 2
+	pos := image.Point{width - rendered.Bounds().Dx() - margin, (height - rendered.Bounds().Dy()) / 2}
+	if align == "left" {
+		pos.X = margin
+	}
+	draw.Draw(bar, rendered.Bounds().Add(pos), rendered, image.Point{0, 0}, draw.Over)
+	return bar
+}
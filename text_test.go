@@ -0,0 +1,51 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestTextPremultipliedOnce checks the soft edges of scaled text: white text premultiplied
+// once has the same value in every channel as its alpha, premultiplying it twice would
+// leave the edges darker than their alpha
+func TestTextPremultipliedOnce(t *testing.T) {
+	text, ok := renderText("Wm", 40, color.White).(*image.RGBA)
+	if !ok {
+		t.Fatalf("Got a %T, want an *image.RGBA", text)
+	}
+	edges := 0
+	for i := 0; i < len(text.Pix); i += 4 {
+		px := color.RGBA{text.Pix[i], text.Pix[i+1], text.Pix[i+2], text.Pix[i+3]}
+		if px.A == 0 || px.A == 0xff {
+			continue
+		}
+		edges++
+		if want := (color.RGBA{px.A, px.A, px.A, px.A}); !nearColor(px, want, 1) {
+			t.Fatalf("Got edge pixel %v, want %v", px, want)
+		}
+	}
+	if edges == 0 {
+		t.Fatal("The scaled text has no soft edges")
+	}
+}
+
+func TestBarColors(t *testing.T) {
+	tests := []struct {
+		name     string
+		barColor color.Color
+		want     color.RGBA
+	}{
+		{"opaque", color.NRGBA{0xff, 0, 0, 0xff}, color.RGBA{0xff, 0, 0, 0xff}},
+		{"semi-transparent", color.NRGBA{0xff, 100, 0, 128}, color.RGBA{128, 50, 0, 128}},
+		{"transparent", color.NRGBA{0xff, 0xff, 0xff, 0}, color.RGBA{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bar := makeBar(20, 10, test.barColor, "", color.White, "right")
+			if got := bar.At(5, 5); got != test.want {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
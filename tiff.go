@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+	"io/fs"
+	"math"
+	"sort"
+
+	"golang.org/x/image/tiff"
+)
+
+// maxTIFFPages limits the pages read from a TIFF file, so a malformed chain of pages that
+// loops back on itself can't keep the decoder busy
+const maxTIFFPages = 1024
+
+// readTIFFPages decodes every page of a TIFF file. The decoder only reads the first page of a
+// file, so every page is decoded from a view of the file whose header points to that page.
+func readTIFFPages(fsys fs.FS, fname string) ([]image.Image, error) {
+	inputfile, reader, err := openSource(fsys, fname, "tiff")
+	if err != nil {
+		return nil, err
+	}
+	defer inputfile.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	order, offsets, err := tiffPageOffsets(data)
+	if err == nil && len(offsets) == 0 {
+		err = errBadMetadata
+	}
+	if err != nil {
+		return nil, &decodeError{err}
+	}
+
+	pages := make([]image.Image, 0, len(offsets))
+	for _, offset := range offsets {
+		page := &tiffPage{data: data}
+		copy(page.header[:], data[:8])
+		order.PutUint32(page.header[4:], offset)
+		img, err := tiff.Decode(io.NewSectionReader(page, 0, int64(len(data))))
+		if err != nil {
+			return nil, &decodeError{err}
+		}
+		pages = append(pages, img)
+	}
+	return pages, nil
+}
+
+// tiffPageOffsets returns the byte order of a TIFF file and the offsets of the directories
+// that describe its pages, in order
+func tiffPageOffsets(data []byte) (binary.ByteOrder, []uint32, error) {
+	if len(data) < 8 {
+		return nil, nil, errBadMetadata
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+	var offsets []uint32
+	seen := map[uint32]bool{}
+	for offset := order.Uint32(data[4:]); offset != 0; {
+		if seen[offset] || len(offsets) == maxTIFFPages || int64(offset)+2 > int64(len(data)) {
+			return nil, nil, errBadMetadata
+		}
+		seen[offset] = true
+		offsets = append(offsets, offset)
+		// The directory is a count of 12 byte entries, followed by the offset of the next one
+		next := int64(offset) + 2 + 12*int64(order.Uint16(data[offset:]))
+		if next+4 > int64(len(data)) {
+			return nil, nil, errBadMetadata
+		}
+		offset = order.Uint32(data[next:])
+	}
+	return order, offsets, nil
+}
+
+// tiffPage is a TIFF file with a replaced header, which the decoder reads through ReadAt
+type tiffPage struct {
+	data   []byte
+	header [8]byte
+}
+
+func (p *tiffPage) ReadAt(b []byte, off int64) (int, error) {
+	if off >= int64(len(p.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, p.data[off:])
+	if off < int64(len(p.header)) {
+		copy(b, p.header[off:])
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// multiPage is a watermarked TIFF file with several pages. It is an image of its first page,
+// which the contact sheet and reports use, and encodeImage writes all pages to TIFF output.
+type multiPage struct {
+	image.Image
+	pages []image.Image
+}
+
+// TIFF tags and field types written by encodeTIFF
+const (
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagPhotometric     = 262
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagXResolution     = 282
+	tagYResolution     = 283
+	tagPlanarConfig    = 284
+	tagResolutionUnit  = 296
+	tagExtraSamples    = 338
+	tagICCProfile      = 34675
+
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+)
+
+// tiffEntry is a field of a TIFF directory, with its value encoded
+type tiffEntry struct {
+	tag, fieldType uint16
+	count          uint32
+	value          []byte
+}
+
+// encodeTIFF writes the pages to w as a TIFF file, with 8 bits per channel and alpha and
+// deflate compression. With dpi the print density is stored, and with srgb the sRGB profile.
+func encodeTIFF(w io.Writer, pages []image.Image, dpi int, srgb bool) error {
+	order := binary.LittleEndian
+	short := func(values ...uint16) []byte {
+		var b []byte
+		for _, v := range values {
+			b = order.AppendUint16(b, v)
+		}
+		return b
+	}
+	long := func(v uint32) []byte { return order.AppendUint32(nil, v) }
+
+	out := []byte("II*\x00\x00\x00\x00\x00")
+	next := 4 // where the offset of the next directory goes
+	for _, page := range pages {
+		// The premultiplied colors of an *image.RGBA are stored as is, as associated alpha
+		rgba := toRGBA(page)
+		var strip bytes.Buffer
+		zw, _ := zlib.NewWriterLevel(&strip, zlib.BestSpeed)
+		if _, err := zw.Write(rgba.Pix); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		stripOffset := len(out)
+		out = append(out, strip.Bytes()...)
+		if len(out)%2 == 1 {
+			out = append(out, 0) // offsets must be even
+		}
+
+		size := rgba.Rect.Size()
+		entries := []tiffEntry{
+			{tagImageWidth, typeLong, 1, long(uint32(size.X))},
+			{tagImageLength, typeLong, 1, long(uint32(size.Y))},
+			{tagBitsPerSample, typeShort, 4, short(8, 8, 8, 8)},
+			{tagCompression, typeShort, 1, short(8)}, // deflate
+			{tagPhotometric, typeShort, 1, short(2)}, // RGB
+			{tagStripOffsets, typeLong, 1, long(uint32(stripOffset))},
+			{tagSamplesPerPixel, typeShort, 1, short(4)},
+			{tagRowsPerStrip, typeLong, 1, long(uint32(size.Y))},
+			{tagStripByteCounts, typeLong, 1, long(uint32(strip.Len()))},
+			{tagPlanarConfig, typeShort, 1, short(1)}, // interleaved
+			{tagExtraSamples, typeShort, 1, short(1)}, // associated alpha
+		}
+		if dpi > 0 {
+			resolution := append(long(uint32(dpi)), long(1)...)
+			entries = append(entries,
+				tiffEntry{tagXResolution, typeRational, 1, resolution},
+				tiffEntry{tagYResolution, typeRational, 1, resolution},
+				tiffEntry{tagResolutionUnit, typeShort, 1, short(2)}, // inch
+			)
+		}
+		if srgb {
+			entries = append(entries, tiffEntry{tagICCProfile, typeUndefined, uint32(len(srgbICC)), srgbICC})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+		// The directory, followed by the values that don't fit in its entries
+		ifdOffset := len(out)
+		if int64(ifdOffset) > math.MaxUint32 {
+			return errBadMetadata
+		}
+		order.PutUint32(out[next:], uint32(ifdOffset))
+		extra := ifdOffset + 2 + 12*len(entries) + 4
+		var values []byte
+		out = append(out, short(uint16(len(entries)))...)
+		for _, e := range entries {
+			out = append(out, short(e.tag, e.fieldType)...)
+			out = append(out, long(e.count)...)
+			if len(e.value) <= 4 {
+				out = append(out, e.value...)
+				out = append(out, make([]byte, 4-len(e.value))...)
+				continue
+			}
+			out = append(out, long(uint32(extra+len(values)))...)
+			values = append(values, e.value...)
+			if len(values)%2 == 1 {
+				values = append(values, 0)
+			}
+		}
+		next = len(out)
+		out = append(out, 0, 0, 0, 0)
+		out = append(out, values...)
+	}
+	_, err := w.Write(out)
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// twoPageTIFF returns the pages and the encoded file of a TIFF with two pages of different sizes
+func twoPageTIFF(t *testing.T) ([]image.Image, []byte) {
+	t.Helper()
+	second := image.NewRGBA(image.Rect(0, 0, 48, 64))
+	for i := range second.Pix {
+		second.Pix[i] = 0x40
+		if i%4 == 3 {
+			second.Pix[i] = 0xff
+		}
+	}
+	pages := []image.Image{testPhoto(64, 48), second}
+	var data bytes.Buffer
+	if err := encodeTIFF(&data, pages, 300, false); err != nil {
+		t.Fatal(err)
+	}
+	return pages, data.Bytes()
+}
+
+// samePixels reports whether a and b have the same size and colors
+func samePixels(a, b image.Image) bool {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return false
+	}
+	for y := 0; y < a.Bounds().Dy(); y++ {
+		for x := 0; x < a.Bounds().Dx(); x++ {
+			ca := color.RGBAModel.Convert(a.At(a.Bounds().Min.X+x, a.Bounds().Min.Y+y))
+			cb := color.RGBAModel.Convert(b.At(b.Bounds().Min.X+x, b.Bounds().Min.Y+y))
+			if ca != cb {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestReadTIFFPages(t *testing.T) {
+	pages, data := twoPageTIFF(t)
+	read, err := readTIFFPages(fstest.MapFS{"scan.tif": {Data: data}}, "scan.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(pages) {
+		t.Fatalf("Got %d pages, want %d", len(read), len(pages))
+	}
+	for i := range pages {
+		if !samePixels(read[i], pages[i]) {
+			t.Errorf("Page %d differs from the page written", i+1)
+		}
+	}
+}
+
+// TestTIFFPageLoop reads a TIFF whose last page points back to the first one
+func TestTIFFPageLoop(t *testing.T) {
+	_, data := twoPageTIFF(t)
+	order, offsets, err := tiffPageOffsets(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := offsets[len(offsets)-1]
+	next := last + 2 + 12*uint32(order.Uint16(data[last:]))
+	order.PutUint32(data[next:], offsets[0])
+	_, err = readTIFFPages(fstest.MapFS{"loop.tif": {Data: data}}, "loop.tif")
+	var decodeErr *decodeError
+	if !errors.As(err, &decodeErr) {
+		t.Errorf("Got error %v, want a decode error", err)
+	}
+}
+
+// TestTIFFPagesWatermarked watermarks a two-page TIFF and checks both pages of the output
+func TestTIFFPagesWatermarked(t *testing.T) {
+	dir := t.TempDir()
+	newTestSource(t, dir)
+	pages, data := twoPageTIFF(t)
+	if err := os.WriteFile(filepath.Join(dir, "photos", "scan.tif"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, out := runTool(t, dir, nil, "-source", "photos", "-target", "target", "-output-format", "tiff"); code != exitSuccess {
+		t.Fatalf("The run exited with %d:\n%s", code, out)
+	}
+	outputs, _ := filepath.Glob(filepath.Join(dir, "target", "scan.*"))
+	if len(outputs) != 1 {
+		t.Fatalf("Got outputs %v, want one", outputs)
+	}
+	read, err := readTIFFPages(osFS{}, outputs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(pages) {
+		t.Fatalf("Got %d pages, want %d", len(read), len(pages))
+	}
+	for i, page := range pages {
+		if read[i].Bounds().Size() != page.Bounds().Size() {
+			t.Errorf("Page %d has size %v, want %v", i+1, read[i].Bounds().Size(), page.Bounds().Size())
+			continue
+		}
+		// The watermark is in the bottom right corner, the top left stays the same
+		half := page.Bounds().Size().Div(2)
+		top := image.Rectangle{Max: half}
+		bottom := image.Rectangle{Min: half, Max: page.Bounds().Size()}
+		if !samePixels(subImage(read[i], top), subImage(page, top)) {
+			t.Errorf("Page %d changed outside the watermark", i+1)
+		}
+		if samePixels(subImage(read[i], bottom), subImage(page, bottom)) {
+			t.Errorf("Page %d was not watermarked", i+1)
+		}
+	}
+}
+
+// subImage returns the part r of img
+func subImage(img image.Image, r image.Rectangle) image.Image {
+	return img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}).SubImage(r.Add(img.Bounds().Min))
+}
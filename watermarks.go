@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+)
+
+// watermarkSpec is the sidecar file of a watermark in -watermark-dir, logo.json for logo.png,
+// which sets where and how it is drawn. Settings that are left out use those of the run.
+type watermarkSpec struct {
+	Location string   `json:"location"`
+	Opacity  *int     `json:"opacity"`
+	Scale    *float64 `json:"scale"`
+}
+
+// loadWatermarkDir reads every PNG and SVG watermark in the folder dir, sorted by name, which
+// is the order -watermark-dir draws them in, or for -watermark-random-dir. The sidecar files
+// are all checked up front, so a mistake in one doesn't show halfway through the run.
+func loadWatermarkDir(dir string, params parameters) ([]watermarkLayer, error) {
+	entries, err := os.ReadDir(dir) // sorted by name
+	if err != nil {
+		return nil, err
+	}
+	var layers []watermarkLayer
+	for _, entry := range entries {
+		ext := strings.ToLower(path.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".png" && ext != ".svg") {
+			continue
+		}
+		fname := path.Join(dir, entry.Name())
+		img, err := loadWatermarkFile(fname, params)
+		if err != nil {
+			return nil, fmt.Errorf("could not read watermark '%s': %w", fname, err)
+		}
+		layer := watermarkLayer{image: img, name: entry.Name(), opacity: -1}
+		if err := readWatermarkSpec(strings.TrimSuffix(fname, path.Ext(fname))+".json", &layer); err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("there are no PNG or SVG watermarks in '%s'", dir)
+	}
+	return layers, nil
+}
+
+// randomWatermark picks the watermark of -watermark-random-dir for the photo relPath, as an
+// index among n. Every photo gets its own generator, seeded with the seed and its path, so the
+// workers don't share one and a run picks the same watermarks whatever order they finish in.
+func randomWatermark(seed int64, relPath string, n int) int {
+	h := fnv.New64a()
+	h.Write([]byte(relPath))
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64()))).Intn(n)
+}
+
+// readWatermarkSpec applies the sidecar file fname of a watermark to its layer, if it exists
+func readWatermarkSpec(fname string, layer *watermarkLayer) error {
+	data, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var spec watermarkSpec
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return fmt.Errorf("invalid watermark settings '%s': %w", fname, err)
+	}
+	if spec.Location != "" && !contains(locations, spec.Location) {
+		return fmt.Errorf("unknown location '%s' in '%s', use one of [%s]", spec.Location, fname, strings.Join(locations, ", "))
+	}
+	if spec.Opacity != nil && (*spec.Opacity < 0 || *spec.Opacity > 100) {
+		return fmt.Errorf("opacity in '%s' must be between 0 and 100, got %d", fname, *spec.Opacity)
+	}
+	if spec.Scale != nil && !(*spec.Scale > 0 && *spec.Scale <= 1) {
+		return fmt.Errorf("scale in '%s' must be greater than 0 and at most 1, got %g", fname, *spec.Scale)
+	}
+
+	layer.location = spec.Location
+	if spec.Opacity != nil {
+		layer.opacity = *spec.Opacity
+	}
+	if spec.Scale != nil {
+		layer.scale = *spec.Scale
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadWatermarkSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string // the sidecar file, empty for none
+		want    watermarkLayer
+		wantErr string
+	}{
+		{"no sidecar", "", watermarkLayer{opacity: -1}, ""},
+		{"all settings", `{"location": "top-left", "opacity": 40, "scale": 0.5}`, watermarkLayer{location: "top-left", opacity: 40, scale: 0.5}, ""},
+		{"zero opacity", `{"opacity": 0}`, watermarkLayer{opacity: 0}, ""},
+		{"only scale", `{"scale": 1}`, watermarkLayer{opacity: -1, scale: 1}, ""},
+		{"unknown location", `{"location": "middle"}`, watermarkLayer{opacity: -1}, "unknown location 'middle'"},
+		{"opacity too high", `{"opacity": 101}`, watermarkLayer{opacity: -1}, "opacity in"},
+		{"zero scale", `{"scale": 0}`, watermarkLayer{opacity: -1}, "scale in"},
+		{"scale too high", `{"scale": 1.5}`, watermarkLayer{opacity: -1}, "scale in"},
+		{"unknown field", `{"size": 10}`, watermarkLayer{opacity: -1}, "invalid watermark settings"},
+		{"not json", `location: left`, watermarkLayer{opacity: -1}, "invalid watermark settings"},
+	}
+	dir := t.TempDir()
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fname := filepath.Join(dir, string(rune('a'+i))+".json")
+			if test.spec != "" {
+				if err := os.WriteFile(fname, []byte(test.spec), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			layer := watermarkLayer{opacity: -1}
+			err := readWatermarkSpec(fname, &layer)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("Got error %v, want one containing %q", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if layer != test.want {
+				t.Errorf("Got layer %+v, want %+v", layer, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadWatermarkDir(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "b.png"), testWatermark(40, 20))
+	writeTestImage(t, filepath.Join(dir, "a.png"), testWatermark(20, 40))
+	if err := os.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"location": "right", "opacity": 30}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "c.svg"), []byte(testSVG), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a watermark"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeTestImage(t, filepath.Join(dir, "old", "d.png"), testWatermark(20, 20))
+
+	layers, err := loadWatermarkDir(dir, parameters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, layer := range layers {
+		names = append(names, layer.name)
+	}
+	if want := []string{"a.png", "b.png", "c.svg"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("Got watermarks %v, want %v", names, want)
+	}
+	if layers[0].location != "right" || layers[0].opacity != 30 {
+		t.Errorf("Got %s at %d%% for a.png, want right at 30%%", layers[0].location, layers[0].opacity)
+	}
+	if layers[1].location != "" || layers[1].opacity != -1 {
+		t.Errorf("Got %s at %d%% for b.png, want the settings of the run", layers[1].location, layers[1].opacity)
+	}
+	if _, ok := layers[2].image.(*svgWatermark); !ok {
+		t.Errorf("Got a %T for c.svg, want an SVG watermark", layers[2].image)
+	}
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{"empty", map[string]string{"notes.txt": "no watermarks"}, "there are no PNG or SVG watermarks"},
+		{"broken watermark", map[string]string{"a.png": "not a watermark"}, "could not read watermark"},
+		{"broken sidecar", map[string]string{"a.svg": testSVG, "a.json": `{"opacity": 200}`}, "opacity in"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range test.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := loadWatermarkDir(dir, parameters{}); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRandomWatermark(t *testing.T) {
+	paths := []string{"a.jpg", "b.jpg", "trip/a.jpg", "trip/b.jpg", "c.png", "d.jpg", "e.jpg", "f.jpg"}
+	picks := func(seed int64) []int {
+		var picked []int
+		for _, relPath := range paths {
+			picked = append(picked, randomWatermark(seed, relPath, 3))
+		}
+		return picked
+	}
+	first := picks(7)
+	for i, pick := range first {
+		if pick < 0 || pick >= 3 {
+			t.Errorf("Got watermark %d for %s, want one of 3", pick, paths[i])
+		}
+	}
+
+	tests := []struct {
+		name string
+		seed int64
+		same bool
+	}{
+		{"same seed", 7, true},
+		{"other seed", 8, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := reflect.DeepEqual(picks(test.seed), first); same != test.same {
+				t.Errorf("Got the same picks %v with seed %d, want %v", same, test.seed, test.same)
+			}
+		})
+	}
+
+	// The pick only depends on the photo, not on which photos were picked for before
+	for i := len(paths) - 1; i >= 0; i-- {
+		if got := randomWatermark(7, paths[i], 3); got != first[i] {
+			t.Errorf("Got watermark %d for %s in reverse order, want %d", got, paths[i], first[i])
+		}
+	}
+	var counts [3]int
+	for _, pick := range first {
+		counts[pick]++
+	}
+	if counts[0] == len(paths) || counts[1] == len(paths) || counts[2] == len(paths) {
+		t.Errorf("Got the same watermark for every photo: %v", counts)
+	}
+}